@@ -6,6 +6,10 @@ import (
 
 type AppConfig struct {
 	FrontendURL string
+	// SessionStorage selects the session backend, "memory" or "mysql"
+	SessionStorage string
+	// SessionEncryptionKey is the base64 AES key used by the mysql backend
+	SessionEncryptionKey string
 }
 
 func GetConfig() AppConfig {
@@ -14,7 +18,14 @@ func GetConfig() AppConfig {
 		frontendURL = "http://localhost:5173"
 	}
 
+	sessionStorage := os.Getenv("SESSION_STORAGE")
+	if sessionStorage == "" {
+		sessionStorage = "memory"
+	}
+
 	return AppConfig{
-		FrontendURL: frontendURL,
+		FrontendURL:          frontendURL,
+		SessionStorage:       sessionStorage,
+		SessionEncryptionKey: os.Getenv("SESSION_ENCRYPTION_KEY"),
 	}
 }
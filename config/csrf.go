@@ -0,0 +1,30 @@
+package config
+
+import (
+	"net/url"
+	"os"
+	"strings"
+)
+
+// TrustedOrigins returns the origins allowed to send state-changing
+// requests along with the session cookie: the frontend plus any listed in
+// CSRF_TRUSTED_ORIGINS, e.g. the site embedding our widget.
+func TrustedOrigins() map[string]bool {
+	origins := make(map[string]bool)
+	for _, raw := range append([]string{GetConfig().FrontendURL}, splitList(os.Getenv("CSRF_TRUSTED_ORIGINS"))...) {
+		if origin := NormalizeOrigin(raw); origin != "" {
+			origins[origin] = true
+		}
+	}
+	return origins
+}
+
+// NormalizeOrigin reduces a URL to its lowercase scheme://host[:port], or
+// returns "" if it has no scheme and host.
+func NormalizeOrigin(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"context"
+	"go-rest-api/database"
+	"go-rest-api/internal/graph"
+	"log"
+	"os"
+	"time"
+)
+
+// GraphBaseURL is the Microsoft Graph endpoint, GRAPH_BASE_URL can point it
+// at a mock server.
+func GraphBaseURL() string {
+	if url := os.Getenv("GRAPH_BASE_URL"); url != "" {
+		return url
+	}
+	return graph.DefaultBaseURL
+}
+
+// MicrosoftGraph returns the service for making Graph calls as a user, or
+// nil if Microsoft login or token storage is not configured.
+func MicrosoftGraph() *graph.Service {
+	if microsoftOAuthConfig == nil || Tokens == nil {
+		return nil
+	}
+	return &graph.Service{
+		DB:      database.DB,
+		OAuth:   microsoftOAuthConfig,
+		Tokens:  Tokens,
+		BaseURL: GraphBaseURL(),
+	}
+}
+
+// SetupGraphSync starts syncing Microsoft profiles in the background every
+// GRAPH_SYNC_INTERVAL (default 24h, "0" disables it).
+func SetupGraphSync() {
+	service := MicrosoftGraph()
+	if service == nil {
+		return
+	}
+
+	interval := 24 * time.Hour
+	if v := os.Getenv("GRAPH_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid GRAPH_SYNC_INTERVAL: %v", err)
+		}
+		interval = d
+	}
+	if interval <= 0 {
+		log.Println("Microsoft profile sync disabled")
+		return
+	}
+
+	syncer := &graph.Syncer{Service: service, Interval: interval}
+	go syncer.Run(context.Background())
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"go-rest-api/internal/jwtauth"
+	"log"
+	"os"
+	"time"
+)
+
+const defaultAccessTokenTTL = 15 * time.Minute
+
+// JWT issues the access tokens of the token login mode.
+var JWT *jwtauth.Issuer
+
+// SetupJWT loads the ES256 signing keys from JWT_SIGNING_KEYS, a comma
+// separated list of PEM files. The first key signs, the others are still
+// published in the JWKS. To rotate, put a new key first and drop the old one
+// once JWT_ACCESS_TTL has passed. Without keys a random one is used, which
+// logs out every token client when the process restarts.
+func SetupJWT() {
+	var keys []*ecdsa.PrivateKey
+	for _, path := range splitList(os.Getenv("JWT_SIGNING_KEYS")) {
+		key, err := jwtauth.LoadKeyFile(path)
+		if err != nil {
+			log.Fatalf("Failed to load JWT signing key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		log.Println("Warning: JWT_SIGNING_KEYS not set, using a random signing key")
+		key, err := jwtauth.GenerateKey()
+		if err != nil {
+			log.Fatalf("Failed to generate JWT signing key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	keyset, err := jwtauth.NewKeyset(keys)
+	if err != nil {
+		log.Fatalf("Invalid JWT signing keys: %v", err)
+	}
+
+	ttl := defaultAccessTokenTTL
+	if v := os.Getenv("JWT_ACCESS_TTL"); v != "" {
+		ttl, err = time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("Invalid JWT_ACCESS_TTL %q", v)
+		}
+	}
+
+	issuer := os.Getenv("JWT_ISSUER")
+	if issuer == "" {
+		issuer = "socmed"
+	}
+
+	JWT = &jwtauth.Issuer{
+		Keys:     keyset,
+		Issuer:   issuer,
+		Audience: issuer,
+		TTL:      ttl,
+	}
+}
+
+// MobileRedirectURL is where external logins in token mode send the app its
+// one-time login code, from MOBILE_REDIRECT_URL. Empty disables token mode
+// for external logins.
+func MobileRedirectURL() string {
+	return os.Getenv("MOBILE_REDIRECT_URL")
+}
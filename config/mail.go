@@ -0,0 +1,58 @@
+package config
+
+import (
+	"go-rest-api/internal/mailer"
+	"log"
+	"os"
+)
+
+var Mailer mailer.Mailer
+
+// SetupMailer picks the mail backend from MAILER: "smtp", "file" (a maildir
+// under MAILDIR_PATH) or "memory".
+func SetupMailer() {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	backend := os.Getenv("MAILER")
+	if backend == "" {
+		backend = "file"
+	}
+
+	switch backend {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		if host == "" {
+			log.Fatal("Missing required SMTP_HOST environment variable")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		Mailer = &mailer.SMTP{
+			Host:     host,
+			Port:     port,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	case "file":
+		dir := os.Getenv("MAILDIR_PATH")
+		if dir == "" {
+			dir = "maildir"
+		}
+		m, err := mailer.NewFile(dir, from)
+		if err != nil {
+			log.Fatalf("Failed to set up maildir: %v", err)
+		}
+		Mailer = m
+	case "memory":
+		Mailer = &mailer.Memory{From: from}
+	default:
+		log.Fatalf("Unknown MAILER %q", backend)
+	}
+
+	log.Printf("Using %s mailer", backend)
+}
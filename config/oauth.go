@@ -1,31 +1,89 @@
 package config
 
 import (
+	"context"
+	"go-rest-api/internal/oauth"
 	"log"
 	"os"
+	"regexp"
+	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 )
 
-func MicrosoftOAuthConfig() *oauth2.Config {
+const microsoftLoginHost = "https://login.microsoftonline.com/"
+
+var (
+	microsoftOAuthConfig *oauth2.Config
+	microsoftVerifier    *oauth.MicrosoftVerifier
+	microsoftPolicy      oauth.MicrosoftPolicy
+)
+
+// Tenants are "common", "organizations", "consumers", a tenant ID or one of
+// a tenant's domain names.
+var microsoftTenantPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9.-]*$`)
+
+// SetupMicrosoftOAuth builds the Microsoft login config once at startup and
+// loads the tenant's signing keys. Without the MICROSOFT_* variables
+// Microsoft login is left disabled.
+//
+// MICROSOFT_TENANT picks who can sign in (default consumers), and
+// MICROSOFT_ALLOWED_TENANTS, MICROSOFT_ALLOWED_DOMAINS and
+// MICROSOFT_GROUP_ROLES ("groupID=role,...") narrow it down further.
+// Personal accounts are only let in on the consumers tenant unless
+// MICROSOFT_ALLOW_PERSONAL_ACCOUNTS is true. Accounts from the old email
+// based login are claimed by their work account's email only when the app
+// registration emits the xms_edov optional claim.
+func SetupMicrosoftOAuth() {
 	clientID := os.Getenv("MICROSOFT_CLIENT_ID")
 	clientSecret := os.Getenv("MICROSOFT_CLIENT_SECRET")
 	redirectURL := os.Getenv("MICROSOFT_REDIRECT_URL")
 
-	// Log values for debugging (remove in production)
-	log.Printf("OAuth Config - ClientID: %s, RedirectURL: %s",
-		clientID, redirectURL)
-
 	if clientID == "" || clientSecret == "" || redirectURL == "" {
-		log.Fatal("Missing required OAuth environment variables")
+		log.Println("Warning: Microsoft OAuth environment variables not set, Microsoft login disabled")
+		return
 	}
 
-	return &oauth2.Config{
+	tenant := os.Getenv("MICROSOFT_TENANT")
+	if tenant == "" {
+		tenant = "consumers"
+	}
+	if !microsoftTenantPattern.MatchString(tenant) {
+		log.Fatalf("Invalid MICROSOFT_TENANT %q", tenant)
+	}
+	microsoftAuthority := microsoftLoginHost + tenant
+
+	allowPersonal := tenant == "consumers" || os.Getenv("MICROSOFT_ALLOW_PERSONAL_ACCOUNTS") == "true"
+	microsoftPolicy = oauth.MicrosoftPolicy{
+		AllowedTenants:        splitList(os.Getenv("MICROSOFT_ALLOWED_TENANTS")),
+		AllowedDomains:        splitList(os.Getenv("MICROSOFT_ALLOWED_DOMAINS")),
+		AllowPersonalAccounts: allowPersonal,
+		GroupRoles:            make(map[string]string),
+	}
+	for _, pair := range splitList(os.Getenv("MICROSOFT_GROUP_ROLES")) {
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok || group == "" || role == "" {
+			log.Fatalf("Invalid MICROSOFT_GROUP_ROLES entry %q, expected groupID=role", pair)
+		}
+		microsoftPolicy.GroupRoles[strings.ToLower(strings.TrimSpace(group))] = strings.TrimSpace(role)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	verifier, err := oauth.NewMicrosoftVerifier(ctx, nil, microsoftAuthority+"/v2.0", clientID)
+	if err != nil {
+		log.Fatalf("Failed to load Microsoft signing keys: %v", err)
+	}
+
+	microsoftVerifier = verifier
+	microsoftOAuthConfig = &oauth2.Config{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://login.microsoftonline.com/consumers/oauth2/v2.0/authorize",
-			TokenURL: "https://login.microsoftonline.com/consumers/oauth2/v2.0/token",
+			AuthURL:  microsoftAuthority + "/oauth2/v2.0/authorize",
+			TokenURL: microsoftAuthority + "/oauth2/v2.0/token",
 		},
 		RedirectURL: redirectURL,
 		Scopes: []string{
@@ -36,4 +94,31 @@ func MicrosoftOAuthConfig() *oauth2.Config {
 			"offline_access",
 		},
 	}
+	log.Printf("Microsoft OAuth configured for tenant %s, redirect URL: %s", tenant, redirectURL)
+}
+
+// splitList splits a comma separated environment variable.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// MicrosoftOAuthConfig returns the Microsoft login config, or nil if
+// Microsoft login is not configured.
+func MicrosoftOAuthConfig() *oauth2.Config {
+	return microsoftOAuthConfig
+}
+
+func MicrosoftIDTokenVerifier() *oauth.MicrosoftVerifier {
+	return microsoftVerifier
+}
+
+// MicrosoftLoginPolicy returns the restrictions on Microsoft accounts.
+func MicrosoftLoginPolicy() oauth.MicrosoftPolicy {
+	return microsoftPolicy
 }
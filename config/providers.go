@@ -0,0 +1,103 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"go-rest-api/internal/oauth"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+var Providers *oauth.Registry
+
+// SetupProviders loads the external login providers served under
+// /auth/:provider. They come from the JSON file named by OAUTH_PROVIDERS_FILE
+// if set, otherwise from OAUTH_PROVIDERS, a comma separated list of names,
+// each configured through OAUTH_<NAME>_* variables.
+func SetupProviders() {
+	var configs []oauth.ProviderConfig
+	if path := os.Getenv("OAUTH_PROVIDERS_FILE"); path != "" {
+		configs = providersFromFile(path)
+	} else {
+		configs = providersFromEnv()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	Providers = oauth.NewRegistry()
+	for _, cfg := range configs {
+		p, err := oauth.New(ctx, cfg, nil)
+		if err != nil {
+			log.Fatalf("Failed to set up login provider %q: %v", cfg.Name, err)
+		}
+		Providers.Register(p)
+		log.Printf("Registered login provider %s", p.Name)
+	}
+}
+
+// providersFromFile reads a JSON array of provider configs. ${VAR} references
+// are expanded so secrets can stay in the environment.
+func providersFromFile(path string) []oauth.ProviderConfig {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read providers file: %v", err)
+	}
+
+	var configs []oauth.ProviderConfig
+	if err := json.Unmarshal([]byte(os.ExpandEnv(string(data))), &configs); err != nil {
+		log.Fatalf("Failed to parse providers file: %v", err)
+	}
+	return configs
+}
+
+func providersFromEnv() []oauth.ProviderConfig {
+	var configs []oauth.ProviderConfig
+	for _, name := range strings.Split(os.Getenv("OAUTH_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OAUTH_" + strings.ToUpper(name) + "_"
+		env := func(key string) string {
+			return os.Getenv(prefix + key)
+		}
+
+		providerType := env("TYPE")
+		if providerType == "" {
+			providerType = "oidc"
+			if name == "google" || name == "github" {
+				providerType = name
+			}
+		}
+
+		var scopes []string
+		if s := env("SCOPES"); s != "" {
+			scopes = strings.Split(s, ",")
+		}
+
+		configs = append(configs, oauth.ProviderConfig{
+			Name:         name,
+			Type:         providerType,
+			DisplayName:  env("DISPLAY_NAME"),
+			ClientID:     env("CLIENT_ID"),
+			ClientSecret: env("CLIENT_SECRET"),
+			RedirectURL:  env("REDIRECT_URL"),
+			Issuer:       env("ISSUER"),
+			Scopes:       scopes,
+			AuthURL:      env("AUTH_URL"),
+			TokenURL:     env("TOKEN_URL"),
+			UserInfoURL:  env("USER_INFO_URL"),
+			Claims: oauth.ClaimMapping{
+				Subject:       env("CLAIM_SUBJECT"),
+				Email:         env("CLAIM_EMAIL"),
+				EmailVerified: env("CLAIM_EMAIL_VERIFIED"),
+				Username:      env("CLAIM_USERNAME"),
+				Avatar:        env("CLAIM_AVATAR"),
+			},
+		})
+	}
+	return configs
+}
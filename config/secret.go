@@ -0,0 +1,32 @@
+package config
+
+import (
+	"crypto/rand"
+	"log"
+	"os"
+	"sync"
+)
+
+var (
+	signingKey     []byte
+	signingKeyOnce sync.Once
+)
+
+// SigningKey returns the key used to sign links and tokens handed out by the
+// API, taken from APP_SECRET. Without it a random key is used, which means
+// signed links stop working when the process restarts.
+func SigningKey() []byte {
+	signingKeyOnce.Do(func() {
+		if secret := os.Getenv("APP_SECRET"); secret != "" {
+			signingKey = []byte(secret)
+			return
+		}
+
+		log.Println("Warning: APP_SECRET not set, using a random signing key")
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			log.Fatalf("Failed to generate signing key: %v", err)
+		}
+	})
+	return signingKey
+}
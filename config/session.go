@@ -1,24 +1,88 @@
 package config
 
 import (
+	"encoding/base64"
+	"go-rest-api/database"
+	"go-rest-api/internal/storage"
+	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
 )
 
+const SessionExpiration = 24 * time.Hour
+
+const SessionCookieName = "session_id"
+
 var Store *session.Store
 
+// SessionIndex maps users to their sessions so they can be listed and revoked
+var SessionIndex *storage.SessionIndex
+
 func SetupSessionStore() {
+	cfg := GetConfig()
+
+	dataTable := ""
+	if cfg.SessionStorage == "mysql" {
+		dataTable = "sessions"
+	}
+	SessionIndex = storage.NewSessionIndex(database.DB, dataTable)
+
+	// SameSite=None lets an embedded widget on another site use the session.
+	// Browsers only accept it on secure cookies, and it leaves CSRF
+	// protection entirely to the CSRF middleware.
+	sameSite := "Lax"
+	switch strings.ToLower(os.Getenv("SESSION_COOKIE_SAMESITE")) {
+	case "", "lax":
+	case "strict":
+		sameSite = "Strict"
+	case "none":
+		sameSite = "None"
+	default:
+		log.Fatalf("Unknown SESSION_COOKIE_SAMESITE %q", os.Getenv("SESSION_COOKIE_SAMESITE"))
+	}
+
 	Store = session.New(session.Config{
-		CookieName:     "session_id",
-		Expiration:     24 * time.Hour,
+		Storage:        sessionStorage(cfg),
+		CookieName:     SessionCookieName,
+		Expiration:     SessionExpiration,
 		CookieHTTPOnly: true,
 		CookiePath:     "/",
-		CookieSameSite: "Lax",
+		CookieSameSite: sameSite,
+		CookieSecure:   sameSite == "None",
 	})
 }
 
+// sessionStorage returns the storage configured by SESSION_STORAGE. A nil
+// storage makes Fiber fall back to its in-memory store.
+func sessionStorage(cfg AppConfig) fiber.Storage {
+	switch cfg.SessionStorage {
+	case "memory":
+		return nil
+	case "mysql":
+		key, err := base64.StdEncoding.DecodeString(cfg.SessionEncryptionKey)
+		if err != nil || len(key) != 32 {
+			log.Fatal("SESSION_ENCRYPTION_KEY must be 32 base64 encoded bytes")
+		}
+
+		store, err := storage.NewMySQL(database.DB, storage.MySQLConfig{
+			Table:         "sessions",
+			EncryptionKey: key,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up session storage: %v", err)
+		}
+		log.Println("Using MySQL session storage")
+		return store
+	default:
+		log.Fatalf("Unknown SESSION_STORAGE %q", cfg.SessionStorage)
+		return nil
+	}
+}
+
 func GetSession(c *fiber.Ctx) (*session.Session, error) {
 	return Store.Get(c)
 }
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"go-rest-api/database"
+	"go-rest-api/internal/storage"
+	"log"
+	"os"
+)
+
+// Tokens stores the OAuth tokens of linked identities, nil when
+// OAUTH_TOKEN_KEYS is not set.
+var Tokens *storage.TokenStore
+
+// TOTPSecrets encrypts two-factor secrets with the same keys, nil when
+// OAUTH_TOKEN_KEYS is not set.
+var TOTPSecrets *storage.TOTPSecrets
+
+// SetupTokenStore reads the encryption keys from OAUTH_TOKEN_KEYS, a comma
+// separated list of id:base64key with the current key first. To rotate, put
+// a new key in front and restart, tokens and TOTP secrets under older keys
+// are re-encrypted in the background. Once that is logged the old key can be
+// removed.
+func SetupTokenStore() {
+	spec := os.Getenv("OAUTH_TOKEN_KEYS")
+	if spec == "" {
+		log.Println("Warning: OAUTH_TOKEN_KEYS not set, provider tokens will not be stored and two-factor enrollment is off")
+		return
+	}
+
+	keys, err := storage.ParseKeyring(spec)
+	if err != nil {
+		log.Fatalf("Invalid OAUTH_TOKEN_KEYS: %v", err)
+	}
+	Tokens = storage.NewTokenStore(database.DB, keys)
+	TOTPSecrets = storage.NewTOTPSecrets(database.DB, keys)
+
+	go func() {
+		n, err := Tokens.Rotate()
+		if err != nil {
+			log.Printf("Error re-encrypting provider tokens: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Re-encrypted %d provider tokens with key %d", n, keys.Current())
+		}
+
+		n, err = TOTPSecrets.Rotate()
+		if err != nil {
+			log.Printf("Error encrypting TOTP secrets: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Encrypted %d TOTP secrets with key %d", n, keys.Current())
+		}
+	}()
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+var WebAuthn *webauthn.WebAuthn
+
+// SetupWebAuthn configures the passkey relying party. WEBAUTHN_RP_ID is the
+// domain passkeys are bound to and WEBAUTHN_RP_ORIGINS a comma separated list
+// of origins allowed to use them, defaulting to the frontend URL.
+func SetupWebAuthn() {
+	rpID := os.Getenv("WEBAUTHN_RP_ID")
+	if rpID == "" {
+		rpID = "localhost"
+	}
+
+	origins := []string{GetConfig().FrontendURL}
+	if env := os.Getenv("WEBAUTHN_RP_ORIGINS"); env != "" {
+		origins = strings.Split(env, ",")
+	}
+
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "SocMed",
+		RPOrigins:     origins,
+	})
+	if err != nil {
+		log.Fatalf("Failed to set up WebAuthn: %v", err)
+	}
+	WebAuthn = w
+}
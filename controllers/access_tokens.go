@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"database/sql"
+	"go-rest-api/database"
+	"go-rest-api/internal/models"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Personal access tokens start with accessTokenPrefix so they are easy to
+// spot in logs and secret scanners. Only their hash is stored.
+const (
+	accessTokenPrefix        = "smp_"
+	defaultAccessTokenExpiry = 30
+	maxAccessTokenExpiry     = 365
+	maxAccessTokenNameLength = 100
+	// accessTokenTouchInterval limits how often last_used_at is written
+	accessTokenTouchInterval = time.Minute
+)
+
+// lookupAccessToken returns the owner and scopes of a valid token, or a zero
+// user ID if the token is unknown, revoked or expired.
+func lookupAccessToken(raw string) (int, map[string]bool, error) {
+	var id, userID int
+	var scopes string
+	var lastUsed sql.NullTime
+	err := database.DB.QueryRow(`
+        SELECT id, user_id, scopes, last_used_at FROM personal_access_tokens
+        WHERE token_hash = ? AND revoked_at IS NULL AND expires_at > ?
+    `, hashToken(raw), time.Now()).Scan(&id, &userID, &scopes, &lastUsed)
+	if err == sql.ErrNoRows {
+		return 0, nil, nil
+	} else if err != nil {
+		log.Printf("Error looking up access token: %v", err)
+		return 0, nil, err
+	}
+
+	if !lastUsed.Valid || time.Since(lastUsed.Time) >= accessTokenTouchInterval {
+		_, err := database.DB.Exec("UPDATE personal_access_tokens SET last_used_at = ? WHERE id = ?", time.Now(), id)
+		if err != nil {
+			log.Printf("Error recording access token use: %v", err)
+		}
+	}
+
+	granted := make(map[string]bool)
+	for _, s := range strings.Fields(scopes) {
+		granted[s] = true
+	}
+	return userID, granted, nil
+}
+
+type createAccessTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays *int     `json:"expires_in_days"`
+}
+
+// CreateAccessToken issues a token. The raw token is only ever returned here.
+func (ac *AuthController) CreateAccessToken(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	var req createAccessTokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAccessTokenNameLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name is required and must be at most 100 characters",
+			"field": "name",
+		})
+	}
+
+	scopeSet := make(map[string]bool)
+	for _, s := range req.Scopes {
+		if !validScopes[s] {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Unknown scope: " + s,
+				"field": "scopes",
+			})
+		}
+		scopeSet[s] = true
+	}
+	if len(scopeSet) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one scope is required",
+			"field": "scopes",
+		})
+	}
+	scopes := make([]string, 0, len(scopeSet))
+	for s := range scopeSet {
+		scopes = append(scopes, s)
+	}
+	sort.Strings(scopes)
+
+	days := defaultAccessTokenExpiry
+	if req.ExpiresInDays != nil {
+		days = *req.ExpiresInDays
+	}
+	if days < 1 || days > maxAccessTokenExpiry {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Expiry must be between 1 and 365 days",
+			"field": "expires_in_days",
+		})
+	}
+
+	secret, err := newToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create token",
+		})
+	}
+	raw := accessTokenPrefix + secret
+
+	now := time.Now()
+	token := models.AccessToken{
+		Name:      req.Name,
+		Prefix:    raw[:len(accessTokenPrefix)+4],
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, days),
+	}
+	result, err := database.DB.Exec(`
+        INSERT INTO personal_access_tokens (user_id, name, token_hash, prefix, scopes, created_at, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, userID, token.Name, hashToken(raw), token.Prefix, strings.Join(scopes, " "), token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		log.Printf("Error creating access token: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create token",
+		})
+	}
+	id, _ := result.LastInsertId()
+	token.ID = int(id)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"token":  raw,
+		"data":   token,
+	})
+}
+
+func (ac *AuthController) ListAccessTokens(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	rows, err := database.DB.Query(`
+        SELECT id, name, prefix, scopes, created_at, expires_at, last_used_at
+        FROM personal_access_tokens
+        WHERE user_id = ? AND revoked_at IS NULL
+        ORDER BY created_at DESC
+    `, userID)
+	if err != nil {
+		log.Printf("Error listing access tokens: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list tokens",
+		})
+	}
+	defer rows.Close()
+
+	tokens := make([]models.AccessToken, 0)
+	for rows.Next() {
+		var t models.AccessToken
+		var scopes string
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Name, &t.Prefix, &scopes, &t.CreatedAt, &t.ExpiresAt, &lastUsed); err != nil {
+			log.Printf("Error scanning access token: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to list tokens",
+			})
+		}
+		t.Scopes = strings.Fields(scopes)
+		if lastUsed.Valid {
+			t.LastUsedAt = &lastUsed.Time
+		}
+		t.Expired = !t.ExpiresAt.After(time.Now())
+		tokens = append(tokens, t)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"count":  len(tokens),
+		"data":   tokens,
+	})
+}
+
+func (ac *AuthController) RevokeAccessToken(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid token ID",
+		})
+	}
+
+	result, err := database.DB.Exec(
+		"UPDATE personal_access_tokens SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		time.Now(), id, userID,
+	)
+	if err != nil {
+		log.Printf("Error revoking access token: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke token",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Token not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"id":     id,
+	})
+}
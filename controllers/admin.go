@@ -0,0 +1,405 @@
+package controllers
+
+import (
+	"database/sql"
+	"go-rest-api/database"
+	"go-rest-api/internal/auth"
+	"go-rest-api/internal/models"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,49}$`)
+
+// The admin role cannot lose these, or nobody could fix the matrix again
+var lockedAdminPermissions = []string{auth.PermRolesAssign, auth.PermRolesManage}
+
+// ListPermissions returns the permission catalog.
+func (ac *AuthController) ListPermissions(c *fiber.Ctx) error {
+	rows, err := database.DB.Query("SELECT name, description FROM permissions ORDER BY name")
+	if err != nil {
+		log.Printf("Error listing permissions: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list permissions",
+		})
+	}
+	defer rows.Close()
+
+	permissions := make([]models.Permission, 0)
+	for rows.Next() {
+		var p models.Permission
+		if err := rows.Scan(&p.Name, &p.Description); err != nil {
+			log.Printf("Error scanning permission: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to list permissions",
+			})
+		}
+		permissions = append(permissions, p)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"count":  len(permissions),
+		"data":   permissions,
+	})
+}
+
+// ListRoles returns every role with its permissions.
+func (ac *AuthController) ListRoles(c *fiber.Ctx) error {
+	rows, err := database.DB.Query(`
+        SELECT r.name, r.description, r.builtin, rp.permission
+        FROM roles r LEFT JOIN role_permissions rp ON rp.role = r.name
+        ORDER BY r.builtin DESC, r.created_at, r.name, rp.permission
+    `)
+	if err != nil {
+		log.Printf("Error listing roles: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list roles",
+		})
+	}
+	defer rows.Close()
+
+	roles := make([]models.Role, 0)
+	for rows.Next() {
+		var r models.Role
+		var permission sql.NullString
+		if err := rows.Scan(&r.Name, &r.Description, &r.Builtin, &permission); err != nil {
+			log.Printf("Error scanning role: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to list roles",
+			})
+		}
+		if len(roles) == 0 || roles[len(roles)-1].Name != r.Name {
+			r.Permissions = make([]string, 0)
+			roles = append(roles, r)
+		}
+		if permission.Valid {
+			last := &roles[len(roles)-1]
+			last.Permissions = append(last.Permissions, permission.String)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"count":  len(roles),
+		"data":   roles,
+	})
+}
+
+type roleRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// CreateRole adds a custom role.
+func (ac *AuthController) CreateRole(c *fiber.Ctx) error {
+	var req roleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	if !roleNamePattern.MatchString(req.Name) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Role names are 2-50 lowercase letters, digits, - or _",
+			"field": "name",
+		})
+	}
+	req.Description = strings.TrimSpace(req.Description)
+	if len(req.Description) > 255 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Description is too long",
+			"field": "description",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create role",
+		})
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO roles (name, description) VALUES (?, ?)", req.Name, req.Description)
+	if _, dup := duplicateKeyField(err); dup {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "A role with this name already exists",
+			"field": "name",
+		})
+	} else if err != nil {
+		log.Printf("Error creating role: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create role",
+		})
+	}
+
+	if ok, err := setRolePermissions(c, tx, req.Name, req.Permissions); !ok {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing role: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create role",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(models.Role{
+		Name:        req.Name,
+		Description: req.Description,
+		Permissions: normalizePermissions(req.Permissions),
+	})
+}
+
+type rolePermissionsRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+// UpdateRolePermissions replaces the permissions of a role.
+func (ac *AuthController) UpdateRolePermissions(c *fiber.Ctx) error {
+	name := c.Params("name")
+
+	var req rolePermissionsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	if name == "admin" {
+		perms := normalizePermissions(req.Permissions)
+		for _, locked := range lockedAdminPermissions {
+			if i := sort.SearchStrings(perms, locked); i == len(perms) || perms[i] != locked {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "The admin role must keep " + locked,
+					"field": "permissions",
+				})
+			}
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update role",
+		})
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT TRUE FROM roles WHERE name = ? FOR UPDATE", name).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Role not found",
+		})
+	} else if err != nil {
+		log.Printf("Error loading role: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update role",
+		})
+	}
+
+	if _, err := tx.Exec("DELETE FROM role_permissions WHERE role = ?", name); err != nil {
+		log.Printf("Error clearing role permissions: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update role",
+		})
+	}
+	if ok, err := setRolePermissions(c, tx, name, req.Permissions); !ok {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing role: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update role",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":      "success",
+		"name":        name,
+		"permissions": normalizePermissions(req.Permissions),
+	})
+}
+
+// setRolePermissions grants permissions to role inside tx. If a permission
+// does not exist it writes the error response and returns false.
+func setRolePermissions(c *fiber.Ctx, tx *sql.Tx, role string, permissions []string) (bool, error) {
+	for _, p := range normalizePermissions(permissions) {
+		var known bool
+		err := tx.QueryRow("SELECT TRUE FROM permissions WHERE name = ?", p).Scan(&known)
+		if err == sql.ErrNoRows {
+			return false, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Unknown permission: " + p,
+				"field": "permissions",
+			})
+		} else if err != nil {
+			log.Printf("Error checking permission: %v", err)
+			return false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to save role",
+			})
+		}
+
+		if _, err := tx.Exec("INSERT INTO role_permissions (role, permission) VALUES (?, ?)", role, p); err != nil {
+			log.Printf("Error granting permission: %v", err)
+			return false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to save role",
+			})
+		}
+	}
+	return true, nil
+}
+
+// normalizePermissions sorts permissions and drops duplicates.
+func normalizePermissions(permissions []string) []string {
+	seen := make(map[string]bool)
+	out := make([]string, 0, len(permissions))
+	for _, p := range permissions {
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// DeleteRole removes a custom role that is not assigned to anyone.
+func (ac *AuthController) DeleteRole(c *fiber.Ctx) error {
+	name := c.Params("name")
+
+	var builtin bool
+	err := database.DB.QueryRow("SELECT builtin FROM roles WHERE name = ?", name).Scan(&builtin)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Role not found",
+		})
+	} else if err != nil {
+		log.Printf("Error loading role: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete role",
+		})
+	}
+	if builtin {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Built-in roles cannot be deleted",
+		})
+	}
+
+	// users.role has no ON DELETE, so this fails while the role is assigned
+	_, err = database.DB.Exec("DELETE FROM roles WHERE name = ?", name)
+	if err != nil {
+		if isForeignKeyError(err) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "The role is still assigned to users",
+			})
+		}
+		log.Printf("Error deleting role: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete role",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"name":   name,
+	})
+}
+
+type assignRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// AssignRole sets the primary role of a user.
+func (ac *AuthController) AssignRole(c *fiber.Ctx) error {
+	targetID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var req assignRoleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to assign role",
+		})
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow("SELECT role FROM users WHERE id = ? FOR UPDATE", targetID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	} else if err != nil {
+		log.Printf("Error loading user role: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to assign role",
+		})
+	}
+
+	// Keep at least one admin around
+	if current == "admin" && req.Role != "admin" {
+		var admins int
+		err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'admin' FOR UPDATE").Scan(&admins)
+		if err != nil {
+			log.Printf("Error counting admins: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to assign role",
+			})
+		}
+		if admins <= 1 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Cannot remove the last admin",
+			})
+		}
+	}
+
+	_, err = tx.Exec("UPDATE users SET role = ? WHERE id = ?", req.Role, targetID)
+	if err != nil {
+		if isForeignKeyError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Unknown role: " + req.Role,
+				"field": "role",
+			})
+		}
+		log.Printf("Error assigning role: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to assign role",
+		})
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing role: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to assign role",
+		})
+	}
+
+	log.Printf("User %d set the role of user %d to %s", currentUserID(c), targetID, req.Role)
+
+	user, err := loadUser(targetID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+	return c.JSON(user)
+}
@@ -2,20 +2,21 @@ package controllers
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/json"
+	"database/sql"
 	"go-rest-api/config"
 	"go-rest-api/database"
+	"go-rest-api/internal/graph"
 	"go-rest-api/internal/models"
-	"io/ioutil"
+	"go-rest-api/internal/oauth"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
+	"golang.org/x/oauth2"
 )
 
 type AuthController struct {
@@ -29,13 +30,12 @@ func NewAuthController(store *session.Store) *AuthController {
 }
 
 func (ac *AuthController) MicrosoftLogin(c *fiber.Ctx) error {
-	b := make([]byte, 32)
-	if _, err := rand.Read(b); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to generate state",
+	oauthConfig := config.MicrosoftOAuthConfig()
+	if oauthConfig == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Microsoft login is not configured",
 		})
 	}
-	state := base64.StdEncoding.EncodeToString(b)
 
 	sess, err := ac.store.Get(c)
 	if err != nil {
@@ -43,24 +43,29 @@ func (ac *AuthController) MicrosoftLogin(c *fiber.Ctx) error {
 			"error": "Failed to get session",
 		})
 	}
-	sess.Set("oauth_state", state)
-	if err := sess.Save(); err != nil {
+
+	flow := oauthFlow{Provider: "microsoft"}
+	if ok, err := tokenModeParams(c, &flow); !ok {
+		return err
+	}
+	flow, err = beginOAuthFlow(sess, flow)
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to save session",
+			"error": "Failed to start login",
 		})
 	}
 
-	oauthConfig := config.MicrosoftOAuthConfig()
-
-	authURL := oauthConfig.AuthCodeURL(state)
-	log.Printf("Redirecting to: %s", authURL)
-
+	authURL, _ := providerAuthURL("microsoft", flow)
 	return c.Redirect(authURL)
 }
 
 func (ac *AuthController) MicrosoftCallback(c *fiber.Ctx) error {
-	queryParams := c.Queries()
-	log.Printf("Callback received. Query params: %v", queryParams)
+	oauthConfig := config.MicrosoftOAuthConfig()
+	if oauthConfig == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Microsoft login is not configured",
+		})
+	}
 
 	if errorMsg := c.Query("error"); errorMsg != "" {
 		errorDesc := c.Query("error_description")
@@ -79,140 +84,386 @@ func (ac *AuthController) MicrosoftCallback(c *fiber.Ctx) error {
 		})
 	}
 
-	sess, err := ac.store.Get(c)
+	sess, flow, valid, err := ac.takeOAuthFlow(c, "microsoft", c.Query("state"))
 	if err != nil {
 		log.Printf("Session error: %v", err)
-		return c.JSON(fiber.Map{
-			"error": "Failed to get session: " + err.Error(),
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
 		})
 	}
-
-	expectedState := sess.Get("oauth_state")
-	receivedState := c.Query("state")
-
-	if receivedState == "" || receivedState != expectedState {
-		log.Printf("State mismatch. Expected: %v, Received: %v", expectedState, receivedState)
+	if !valid {
+		log.Printf("Invalid or expired OAuth state in Microsoft callback")
 		return c.JSON(fiber.Map{
 			"error": "Invalid OAuth state",
 		})
 	}
 
-	oauthConfig := config.MicrosoftOAuthConfig()
-
-	log.Printf("Attempting to exchange code for token. Code length: %d", len(code))
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-	token, err := oauthConfig.Exchange(context.Background(), code)
+	token, err := oauthConfig.Exchange(ctx, code, oauth2.VerifierOption(flow.Verifier))
 	if err != nil {
 		log.Printf("Token exchange error: %v", err)
 		return c.JSON(fiber.Map{
-			"error": "Failed to exchange token: " + err.Error(),
+			"error": "Failed to exchange token",
 		})
 	}
 
-	client := oauthConfig.Client(context.Background(), token)
+	rawIDToken, _ := token.Extra("id_token").(string)
+	claims, err := config.MicrosoftIDTokenVerifier().Verify(ctx, rawIDToken, flow.Nonce)
+	if err != nil {
+		log.Printf("ID token verification failed: %v", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid ID token",
+		})
+	}
 
-	resp, err := client.Get("https://graph.microsoft.com/v1.0/me")
+	gc := &graph.Client{HTTP: oauthConfig.Client(ctx, token), BaseURL: config.GraphBaseURL()}
+	me, err := gc.Me(ctx)
 	if err != nil {
 		log.Printf("Failed to get user info: %v", err)
 		return c.Redirect("/login?error=profile_fetch_failed")
 	}
-	defer resp.Body.Close()
 
-	userData, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to read user data: " + err.Error(),
+	// The profile must belong to the account the verified ID token is for.
+	// The Graph id is the subject. Accounts from the email based login are
+	// never matched by mail or UPN, only claimed once by a verified ID token
+	// email.
+	if !graphIDMatchesOID(me.ID, claims.ObjectID) {
+		log.Printf("Graph profile %q does not match ID token oid %q", me.ID, claims.ObjectID)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Profile does not match ID token",
+		})
+	}
+
+	// Graph only fills in mail for addresses the tenant has confirmed
+	profile := &oauth.Profile{
+		Provider:      "microsoft",
+		Subject:       me.ID,
+		Email:         me.Mail,
+		EmailVerified: me.Mail != "",
+		Username:      me.DisplayName,
+		Claims: map[string]interface{}{
+			"tid":    claims.TenantID,
+			"groups": claims.Groups,
+			// Lets the first login claim an account from the email based
+			// login, see claimPendingIdentity
+			"verified_email": claims.VerifiedEmail(),
+		},
+	}
+	if profile.Email == "" {
+		profile.Email = me.UserPrincipalName
+	}
+	if claims.GroupsOverage() {
+		profile.Claims["groups_overage"] = true
+	}
+
+	if !config.MicrosoftLoginPolicy().Allows(claims.TenantID, me.UserPrincipalName) {
+		log.Printf("Microsoft login from tenant %s rejected by policy", claims.TenantID)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "This Microsoft account is not allowed to sign in",
 		})
 	}
 
-	var userInfo map[string]interface{}
-	if err := json.Unmarshal(userData, &userInfo); err != nil {
+	return ac.completeProviderLogin(c, sess, flow, profile, token)
+}
+
+// graphIDMatchesOID compares a Graph user id with an ID token oid. Work and
+// school accounts use the same GUID for both, personal accounts have a 16
+// digit hex id that is the tail of the oid.
+func graphIDMatchesOID(graphID, oid string) bool {
+	if graphID == "" {
+		return false
+	}
+	if strings.EqualFold(graphID, oid) {
+		return true
+	}
+	compactOID := strings.ToLower(strings.ReplaceAll(oid, "-", ""))
+	return len(graphID) == 16 && strings.HasSuffix(compactOID, strings.ToLower(graphID))
+}
+
+// redirectAfterLogin sends the browser back to the frontend once an external
+// login has completed.
+func redirectAfterLogin(c *fiber.Ctx) error {
+	if os.Getenv("USE_AUTH_CALLBACK") == "true" {
+		redirectURL := frontendURL() + "/auth/callback"
+		log.Printf("Redirecting to frontend auth callback: %s", redirectURL)
+		return c.Redirect(redirectURL)
+	} else {
+		redirectURL := frontendURL() + "/user"
+		log.Printf("Redirecting to frontend user view: %s", redirectURL)
+		return c.Redirect(redirectURL)
+	}
+}
+
+// redirectToTwoFactor sends a browser whose external login still needs the
+// second factor to the page that posts it to /api/login/2fa.
+func redirectToTwoFactor(c *fiber.Ctx) error {
+	return c.Redirect(frontendURL() + "/login/2fa")
+}
+
+func frontendURL() string {
+	if u := os.Getenv("FRONTEND_URL"); u != "" {
+		return u
+	}
+	return "http://localhost:5173"
+}
+
+type registerRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+func (ac *AuthController) Register(c *fiber.Ctx) error {
+	var req registerRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+
+	if err := validateUsername(req.Username); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+			"field": "username",
+		})
+	}
+	if err := validateEmail(req.Email); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+			"field": "email",
+		})
+	}
+	if err := validatePassword(req.Password); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+			"field": "password",
+		})
+	}
+
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to parse user data",
+			"error": "Failed to create user",
 		})
 	}
 
-	log.Printf("User info received: %v", userInfo)
+	user := models.User{
+		Username:  req.Username,
+		Email:     req.Email,
+		CreatedAt: time.Now(),
+	}
 
-	email, ok := userInfo["mail"].(string)
-	if !ok {
-		email, ok = userInfo["userPrincipalName"].(string)
-		if !ok {
-			email, ok = userInfo["id"].(string)
-			if !ok {
-				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-					"error": "No identifier found in user info",
-				})
+	result, err := database.DB.Exec(
+		"INSERT INTO users (username, email, password_hash, created_at) VALUES (?, ?, ?, ?)",
+		user.Username, user.Email, passwordHash, user.CreatedAt,
+	)
+	if err != nil {
+		if field, ok := duplicateKeyField(err); ok {
+			msg := "Account already exists"
+			if field != "" {
+				msg = "An account with this " + field + " already exists"
 			}
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": msg,
+				"field": field,
+			})
 		}
+		log.Printf("Error creating user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create user",
+		})
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Printf("Error getting new user ID: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create user",
+		})
+	}
+	user.ID = int(id)
+
+	if err := sendVerificationEmail(user.ID, user.Email); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(user)
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// Mode "token" ends the login in tokens instead of a session cookie
+	Mode string `json:"mode"`
+}
+
+func (ac *AuthController) Login(c *fiber.Ctx) error {
+	var req loginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	identifier := strings.ToLower(strings.TrimSpace(req.Email))
+	column := "email"
+	if identifier == "" {
+		identifier = strings.TrimSpace(req.Username)
+		column = "username"
+	}
+	if identifier == "" || req.Password == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Username or email and password are required",
+		})
+	}
+
+	ip := c.IP()
+	if locked, err := ac.checkLoginLock(c, loginScopeIP, ip); locked || err != nil {
+		return err
 	}
 
 	var user models.User
-	var userId int
-	err = database.DB.QueryRow("SELECT id, username, email FROM users WHERE email = ?", email).Scan(
-		&userId, &user.Username, &user.Email,
-	)
+	var passwordHash sql.NullString
+	err := database.DB.QueryRow(
+		"SELECT id, username, email, email_verified_at IS NOT NULL, password_hash, created_at FROM users WHERE "+column+" = ?",
+		identifier,
+	).Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified, &passwordHash, &user.CreatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error looking up user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+	found := err == nil
+	userKey := strconv.Itoa(user.ID)
+
+	if found {
+		if locked, err := ac.checkLoginLock(c, loginScopeUser, userKey); locked || err != nil {
+			return err
+		}
+	}
+
+	if !found || !passwordHash.Valid {
+		checkPassword(dummyPasswordHash, req.Password)
+		return ac.loginFailed(c, found, userKey, ip)
+	}
+	if !checkPassword(passwordHash.String, req.Password) {
+		return ac.loginFailed(c, found, userKey, ip)
+	}
+	if err := forgiveLoginFailures(loginScopeIP, ip, ipSuccessCredit); err != nil {
+		log.Printf("Error forgiving login failures: %v", err)
+	}
 
+	mfaRequired, err := totpEnabled(user.ID)
 	if err != nil {
-		displayName, _ := userInfo["displayName"].(string)
-		username := email
-		if displayName != "" {
-			username = displayName
-		} else if idx := strings.Index(email, "@"); idx > 0 {
-			username = email[:idx]
+		log.Printf("Error checking two-factor status: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+	if !mfaRequired {
+		if err := clearLoginFailures(loginScopeUser, userKey); err != nil {
+			log.Printf("Error clearing login failures: %v", err)
 		}
+	}
 
-		result, err := database.DB.Exec(
-			"INSERT INTO users (username, email, created_at) VALUES (?, ?, ?)",
-			username, email, time.Now(),
-		)
-		if err != nil {
-			log.Printf("Error creating user: %v", err)
+	// Token mode never touches the session
+	if req.Mode == "token" {
+		if mfaRequired {
+			return respondWithMFAToken(c, user.ID)
+		}
+		return ac.respondWithTokens(c, user.ID)
+	}
+
+	sess, err := ac.store.Get(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+	if err := rotateSession(sess); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to regenerate session",
+		})
+	}
+	if mfaRequired {
+		if err := startMFAChallenge(sess, user.ID); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": "Failed to create user",
+				"error": "Failed to save session",
 			})
 		}
-
-		id, _ := result.LastInsertId()
-		userId = int(id)
+		return c.JSON(fiber.Map{
+			"mfa_required": true,
+		})
 	}
-
-	sess.Set("user_id", userId)
-	if err := sess.Save(); err != nil {
+	if err := startSession(c, sess, user.ID); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to save session",
 		})
 	}
 
-	frontendURL := os.Getenv("FRONTEND_URL")
-	if frontendURL == "" {
-		frontendURL = "http://localhost:5173"
-	}
+	return c.JSON(user)
+}
 
-	if os.Getenv("USE_AUTH_CALLBACK") == "true" {
-		redirectURL := frontendURL + "/auth/callback"
-		log.Printf("Redirecting to frontend auth callback: %s", redirectURL)
-		return c.Redirect(redirectURL)
-	} else {
-		redirectURL := frontendURL + "/user"
-		log.Printf("Redirecting to frontend user view: %s", redirectURL)
-		return c.Redirect(redirectURL)
+// checkLoginLock writes a 429 response and returns true if the identifier is
+// currently locked out.
+func (ac *AuthController) checkLoginLock(c *fiber.Ctx, scope, identifier string) (bool, error) {
+	lockedUntil, err := loginLockedUntil(scope, identifier)
+	if err != nil {
+		log.Printf("Error checking login lock: %v", err)
+		return true, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+	if lockedUntil.IsZero() {
+		return false, nil
 	}
+
+	retryAfter := int(time.Until(lockedUntil).Seconds()) + 1
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	return true, c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error":       "Too many failed login attempts, try again later",
+		"retry_after": retryAfter,
+	})
 }
 
-func (ac *AuthController) Register(c *fiber.Ctx) error {
-	return c.SendString("Register endpoint")
+func (ac *AuthController) loginFailed(c *fiber.Ctx, userFound bool, userKey, ip string) error {
+	if err := recordLoginFailure(loginScopeIP, ip, ipFreeAttempts); err != nil {
+		log.Printf("Error recording login failure: %v", err)
+	}
+	if userFound {
+		if err := recordLoginFailure(loginScopeUser, userKey, userFreeAttempts); err != nil {
+			log.Printf("Error recording login failure: %v", err)
+		}
+	}
+
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		"error": "Invalid credentials",
+	})
 }
 
-func (ac *AuthController) Login(c *fiber.Ctx) error {
-	return c.SendString("Login endpoint")
+type logoutRequest struct {
+	All bool `json:"all"`
 }
 
 func (ac *AuthController) Logout(c *fiber.Ctx) error {
-	return c.SendString("Logout endpoint")
-}
+	var req logoutRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request payload",
+			})
+		}
+	}
+	all := req.All || c.QueryBool("all")
 
-func (ac *AuthController) User(c *fiber.Ctx) error {
 	sess, err := ac.store.Get(c)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -220,18 +471,54 @@ func (ac *AuthController) User(c *fiber.Ctx) error {
 		})
 	}
 
-	userID := sess.Get("user_id")
-	if userID == nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Not authenticated",
+	if all {
+		userID, err := sessionUserID(c, sess)
+		if err != nil {
+			log.Printf("Error reading session user: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to log out",
+			})
+		}
+		if userID == 0 {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Not authenticated",
+			})
+		}
+		if err := revokeAllSessions(userID); err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to log out",
+			})
+		}
+	}
+
+	if imp := sessionImpersonation(sess); imp != nil {
+		if _, err := recordImpersonation(c, imp, "stop", ""); err != nil {
+			log.Printf("Error recording impersonation: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to log out",
+			})
+		}
+	}
+
+	// Destroying the session also expires the session_id cookie
+	if err := endSession(sess); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to destroy session",
 		})
 	}
 
-	var user models.User
-	err = database.DB.QueryRow("SELECT id, username, email FROM users WHERE id = ?", userID).Scan(
-		&user.ID, &user.Username, &user.Email,
-	)
+	return c.JSON(fiber.Map{
+		"message": "Logged out",
+		"all":     all,
+	})
+}
+
+// User returns the current user, behind RequireAuth.
+func (ac *AuthController) User(c *fiber.Ctx) error {
+	userID := currentUserID(c)
 
+	user, err := loadUser(userID)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to get user",
@@ -241,7 +528,13 @@ func (ac *AuthController) User(c *fiber.Ctx) error {
 	return c.JSON(user)
 }
 
+// LoginPage tells the frontend why it was sent to log in. With ?request= it
+// is the consent screen of an app asking for access, see Authorize.
 func (ac *AuthController) LoginPage(c *fiber.Ctx) error {
+	if requestID := c.Query("request"); requestID != "" {
+		return ac.consentScreen(c, requestID)
+	}
+
 	errorMsg := c.Query("error")
 
 	if errorMsg != "" {
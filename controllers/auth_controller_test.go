@@ -0,0 +1,29 @@
+package controllers
+
+import "testing"
+
+func TestGraphIDMatchesOID(t *testing.T) {
+	tests := []struct {
+		name    string
+		graphID string
+		oid     string
+		want    bool
+	}{
+		{"work account", "4f9a5a8e-2c1b-4d7e-9a3f-6b8c0d1e2f30", "4f9a5a8e-2c1b-4d7e-9a3f-6b8c0d1e2f30", true},
+		{"work account case", "4F9A5A8E-2C1B-4D7E-9A3F-6B8C0D1E2F30", "4f9a5a8e-2c1b-4d7e-9a3f-6b8c0d1e2f30", true},
+		{"other work account", "4f9a5a8e-2c1b-4d7e-9a3f-6b8c0d1e2f31", "4f9a5a8e-2c1b-4d7e-9a3f-6b8c0d1e2f30", false},
+		{"personal account", "66f33332eca7ea81", "00000000-0000-0000-66f3-3332eca7ea81", true},
+		{"personal account case", "66F33332ECA7EA81", "00000000-0000-0000-66f3-3332eca7ea81", true},
+		{"other personal account", "66f33332eca7ea82", "00000000-0000-0000-66f3-3332eca7ea81", false},
+		// Only a full 16 digit id may match the tail
+		{"short tail", "eca7ea81", "00000000-0000-0000-66f3-3332eca7ea81", false},
+		{"empty graph id", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := graphIDMatchesOID(tt.graphID, tt.oid); got != tt.want {
+				t.Errorf("graphIDMatchesOID(%q, %q) = %v, want %v", tt.graphID, tt.oid, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package controllers
+
+import (
+	"database/sql"
+	"go-rest-api/internal/auth"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Scopes a personal access token can be granted. Cookie sessions can do
+// everything.
+const (
+	ScopePostsRead   = "posts:read"
+	ScopePostsWrite  = "posts:write"
+	ScopeProfileRead = "profile:read"
+)
+
+var validScopes = map[string]bool{
+	ScopePostsRead:   true,
+	ScopePostsWrite:  true,
+	ScopeProfileRead: true,
+}
+
+// Keys of the values RequireAuth stores in c.Locals
+const (
+	localUserID     = "user_id"
+	localAuthMethod = "auth_method"
+	localScopes     = "scopes"
+	localPrincipal  = "principal"
+	// Set to the admin while they impersonate the user in localUserID
+	localImpersonator = "impersonator"
+)
+
+// RequireAuth resolves the current user from an Authorization: Bearer token
+// or, without that header, from the session cookie. Personal access tokens
+// must carry every scope in scopes, JWT access tokens from a login can do
+// everything a session can. The user is available to handlers through
+// currentUserID.
+func (ac *AuthController) RequireAuth(scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if ok, err := ac.authenticate(c, scopes); !ok {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+// RequireUser is RequireAuth that also loads the user and their permissions
+// into the request context, see currentPrincipal and auth.FromContext.
+func (ac *AuthController) RequireUser(scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if ok, err := ac.authenticate(c, scopes); !ok {
+			return err
+		}
+
+		userID := currentUserID(c)
+		user, err := loadUser(userID)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Not authenticated",
+			})
+		} else if err != nil {
+			log.Printf("Error loading user %d: %v", userID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to get user",
+			})
+		}
+
+		permissions, err := userPermissions(c, userID)
+		if err != nil {
+			log.Printf("Error loading permissions of user %d: %v", userID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check permissions",
+			})
+		}
+
+		method, _ := c.Locals(localAuthMethod).(string)
+		impersonator, _ := c.Locals(localImpersonator).(int)
+		principal := &auth.Principal{
+			User:           user,
+			Method:         method,
+			Permissions:    permissions,
+			ImpersonatorID: impersonator,
+		}
+		c.Locals(localPrincipal, principal)
+		c.SetUserContext(auth.NewContext(c.UserContext(), principal))
+		return c.Next()
+	}
+}
+
+// OptionalUser is RequireUser for endpoints that also serve anonymous
+// visitors. Requests without a token or logged in session go through
+// without a user, invalid tokens are still rejected.
+func (ac *AuthController) OptionalUser(scopes ...string) fiber.Handler {
+	requireUser := ac.RequireUser(scopes...)
+	return func(c *fiber.Ctx) error {
+		if c.Get(fiber.HeaderAuthorization) == "" {
+			sess, err := ac.store.Get(c)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to get session",
+				})
+			}
+			userID, err := sessionUserID(c, sess)
+			if err != nil {
+				log.Printf("Error reading session user: %v", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to get session",
+				})
+			}
+			if userID == 0 {
+				return c.Next()
+			}
+		}
+		return requireUser(c)
+	}
+}
+
+// authenticate resolves the current user into c.Locals. If that fails it
+// writes the error response and returns false.
+func (ac *AuthController) authenticate(c *fiber.Ctx, scopes []string) (bool, error) {
+	if header := c.Get(fiber.HeaderAuthorization); header != "" {
+		return ac.authenticateBearer(c, header, scopes)
+	}
+
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return false, err
+	}
+	c.Locals(localUserID, userID)
+	c.Locals(localAuthMethod, "session")
+	return true, nil
+}
+
+func (ac *AuthController) authenticateBearer(c *fiber.Ctx, header string, scopes []string) (bool, error) {
+	scheme, raw, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || raw == "" {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_request"`)
+		return false, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid Authorization header",
+		})
+	}
+
+	raw = strings.TrimSpace(raw)
+	var userID int
+	var granted map[string]bool
+	var err error
+	method := "token"
+	switch {
+	case strings.HasPrefix(raw, accessTokenPrefix):
+		userID, granted, err = lookupAccessToken(raw)
+	case strings.HasPrefix(raw, appTokenPrefix):
+		method = "app"
+		userID, granted, err = lookupAppToken(raw)
+	default:
+		method = "jwt"
+		userID, err = accessTokenUser(raw)
+		granted = validScopes
+	}
+	if err != nil {
+		return false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check token",
+		})
+	}
+	if userID == 0 {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return false, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or expired token",
+		})
+	}
+
+	for _, scope := range scopes {
+		if !granted[scope] {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="insufficient_scope", scope="`+strings.Join(scopes, " ")+`"`)
+			return false, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Token is missing the " + scope + " scope",
+			})
+		}
+	}
+
+	c.Locals(localUserID, userID)
+	c.Locals(localAuthMethod, method)
+	c.Locals(localScopes, granted)
+	return true, nil
+}
+
+// currentUserID returns the user RequireAuth resolved, or 0 outside of it.
+func currentUserID(c *fiber.Ctx) int {
+	userID, _ := c.Locals(localUserID).(int)
+	return userID
+}
+
+// currentPrincipal returns the user RequireUser loaded, or nil outside of it.
+func currentPrincipal(c *fiber.Ctx) *auth.Principal {
+	principal, _ := c.Locals(localPrincipal).(*auth.Principal)
+	return principal
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"go-rest-api/internal/auth"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+const testAccessToken = accessTokenPrefix + "test"
+
+// expectAccessToken resolves testAccessToken to userID with scopes. The
+// token was used a moment ago, so its last use is not recorded again.
+func expectAccessToken(mock sqlmock.Sqlmock, userID int, scopes string) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, user_id, scopes, last_used_at FROM personal_access_tokens")).
+		WithArgs(hashToken(testAccessToken), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "scopes", "last_used_at"}).
+			AddRow(1, userID, scopes, time.Now()))
+}
+
+// expectUser loads userID with role as their only role.
+func expectUser(mock sqlmock.Sqlmock, userID int, role string) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, username, email, email_verified_at IS NOT NULL")).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"id", "username", "email", "verified", "avatar_url",
+			"display_name", "job_title", "preferred_language", "profile_overrides", "graph_synced_at", "role", "created_at",
+		}).AddRow(userID, "ada", "ada@example.com", true, nil, nil, nil, nil, "", nil, role, time.Now()))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT role, 0 FROM users WHERE id = ?")).
+		WithArgs(userID, userID).
+		WillReturnRows(sqlmock.NewRows([]string{"role", "extra"}).AddRow(role, false))
+}
+
+// expectPrincipal loads userID with role and the permissions the role has.
+func expectPrincipal(mock sqlmock.Sqlmock, userID int, role string, permissions ...string) {
+	expectUser(mock, userID, role)
+	rows := sqlmock.NewRows([]string{"permission"})
+	for _, p := range permissions {
+		rows.AddRow(p)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT DISTINCT permission FROM role_permissions")).
+		WithArgs(userID, userID).
+		WillReturnRows(rows)
+}
+
+func TestOptionalUserScopes(t *testing.T) {
+	bearer := http.Header{fiber.HeaderAuthorization: {"Bearer " + testAccessToken}}
+	tests := []struct {
+		name   string
+		header http.Header
+		expect func(sqlmock.Sqlmock)
+		status int
+		user   float64
+	}{
+		{"anonymous", nil, func(sqlmock.Sqlmock) {}, fiber.StatusOK, 0},
+		{"token with scope", bearer, func(mock sqlmock.Sqlmock) {
+			expectAccessToken(mock, 1, "posts:read posts:write")
+			expectPrincipal(mock, 1, "member")
+		}, fiber.StatusOK, 1},
+		{"token without scope", bearer, func(mock sqlmock.Sqlmock) {
+			expectAccessToken(mock, 1, "posts:write")
+		}, fiber.StatusForbidden, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			ac := NewAuthController(session.New())
+			app := fiber.New()
+			app.Get("/posts", ac.OptionalUser(ScopePostsRead), func(c *fiber.Ctx) error {
+				user := 0
+				if p, ok := auth.FromContext(c.UserContext()); ok {
+					user = p.User.ID
+				}
+				return c.JSON(fiber.Map{"user": user})
+			})
+			tt.expect(mock)
+
+			status, body := newTestClient(t, app).do(http.MethodGet, "/posts", nil, tt.header)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d: %v", status, tt.status, body)
+			}
+			if status == fiber.StatusOK && body["user"] != tt.user {
+				t.Errorf("user %v, want %v", body["user"], tt.user)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
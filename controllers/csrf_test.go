@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+const (
+	trustedOrigin = "https://app.example.com"
+	foreignOrigin = "https://evil.example.net"
+)
+
+// newCSRFApp protects app with CSRFProtect, trusting trustedOrigin and the
+// origin requests are sent to, http://example.com.
+func newCSRFApp(t *testing.T) (*fiber.App, *AuthController, *session.Store) {
+	t.Helper()
+	t.Setenv("FRONTEND_URL", trustedOrigin)
+	t.Setenv("CSRF_TRUSTED_ORIGINS", "")
+	store := session.New()
+	ac := NewAuthController(store)
+	app := fiber.New()
+	app.Use(ac.CSRFProtect())
+	app.Get("/api/csrf", ac.CSRFToken)
+	app.Post("/test/login/:id", testLogin(store))
+	return app, ac, store
+}
+
+// csrfLogin logs client in and returns the CSRF token of its session.
+func csrfLogin(t *testing.T, client *testClient) string {
+	t.Helper()
+	if status, body := client.post("/test/login/1", nil); status != fiber.StatusOK {
+		t.Fatalf("test login: %d %v", status, body)
+	}
+	status, body := client.do(http.MethodGet, "/api/csrf", nil, nil)
+	token, _ := body["csrf_token"].(string)
+	if status != fiber.StatusOK || token == "" {
+		t.Fatalf("csrf: %d %v", status, body)
+	}
+	return token
+}
+
+func TestCSRFProtect(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		loggedIn bool
+		origin   string
+		referer  string
+		token    string
+		bearer   bool
+		status   int
+	}{
+		{"trusted origin", http.MethodPost, "/api/posts", true, trustedOrigin, "", "valid", false, fiber.StatusOK},
+		{"same origin", http.MethodPost, "/api/posts", true, "http://example.com", "", "valid", false, fiber.StatusOK},
+		{"no origin or referer", http.MethodPost, "/api/posts", true, "", "", "valid", false, fiber.StatusOK},
+		{"foreign origin", http.MethodPost, "/api/posts", true, foreignOrigin, "", "valid", false, fiber.StatusForbidden},
+		{"null origin", http.MethodPost, "/api/posts", true, "null", "", "valid", false, fiber.StatusForbidden},
+		{"trusted referer", http.MethodPost, "/api/posts", true, "", trustedOrigin + "/posts/1", "valid", false, fiber.StatusOK},
+		{"foreign referer", http.MethodPost, "/api/posts", true, "", foreignOrigin + "/page", "valid", false, fiber.StatusForbidden},
+		{"missing token", http.MethodPost, "/api/posts", true, trustedOrigin, "", "", false, fiber.StatusForbidden},
+		{"wrong token", http.MethodPost, "/api/posts", true, trustedOrigin, "", "wrong", false, fiber.StatusForbidden},
+		{"missing token on delete", http.MethodDelete, "/api/posts", true, trustedOrigin, "", "", false, fiber.StatusForbidden},
+		{"safe method", http.MethodGet, "/api/posts", true, foreignOrigin, "", "", false, fiber.StatusOK},
+		{"bearer token", http.MethodPost, "/api/posts", true, foreignOrigin, "", "", true, fiber.StatusOK},
+		{"exempt path", http.MethodPost, "/api/token", true, foreignOrigin, "", "", false, fiber.StatusOK},
+		{"no session", http.MethodPost, "/api/posts", false, trustedOrigin, "", "", false, fiber.StatusOK},
+		{"no session, foreign origin", http.MethodPost, "/api/posts", false, foreignOrigin, "", "", false, fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, _, _ := newCSRFApp(t)
+			ok := func(c *fiber.Ctx) error { return c.JSON(fiber.Map{"ok": true}) }
+			app.Add(tt.method, "/api/posts", ok)
+			app.Post("/api/token", ok)
+			client := newTestClient(t, app)
+
+			header := make(http.Header)
+			if tt.loggedIn {
+				token := csrfLogin(t, client)
+				switch tt.token {
+				case "valid":
+					header.Set(csrfHeader, token)
+				case "wrong":
+					header.Set(csrfHeader, token+"x")
+				}
+			}
+			if tt.origin != "" {
+				header.Set(fiber.HeaderOrigin, tt.origin)
+			}
+			if tt.referer != "" {
+				header.Set(fiber.HeaderReferer, tt.referer)
+			}
+			if tt.bearer {
+				header.Set(fiber.HeaderAuthorization, "Bearer "+testAccessToken)
+			}
+
+			if status, body := client.do(tt.method, tt.path, nil, header); status != tt.status {
+				t.Fatalf("status %d, want %d: %v", status, tt.status, body)
+			}
+		})
+	}
+}
+
+// A token mode login finishes its second factor with the mfa_token as a
+// bearer token, which needs no CSRF token even if the client also holds a
+// session cookie. The session mode step still does.
+func TestCSRFTwoFactorLogin(t *testing.T) {
+	mock := newMockDB(t)
+	app, ac, _ := newCSRFApp(t)
+	app.Post("/api/login/2fa", ac.LoginTwoFactor)
+	client := newTestClient(t, app)
+	csrfLogin(t, client)
+	body := mustJSON(t, map[string]string{"code": "123456"})
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM mfa_tokens")).
+		WithArgs(hashToken("expired"), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	bearer := http.Header{fiber.HeaderAuthorization: {"Bearer expired"}}
+	status, resp := client.do(http.MethodPost, "/api/login/2fa", body, bearer)
+	if status != fiber.StatusUnauthorized || resp["error"] != "No pending login, please log in again" {
+		t.Fatalf("token mode: %d %v", status, resp)
+	}
+
+	if status, resp := client.post("/api/login/2fa", body); status != fiber.StatusForbidden {
+		t.Fatalf("session mode without CSRF token: %d %v", status, resp)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"go-rest-api/config"
+	"go-rest-api/database"
+	"go-rest-api/internal/mailer"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	emailVerificationTTL = 24 * time.Hour
+	// minimum time between two verification emails for the same account
+	verificationResendCooldown = time.Minute
+)
+
+var errInvalidVerificationToken = errors.New("invalid verification token")
+
+// Verification links are stateless: the token carries the user ID, the email
+// address being verified and an expiry, signed with config.SigningKey. Tying
+// the token to the address means it stops working if the email changes.
+
+func signVerificationToken(userID int, email string, expires time.Time) string {
+	payload := strconv.Itoa(userID) + "|" + email + "|" + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, config.SigningKey())
+	mac.Write([]byte("email-verification|" + payload))
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func parseVerificationToken(token string) (int, string, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, "", errInvalidVerificationToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return 0, "", errInvalidVerificationToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return 0, "", errInvalidVerificationToken
+	}
+
+	mac := hmac.New(sha256.New, config.SigningKey())
+	mac.Write([]byte("email-verification|"))
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return 0, "", errInvalidVerificationToken
+	}
+
+	// The email may itself contain '|', so split on the first and last one
+	first := strings.Index(string(payload), "|")
+	last := strings.LastIndex(string(payload), "|")
+	if first < 0 || first == last {
+		return 0, "", errInvalidVerificationToken
+	}
+	userID, err := strconv.Atoi(string(payload[:first]))
+	if err != nil {
+		return 0, "", errInvalidVerificationToken
+	}
+	expires, err := strconv.ParseInt(string(payload[last+1:]), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return 0, "", errInvalidVerificationToken
+	}
+
+	return userID, string(payload[first+1 : last]), nil
+}
+
+// sendVerificationEmail mails a fresh verification link to the user.
+func sendVerificationEmail(userID int, email string) error {
+	_, err := database.DB.Exec("UPDATE users SET verification_sent_at = ? WHERE id = ?", time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	token := signVerificationToken(userID, email, time.Now().Add(emailVerificationTTL))
+	link := config.GetConfig().FrontendURL + "/verify-email?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Welcome! Please confirm your email address by opening this link "+
+			"within %d hours:\n\n%s\n\nUntil then you won't be able to post or like.\n",
+			int(emailVerificationTTL.Hours()), link),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return config.Mailer.Send(ctx, msg)
+}
+
+type verifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+func (ac *AuthController) VerifyEmail(c *fiber.Ctx) error {
+	var req verifyEmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	userID, email, err := parseVerificationToken(req.Token)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or expired verification link",
+		})
+	}
+
+	result, err := database.DB.Exec(
+		"UPDATE users SET email_verified_at = ? WHERE id = ? AND email = ? AND email_verified_at IS NULL",
+		time.Now(), userID, email,
+	)
+	if err != nil {
+		log.Printf("Error verifying email: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to verify email",
+		})
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		var verified bool
+		err := database.DB.QueryRow(
+			"SELECT email_verified_at IS NOT NULL FROM users WHERE id = ? AND email = ?", userID, email,
+		).Scan(&verified)
+		if err != nil || !verified {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid or expired verification link",
+			})
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Email verified",
+	})
+}
+
+func (ac *AuthController) ResendVerification(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	var email string
+	var verifiedAt, sentAt sql.NullTime
+	err = database.DB.QueryRow(
+		"SELECT email, email_verified_at, verification_sent_at FROM users WHERE id = ?", userID,
+	).Scan(&email, &verifiedAt, &sentAt)
+	if err != nil {
+		log.Printf("Error loading user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+
+	if verifiedAt.Valid {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Email is already verified",
+		})
+	}
+	if sentAt.Valid && time.Since(sentAt.Time) < verificationResendCooldown {
+		retryAfter := int((verificationResendCooldown - time.Since(sentAt.Time)).Seconds()) + 1
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error":       "Verification email was sent recently, try again later",
+			"retry_after": retryAfter,
+		})
+	}
+
+	if err := sendVerificationEmail(userID, email); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to send verification email",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Verification email sent",
+	})
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-rest-api/config"
+	"go-rest-api/database"
+	"go-rest-api/internal/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// newMockDB points database.DB and the session index at a mock database
+// for the length of the test.
+func newMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevDB, prevIndex := database.DB, config.SessionIndex
+	t.Cleanup(func() {
+		database.DB, config.SessionIndex = prevDB, prevIndex
+		db.Close()
+	})
+	database.DB = db
+	config.SessionIndex = storage.NewSessionIndex(db, "")
+	return mock
+}
+
+// testLogin stands in for a password login, it logs the session in as the
+// user in the :id parameter.
+func testLogin(store *session.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		id, _ := c.ParamsInt("id")
+		sess.Set("user_id", id)
+		sess.Set("session_epoch", 0)
+		return sess.Save()
+	}
+}
+
+// testClient sends requests to app like a browser, carrying the cookies of
+// one response to the next request. header is sent with every request.
+type testClient struct {
+	t       *testing.T
+	app     *fiber.App
+	cookies map[string]*http.Cookie
+	header  http.Header
+}
+
+func newTestClient(t *testing.T, app *fiber.App) *testClient {
+	return &testClient{t: t, app: app, cookies: make(map[string]*http.Cookie), header: make(http.Header)}
+}
+
+func (tc *testClient) do(method, path string, body []byte, header http.Header) (int, map[string]interface{}) {
+	tc.t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range tc.header {
+		req.Header[k] = v
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	for _, c := range tc.cookies {
+		req.AddCookie(c)
+	}
+	resp, err := tc.app.Test(req, -1)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	for _, c := range resp.Cookies() {
+		tc.cookies[c.Name] = c
+	}
+
+	raw, _ := io.ReadAll(resp.Body)
+	var out map[string]interface{}
+	json.Unmarshal(raw, &out)
+	return resp.StatusCode, out
+}
+
+func (tc *testClient) post(path string, body []byte) (int, map[string]interface{}) {
+	tc.t.Helper()
+	return tc.do(http.MethodPost, path, body, nil)
+}
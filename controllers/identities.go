@@ -0,0 +1,567 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"go-rest-api/config"
+	"go-rest-api/database"
+	"go-rest-api/internal/models"
+	"go-rest-api/internal/oauth"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"golang.org/x/oauth2"
+)
+
+// External logins are matched through user_identities by provider and
+// subject, never by email. An email that already belongs to an account is
+// refused, the owner has to log in and link the provider explicitly.
+//
+// The exception are accounts left by the old email based Microsoft login.
+// The migration could only give them a pending identity without a subject.
+// The first Microsoft login whose ID token carries a verified email equal to
+// the pending identity's binds it, after that the subject alone counts. An
+// owner whose token has no verified email gets in with a password reset or
+// magic link and links Microsoft from their account instead.
+
+var errIdentityTaken = errors.New("identity is linked to another account")
+
+// providerAuthURL returns the authorization URL for flow, or false if
+// provider is not configured.
+func providerAuthURL(provider string, flow oauthFlow) (string, bool) {
+	if provider == "microsoft" {
+		oauthConfig := config.MicrosoftOAuthConfig()
+		if oauthConfig == nil {
+			return "", false
+		}
+		return oauthConfig.AuthCodeURL(flow.State,
+			oauth2.S256ChallengeOption(flow.Verifier),
+			oidc.Nonce(flow.Nonce),
+		), true
+	}
+
+	p, ok := config.Providers.Get(provider)
+	if !ok {
+		return "", false
+	}
+	return p.AuthCodeURL(flow.State, flow.Nonce, flow.Verifier), true
+}
+
+// findIdentityUser returns the user linked to the provider account, or
+// sql.ErrNoRows.
+func findIdentityUser(provider, subject string) (int, error) {
+	if subject == "" {
+		return 0, sql.ErrNoRows
+	}
+	var userID int
+	err := database.DB.QueryRow(
+		"SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?",
+		provider, subject,
+	).Scan(&userID)
+	return userID, err
+}
+
+// claimPendingIdentity binds the pending Microsoft identity with the
+// profile's verified ID token email to the profile's subject and returns its
+// user, or sql.ErrNoRows if there is none to claim.
+func claimPendingIdentity(profile *oauth.Profile) (int, error) {
+	email, _ := profile.Claims["verified_email"].(string)
+	if profile.Provider != "microsoft" || profile.Subject == "" || email == "" {
+		return 0, sql.ErrNoRows
+	}
+
+	var identityID, userID int
+	err := database.DB.QueryRow(
+		"SELECT id, user_id FROM user_identities WHERE provider = 'microsoft' AND subject IS NULL AND email = ?",
+		strings.ToLower(email),
+	).Scan(&identityID, &userID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only one login can fill in the subject
+	result, err := database.DB.Exec(
+		"UPDATE user_identities SET subject = ?, last_login_at = ? WHERE id = ? AND subject IS NULL",
+		profile.Subject, time.Now(), identityID,
+	)
+	if _, dup := duplicateKeyField(err); dup {
+		return 0, errIdentityTaken
+	} else if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, sql.ErrNoRows
+	}
+	log.Printf("Microsoft account %s claimed the pending identity of user %d", profile.Subject, userID)
+	return userID, nil
+}
+
+// insertIdentity links the provider account in profile to userID.
+func insertIdentity(exec dbExecer, userID int, profile *oauth.Profile) error {
+	var email *string
+	if profile.Email != "" {
+		e := strings.ToLower(profile.Email)
+		email = &e
+	}
+	_, err := exec.Exec(
+		"INSERT INTO user_identities (user_id, provider, subject, email, created_at, last_login_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, profile.Provider, profile.Subject, email, time.Now(), time.Now(),
+	)
+	if _, dup := duplicateKeyField(err); dup {
+		return errIdentityTaken
+	}
+	return err
+}
+
+// linkIdentity links the provider account in profile to userID, claiming
+// the pending identity of a migrated account if there is one.
+func linkIdentity(userID int, profile *oauth.Profile) error {
+	var email *string
+	if profile.Email != "" {
+		e := strings.ToLower(profile.Email)
+		email = &e
+	}
+	result, err := database.DB.Exec(`
+        UPDATE user_identities SET subject = ?, email = ?, last_login_at = ?
+        WHERE user_id = ? AND provider = ? AND subject IS NULL
+        LIMIT 1
+    `, profile.Subject, email, time.Now(), userID, profile.Provider)
+	if _, dup := duplicateKeyField(err); dup {
+		return errIdentityTaken
+	} else if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return nil
+	}
+	return insertIdentity(database.DB, userID, profile)
+}
+
+// createProviderUser creates an account for a provider profile along with
+// its identity. It fails with errEmailTaken if the email is already in use.
+func createProviderUser(profile *oauth.Profile) (int, error) {
+	if profile.Email == "" {
+		return 0, errors.New("provider returned no email address")
+	}
+	email := strings.ToLower(profile.Email)
+
+	var existing int
+	err := database.DB.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&existing)
+	if err == nil {
+		return 0, errEmailTaken
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	var verifiedAt *time.Time
+	if profile.EmailVerified {
+		now := time.Now()
+		verifiedAt = &now
+	}
+
+	base := profile.Username
+	if base == "" {
+		base, _, _ = strings.Cut(email, "@")
+	}
+
+	var avatar *string
+	if profile.AvatarURL != "" {
+		avatar = &profile.AvatarURL
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Retry with a random suffix if the username is taken
+	username := sanitizeUsername(base)
+	var userID int
+	for attempt := 0; ; attempt++ {
+		result, err := tx.Exec(
+			"INSERT INTO users (username, email, email_verified_at, avatar_url, created_at) VALUES (?, ?, ?, ?, ?)",
+			username, email, verifiedAt, avatar, time.Now(),
+		)
+		if err == nil {
+			id, err := result.LastInsertId()
+			if err != nil {
+				return 0, err
+			}
+			userID = int(id)
+			break
+		}
+
+		field, dup := duplicateKeyField(err)
+		if dup && field == "email" {
+			return 0, errEmailTaken
+		}
+		if !dup || field != "username" || attempt == 4 {
+			return 0, err
+		}
+		suffix := make([]byte, 3)
+		if _, err := rand.Read(suffix); err != nil {
+			return 0, err
+		}
+		username = sanitizeUsername(base)
+		if len(username) > maxUsernameLength-7 {
+			username = username[:maxUsernameLength-7]
+		}
+		username += "-" + hex.EncodeToString(suffix)
+	}
+
+	if err := insertIdentity(tx, userID, profile); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// saveIdentityToken stores the provider token of an identity so it can be
+// used later on behalf of the user. Failing to do so does not fail the login.
+func saveIdentityToken(profile *oauth.Profile, token *oauth2.Token) {
+	if config.Tokens == nil || token == nil || token.AccessToken == "" {
+		return
+	}
+
+	var identityID int
+	err := database.DB.QueryRow(
+		"SELECT id FROM user_identities WHERE provider = ? AND subject = ?",
+		profile.Provider, profile.Subject,
+	).Scan(&identityID)
+	if err == nil {
+		err = config.Tokens.Save(identityID, token)
+	}
+	if err != nil {
+		log.Printf("Error storing %s token: %v", profile.Provider, err)
+	}
+}
+
+// afterProviderLogin runs once userID has logged in or linked an account
+// with token.
+func afterProviderLogin(userID int, profile *oauth.Profile, token *oauth2.Token) {
+	saveIdentityToken(profile, token)
+	if profile.Provider != "microsoft" {
+		return
+	}
+	if err := syncMicrosoftRoles(userID, profile); err != nil {
+		log.Printf("Error syncing Microsoft roles for user %d: %v", userID, err)
+	}
+	if token != nil {
+		go syncMicrosoftProfile(userID, token)
+	}
+}
+
+// syncMicrosoftRoles makes the roles granted through tenant groups match the
+// groups in the ID token. Roles assigned any other way are left alone.
+func syncMicrosoftRoles(userID int, profile *oauth.Profile) error {
+	policy := config.MicrosoftLoginPolicy()
+	if len(policy.GroupRoles) == 0 {
+		return nil
+	}
+	if overage, _ := profile.Claims["groups_overage"].(bool); overage {
+		return errors.New("groups claim left out of the ID token, roles not updated")
+	}
+	groups, _ := profile.Claims["groups"].([]string)
+	roles := policy.Roles(groups)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM user_roles WHERE user_id = ? AND source = 'microsoft'", userID); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		_, err := tx.Exec(
+			"INSERT IGNORE INTO user_roles (user_id, role, source, created_at) VALUES (?, ?, 'microsoft', ?)",
+			userID, role, time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// completeProviderLogin finishes a provider callback, either by linking the
+// account to the logged in user or by logging in as the linked user.
+func (ac *AuthController) completeProviderLogin(c *fiber.Ctx, sess *session.Session, flow oauthFlow, profile *oauth.Profile, token *oauth2.Token) error {
+	if flow.LinkUserID != 0 {
+		return ac.completeIdentityLink(c, sess, flow, profile, token)
+	}
+
+	userID, err := findIdentityUser(profile.Provider, profile.Subject)
+	if err == sql.ErrNoRows {
+		userID, err = claimPendingIdentity(profile)
+	}
+	if err == sql.ErrNoRows {
+		userID, err = createProviderUser(profile)
+	}
+	if err == errEmailTaken {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "An account with this email already exists, log in to it and link this provider from your account settings",
+		})
+	} else if err != nil {
+		log.Printf("Error resolving %s user: %v", profile.Provider, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+
+	if _, err := database.DB.Exec(
+		"UPDATE user_identities SET last_login_at = ? WHERE provider = ? AND subject = ?",
+		time.Now(), profile.Provider, profile.Subject,
+	); err != nil {
+		log.Printf("Error recording identity login: %v", err)
+	}
+	afterProviderLogin(userID, profile, token)
+	if profile.EmailVerified {
+		if _, err := database.DB.Exec(
+			"UPDATE users SET email_verified_at = ? WHERE id = ? AND email = ? AND email_verified_at IS NULL",
+			time.Now(), userID, strings.ToLower(profile.Email),
+		); err != nil {
+			log.Printf("Error marking email verified: %v", err)
+		}
+	}
+
+	if flow.TokenMode {
+		return redirectWithLoginCode(c, userID, flow)
+	}
+
+	if err := rotateSession(sess); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to regenerate session",
+		})
+	}
+
+	// The provider replaces the password, not the second factor
+	mfaRequired, err := totpEnabled(userID)
+	if err != nil {
+		log.Printf("Error checking two-factor status: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+	if mfaRequired {
+		if err := startMFAChallenge(sess, userID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to save session",
+			})
+		}
+		return redirectToTwoFactor(c)
+	}
+
+	if err := startSession(c, sess, userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save session",
+		})
+	}
+
+	return redirectAfterLogin(c)
+}
+
+// completeIdentityLink links the provider account to the user who started
+// the flow, as long as they are still the one logged in.
+func (ac *AuthController) completeIdentityLink(c *fiber.Ctx, sess *session.Session, flow oauthFlow, profile *oauth.Profile, token *oauth2.Token) error {
+	userID, err := sessionUserID(c, sess)
+	if err != nil {
+		log.Printf("Error reading session user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+	if userID == 0 || userID != flow.LinkUserID {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Not authenticated",
+		})
+	}
+
+	if profile.Subject == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Provider did not identify the account",
+		})
+	}
+
+	linkedTo, err := findIdentityUser(profile.Provider, profile.Subject)
+	switch {
+	case err == nil && linkedTo == userID:
+		afterProviderLogin(userID, profile, token)
+		return redirectAfterLogin(c)
+	case err == nil:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "This account is already linked to another user",
+		})
+	case err != sql.ErrNoRows:
+		log.Printf("Error looking up identity: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to link account",
+		})
+	}
+
+	err = linkIdentity(userID, profile)
+	if err == errIdentityTaken {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "This account is already linked to another user",
+		})
+	} else if err != nil {
+		log.Printf("Error linking identity: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to link account",
+		})
+	}
+
+	afterProviderLogin(userID, profile, token)
+	return redirectAfterLogin(c)
+}
+
+func (ac *AuthController) ListIdentities(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	rows, err := database.DB.Query(`
+        SELECT id, provider, email, created_at, last_login_at
+        FROM user_identities
+        WHERE user_id = ?
+        ORDER BY created_at
+    `, userID)
+	if err != nil {
+		log.Printf("Error listing identities: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list linked accounts",
+		})
+	}
+	defer rows.Close()
+
+	identities := make([]models.Identity, 0)
+	for rows.Next() {
+		var i models.Identity
+		var email sql.NullString
+		var lastLogin sql.NullTime
+		if err := rows.Scan(&i.ID, &i.Provider, &email, &i.CreatedAt, &lastLogin); err != nil {
+			log.Printf("Error scanning identity: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to list linked accounts",
+			})
+		}
+		i.Email = email.String
+		if lastLogin.Valid {
+			i.LastLoginAt = &lastLogin.Time
+		}
+		identities = append(identities, i)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"count":  len(identities),
+		"data":   identities,
+	})
+}
+
+// LinkIdentity starts linking a provider to the logged in user. It returns
+// the URL to send the browser to, the provider redirects back to the usual
+// callback.
+func (ac *AuthController) LinkIdentity(c *fiber.Ctx) error {
+	sess, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	provider := c.Params("provider")
+	flow, err := beginOAuthFlow(sess, oauthFlow{Provider: provider, LinkUserID: userID})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start linking",
+		})
+	}
+
+	authURL, ok := providerAuthURL(provider, flow)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown login provider",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"authorization_url": authURL,
+	})
+}
+
+// UnlinkIdentity removes a linked provider, unless it is the only way left
+// to log in to the account.
+func (ac *AuthController) UnlinkIdentity(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid linked account ID",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unlink account",
+		})
+	}
+	defer tx.Rollback()
+
+	// Lock the user row so two unlinks cannot each leave the other last
+	var hasPassword bool
+	var others, passkeys int
+	err = tx.QueryRow(`
+        SELECT password_hash IS NOT NULL AND password_hash <> '',
+            (SELECT COUNT(*) FROM user_identities WHERE user_id = users.id AND id <> ?),
+            (SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = users.id)
+        FROM users WHERE id = ? FOR UPDATE
+    `, id, userID).Scan(&hasPassword, &others, &passkeys)
+	if err != nil {
+		log.Printf("Error checking login methods: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unlink account",
+		})
+	}
+	if !hasPassword && others == 0 && passkeys == 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Set a password or add a passkey before unlinking your only login method",
+		})
+	}
+
+	result, err := tx.Exec("DELETE FROM user_identities WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		log.Printf("Error unlinking identity: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unlink account",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Linked account not found",
+		})
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing unlink: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unlink account",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"id":     id,
+	})
+}
@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"go-rest-api/internal/oauth"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// newProviderLoginClient serves a route that completes a provider login for
+// profile, standing in for a callback that verified it.
+func newProviderLoginClient(t *testing.T, profile *oauth.Profile) (*testClient, sqlmock.Sqlmock) {
+	t.Helper()
+	mock := newMockDB(t)
+	store := session.New()
+	ac := NewAuthController(store)
+	app := fiber.New()
+	app.Get("/test/provider-login", func(c *fiber.Ctx) error {
+		sess, err := store.Get(c)
+		if err != nil {
+			return err
+		}
+		return ac.completeProviderLogin(c, sess, oauthFlow{}, profile, nil)
+	})
+	return newTestClient(t, app), mock
+}
+
+func legacyMicrosoftProfile(verifiedEmail string) *oauth.Profile {
+	return &oauth.Profile{
+		Provider:      "microsoft",
+		Subject:       "66f33332eca7ea81",
+		Email:         "ada@contoso.com",
+		EmailVerified: true,
+		Username:      "Ada Lovelace",
+		Claims: map[string]interface{}{
+			"tid":            "72f988bf-86f1-41af-91ab-2d7cd011db47",
+			"verified_email": verifiedEmail,
+		},
+	}
+}
+
+func expectNoIdentity(mock sqlmock.Sqlmock, subject string) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?")).
+		WithArgs("microsoft", subject).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+}
+
+func expectEmailTaken(mock sqlmock.Sqlmock, email string) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE email = ?")).
+		WithArgs(email).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+}
+
+func TestProviderLoginClaimsPendingIdentity(t *testing.T) {
+	profile := legacyMicrosoftProfile("Ada@Contoso.com")
+	client, mock := newProviderLoginClient(t, profile)
+
+	expectNoIdentity(mock, profile.Subject)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, user_id FROM user_identities WHERE provider = 'microsoft' AND subject IS NULL AND email = ?")).
+		WithArgs("ada@contoso.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(5, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE user_identities SET subject = ?, last_login_at = ? WHERE id = ? AND subject IS NULL")).
+		WithArgs(profile.Subject, sqlmock.AnyArg(), 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE user_identities SET last_login_at = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET email_verified_at = ?")).
+		WithArgs(sqlmock.AnyArg(), 1, "ada@contoso.com").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM user_sessions WHERE id = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = ?")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(false))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT session_epoch FROM users WHERE id = ?")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"session_epoch"}).AddRow(0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_sessions")).
+		WithArgs(indexedSessionID{}, 1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	status, body := client.do(http.MethodGet, "/test/provider-login", nil, nil)
+	if status != fiber.StatusFound {
+		t.Fatalf("login: %d %v", status, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProviderLoginRefusesClaims(t *testing.T) {
+	tests := []struct {
+		name          string
+		verifiedEmail string
+		pending       bool
+	}{
+		// A work account email without xms_edov proves nothing
+		{"unverified email", "", true},
+		// Someone else already bound the pending identity
+		{"already claimed", "ada@contoso.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := legacyMicrosoftProfile(tt.verifiedEmail)
+			client, mock := newProviderLoginClient(t, profile)
+
+			expectNoIdentity(mock, profile.Subject)
+			if tt.verifiedEmail != "" {
+				rows := sqlmock.NewRows([]string{"id", "user_id"})
+				if tt.pending {
+					rows.AddRow(5, 1)
+				}
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT id, user_id FROM user_identities")).
+					WithArgs(tt.verifiedEmail).
+					WillReturnRows(rows)
+			}
+			expectEmailTaken(mock, "ada@contoso.com")
+
+			status, body := client.do(http.MethodGet, "/test/provider-login", nil, nil)
+			if status != fiber.StatusConflict {
+				t.Fatalf("login: %d %v", status, body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestProviderLoginClaimsOnlyOnce(t *testing.T) {
+	profile := legacyMicrosoftProfile("ada@contoso.com")
+	client, mock := newProviderLoginClient(t, profile)
+
+	// Another login filled in the subject between the select and the update
+	expectNoIdentity(mock, profile.Subject)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, user_id FROM user_identities")).
+		WithArgs("ada@contoso.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow(5, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE user_identities SET subject = ?")).
+		WithArgs(profile.Subject, sqlmock.AnyArg(), 5).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	expectEmailTaken(mock, "ada@contoso.com")
+
+	status, body := client.do(http.MethodGet, "/test/provider-login", nil, nil)
+	if status != fiber.StatusConflict {
+		t.Fatalf("login: %d %v", status, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
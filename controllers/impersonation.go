@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"go-rest-api/database"
+	"go-rest-api/internal/auth"
+	"go-rest-api/internal/models"
+	"go-rest-api/internal/storage"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// While an admin impersonates someone the session keeps user_id as the admin,
+// so the epoch and index checks still apply to the real person, and stores
+// the impersonation next to it. requireSessionUser then hands out the
+// impersonated user. Every step is recorded in impersonation_audit, which
+// the database keeps append-only.
+
+const (
+	impersonationMaxAge = time.Hour
+
+	headerImpersonating = "X-Impersonating-User"
+	headerImpersonator  = "X-Impersonator"
+
+	impersonationStopPath = "/api/admin/impersonate/stop"
+)
+
+// Changing how the user signs in is never done on their behalf, whatever
+// the admin asked for when starting.
+var impersonationBlockedPrefixes = []string{
+	"/api/login", "/api/register", "/api/password", "/api/email",
+	"/api/2fa", "/api/passkeys", "/api/token", "/api/identities",
+	"/api/sessions", "/api/admin", "/api/user/profile", "/api/oauth",
+	"/auth/", "/oauth/",
+}
+
+type impersonation struct {
+	ID               int64 `json:"id"`
+	AdminID          int   `json:"admin_id"`
+	UserID           int   `json:"user_id"`
+	AllowDestructive bool  `json:"allow_destructive"`
+	StartedAt        int64 `json:"started_at"`
+}
+
+func (imp *impersonation) expired() bool {
+	return time.Since(time.Unix(imp.StartedAt, 0)) > impersonationMaxAge
+}
+
+// sessionImpersonation returns the impersonation running in sess, or nil.
+func sessionImpersonation(sess *session.Session) *impersonation {
+	raw, _ := sess.Get("impersonation").(string)
+	if raw == "" {
+		return nil
+	}
+	var imp impersonation
+	if json.Unmarshal([]byte(raw), &imp) != nil {
+		return nil
+	}
+	return &imp
+}
+
+// recordImpersonation appends an event to the audit trail and returns its ID.
+func recordImpersonation(c *fiber.Ctx, imp *impersonation, event, reason string) (int64, error) {
+	var ref sql.NullInt64
+	if imp.ID != 0 {
+		ref = sql.NullInt64{Int64: imp.ID, Valid: true}
+	}
+	result, err := database.DB.Exec(`
+        INSERT INTO impersonation_audit
+            (impersonation_id, event, admin_id, user_id, reason, allow_destructive, ip, user_agent, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, ref, event, imp.AdminID, imp.UserID, reason, imp.AllowDestructive,
+		c.IP(), storage.Truncate(c.Get(fiber.HeaderUserAgent), 255), time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// endImpersonation records event and drops the impersonation from sess.
+func endImpersonation(c *fiber.Ctx, sess *session.Session, imp *impersonation, event string) error {
+	if _, err := recordImpersonation(c, imp, event, ""); err != nil {
+		return err
+	}
+	sess.Delete("impersonation")
+	return sess.Save()
+}
+
+// resolveImpersonation returns the user a session logged in as realID acts
+// as. Impersonations that expired or whose admin lost the permission end
+// here. Ending one saves and so releases sess, the session to carry on with
+// is returned.
+func (ac *AuthController) resolveImpersonation(c *fiber.Ctx, sess *session.Session, realID int) (*session.Session, int, error) {
+	imp := sessionImpersonation(sess)
+	if imp == nil {
+		return sess, realID, nil
+	}
+
+	if imp.AdminID != realID {
+		sess.Delete("impersonation")
+		if err := sess.Save(); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		allowed, err := hasPermission(realID, auth.PermUsersImpersonate)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !imp.expired() && allowed {
+			c.Locals(localImpersonator, realID)
+			return sess, imp.UserID, nil
+		}
+		if err := endImpersonation(c, sess, imp, "expire"); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	sess, err := ac.store.Get(c)
+	return sess, realID, err
+}
+
+// ImpersonationGuard marks every response of an impersonating session and
+// keeps it away from account security and, unless the admin allowed it when
+// starting, from DELETE requests.
+func (ac *AuthController) ImpersonationGuard() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// Bearer tokens always act as their own user
+		if c.Get(fiber.HeaderAuthorization) != "" {
+			return c.Next()
+		}
+
+		sess, err := ac.store.Get(c)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to get session",
+			})
+		}
+		imp := sessionImpersonation(sess)
+		if imp == nil || imp.expired() {
+			return c.Next()
+		}
+
+		c.Set(headerImpersonating, strconv.Itoa(imp.UserID))
+		c.Set(headerImpersonator, strconv.Itoa(imp.AdminID))
+
+		path := c.Path()
+		if path == impersonationStopPath {
+			return c.Next()
+		}
+		readOnly := c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead || c.Method() == fiber.MethodOptions
+		for _, prefix := range impersonationBlockedPrefixes {
+			if strings.HasPrefix(path, prefix) && (!readOnly || prefix == "/auth/" || prefix == "/oauth/") {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+					"error":         "Not available while impersonating",
+					"impersonating": true,
+				})
+			}
+		}
+		if c.Method() == fiber.MethodDelete && !imp.AllowDestructive {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error":         "Destructive actions are blocked while impersonating",
+				"impersonating": true,
+			})
+		}
+
+		return c.Next()
+	}
+}
+
+type impersonateRequest struct {
+	UserID           int    `json:"user_id"`
+	Reason           string `json:"reason"`
+	AllowDestructive bool   `json:"allow_destructive"`
+}
+
+// StartImpersonation switches the admin's session to another user.
+func (ac *AuthController) StartImpersonation(c *fiber.Ctx) error {
+	if method, _ := c.Locals(localAuthMethod).(string); method != "session" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Impersonation needs a browser session",
+		})
+	}
+	adminID := currentUserID(c)
+
+	var req impersonateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" || len(req.Reason) > 255 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A reason of at most 255 characters is required",
+			"field": "reason",
+		})
+	}
+	if req.UserID == adminID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "You cannot impersonate yourself",
+			"field": "user_id",
+		})
+	}
+
+	user, err := loadUser(req.UserID)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	} else if err != nil {
+		log.Printf("Error loading user %d: %v", req.UserID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start impersonation",
+		})
+	}
+
+	// Impersonating another admin would hand out their permissions
+	peer, err := hasPermission(req.UserID, auth.PermUsersImpersonate)
+	if err != nil {
+		log.Printf("Error checking permission: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start impersonation",
+		})
+	}
+	if peer {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Cannot impersonate another administrator",
+		})
+	}
+
+	sess, err := ac.store.Get(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+	if sessionImpersonation(sess) != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Already impersonating, stop first",
+		})
+	}
+
+	imp := &impersonation{
+		AdminID:          adminID,
+		UserID:           req.UserID,
+		AllowDestructive: req.AllowDestructive,
+		StartedAt:        time.Now().Unix(),
+	}
+	imp.ID, err = recordImpersonation(c, imp, "start", req.Reason)
+	if err != nil {
+		log.Printf("Error recording impersonation: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start impersonation",
+		})
+	}
+
+	b, err := json.Marshal(imp)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start impersonation",
+		})
+	}
+	sess.Set("impersonation", string(b))
+	if err := sess.Save(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save session",
+		})
+	}
+
+	log.Printf("User %d started impersonating user %d", adminID, req.UserID)
+
+	c.Set(headerImpersonating, strconv.Itoa(imp.UserID))
+	c.Set(headerImpersonator, strconv.Itoa(imp.AdminID))
+	return c.JSON(fiber.Map{
+		"status":            "success",
+		"user":              user,
+		"allow_destructive": imp.AllowDestructive,
+		"expires_at":        time.Unix(imp.StartedAt, 0).Add(impersonationMaxAge),
+	})
+}
+
+// StopImpersonation returns the session to the admin. It reads the session
+// directly because RequireAuth would resolve the impersonated user.
+func (ac *AuthController) StopImpersonation(c *fiber.Ctx) error {
+	sess, err := ac.store.Get(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+	adminID, err := sessionUserID(c, sess)
+	if err != nil {
+		log.Printf("Error reading session user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+	if adminID == 0 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Not authenticated",
+		})
+	}
+
+	imp := sessionImpersonation(sess)
+	if imp == nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Not impersonating anyone",
+		})
+	}
+	if err := endImpersonation(c, sess, imp, "stop"); err != nil {
+		log.Printf("Error stopping impersonation: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to stop impersonation",
+		})
+	}
+
+	log.Printf("User %d stopped impersonating user %d", adminID, imp.UserID)
+
+	user, err := loadUser(adminID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+	return c.JSON(user)
+}
+
+// ListImpersonations returns the latest audit events, optionally only those
+// about ?user_id= or by ?admin_id=.
+func (ac *AuthController) ListImpersonations(c *fiber.Ctx) error {
+	query := `
+        SELECT id, impersonation_id, event, admin_id, user_id, reason, allow_destructive, ip, user_agent, created_at
+        FROM impersonation_audit WHERE 1 = 1`
+	var args []interface{}
+	if userID := c.QueryInt("user_id"); userID > 0 {
+		query += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	if adminID := c.QueryInt("admin_id"); adminID > 0 {
+		query += " AND admin_id = ?"
+		args = append(args, adminID)
+	}
+	query += " ORDER BY id DESC LIMIT 100"
+
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error listing impersonations: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list impersonations",
+		})
+	}
+	defer rows.Close()
+
+	events := make([]models.ImpersonationEvent, 0)
+	for rows.Next() {
+		var e models.ImpersonationEvent
+		var ref sql.NullInt64
+		err := rows.Scan(&e.ID, &ref, &e.Event, &e.AdminID, &e.UserID, &e.Reason,
+			&e.AllowDestructive, &e.IP, &e.UserAgent, &e.CreatedAt)
+		if err != nil {
+			log.Printf("Error scanning impersonation: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to list impersonations",
+			})
+		}
+		if ref.Valid {
+			e.ImpersonationID = &ref.Int64
+		}
+		events = append(events, e)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"count":  len(events),
+		"data":   events,
+	})
+}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testIP = "0.0.0.0"
+
+func newLoginClient(t *testing.T) (*testClient, sqlmock.Sqlmock) {
+	t.Helper()
+	mock := newMockDB(t)
+	ac := NewAuthController(session.New())
+	app := fiber.New()
+	app.Post("/api/login", ac.Login)
+	return newTestClient(t, app), mock
+}
+
+func expectLoginUser(t *testing.T, mock sqlmock.Sqlmock, userID int, password string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT locked_until FROM login_attempts")).
+		WithArgs(loginScopeIP, testIP).
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, username, email, email_verified_at IS NOT NULL, password_hash, created_at FROM users WHERE email = ?")).
+		WithArgs("ada@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "verified", "password_hash", "created_at"}).
+			AddRow(userID, "ada", "ada@example.com", true, string(hash), time.Now()))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT locked_until FROM login_attempts")).
+		WithArgs(loginScopeUser, "1").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}))
+}
+
+func TestLoginForgivesIPFailures(t *testing.T) {
+	client, mock := newLoginClient(t)
+	expectLoginUser(t, mock, 1, "correct horse")
+
+	// The right password takes failures off the IP and clears the account's
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE login_attempts SET failures = GREATEST(failures - ?, 0)")).
+		WithArgs(ipSuccessCredit, loginScopeIP, testIP).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = ?")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(false))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM login_attempts WHERE scope = ? AND identifier = ?")).
+		WithArgs(loginScopeUser, "1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM user_sessions WHERE id = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT session_epoch FROM users WHERE id = ?")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"session_epoch"}).AddRow(0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_sessions")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	status, body := client.post("/api/login", mustJSON(t, map[string]string{
+		"email": "ada@example.com", "password": "correct horse",
+	}))
+	if status != fiber.StatusOK {
+		t.Fatalf("login: %d %v", status, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginCountsIPFailures(t *testing.T) {
+	client, mock := newLoginClient(t)
+	expectLoginUser(t, mock, 1, "correct horse")
+
+	// 19 earlier failures within the window: the 20th is still free, the
+	// account's first failure too, and nothing is forgiven
+	for _, scope := range []struct {
+		scope, identifier string
+		failures          int
+	}{{loginScopeIP, testIP, 19}, {loginScopeUser, "1", 0}} {
+		mock.ExpectBegin()
+		rows := sqlmock.NewRows([]string{"failures", "last_failure_at"})
+		if scope.failures > 0 {
+			rows.AddRow(scope.failures, time.Now().Add(-time.Minute))
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT failures, last_failure_at FROM login_attempts")).
+			WithArgs(scope.scope, scope.identifier).
+			WillReturnRows(rows)
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO login_attempts")).
+			WithArgs(scope.scope, scope.identifier, scope.failures+1, nil, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	status, body := client.post("/api/login", mustJSON(t, map[string]string{
+		"email": "ada@example.com", "password": "wrong",
+	}))
+	if status != fiber.StatusUnauthorized {
+		t.Fatalf("login: %d %v", status, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	for excess, want := range map[int]time.Duration{
+		1:  baseLockout,
+		2:  2 * baseLockout,
+		5:  16 * baseLockout,
+		50: maxLockout,
+	} {
+		if got := lockoutDuration(excess); got != want {
+			t.Errorf("lockoutDuration(%d) = %v, want %v", excess, got, want)
+		}
+	}
+}
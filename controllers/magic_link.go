@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"go-rest-api/config"
+	"go-rest-api/database"
+	"go-rest-api/internal/mailer"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// A magic link only works in the browser that asked for it. Requesting one
+// sets a random binding cookie whose hash is stored with the link, and the
+// link is refused without that cookie.
+const (
+	magicLinkTTL        = 15 * time.Minute
+	magicLinkCookie     = "magic_link_binding"
+	magicLinkCookiePath = "/api/login/magic"
+)
+
+type magicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+type verifyMagicLinkRequest struct {
+	Token string `json:"token"`
+}
+
+// RequestMagicLink emails a sign-in link if the address belongs to an
+// account. The response is the same either way.
+func (ac *AuthController) RequestMagicLink(c *fiber.Ctx) error {
+	var req magicLinkRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if err := validateEmail(email); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+			"field": "email",
+		})
+	}
+
+	// Reuse the binding from an earlier request so asking twice in one
+	// browser keeps both links working
+	binding := c.Cookies(magicLinkCookie)
+	if len(binding) < 43 {
+		var err error
+		binding, err = newToken()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to send sign-in link",
+			})
+		}
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     magicLinkCookie,
+		Value:    binding,
+		Path:     magicLinkCookiePath,
+		MaxAge:   int(magicLinkTTL.Seconds()),
+		HTTPOnly: true,
+		SameSite: "Lax",
+	})
+
+	if err := sendMagicLink(email, binding); err != nil {
+		log.Printf("Error sending magic link: %v", err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "If an account exists for this email, a sign-in link has been sent",
+	})
+}
+
+func sendMagicLink(email, binding string) error {
+	var userID int
+	err := database.DB.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = database.DB.Exec(`
+        INSERT INTO magic_links (user_id, email, token_hash, binding_hash, created_at, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, userID, email, hashToken(token), hashToken(binding), now, now.Add(magicLinkTTL))
+	if err != nil {
+		return err
+	}
+
+	link := config.GetConfig().FrontendURL + "/login/magic?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Your sign-in link",
+		Body: fmt.Sprintf("Use this link within %d minutes to sign in:\n\n%s\n\n"+
+			"It only works once, and only in the browser you requested it from.\n"+
+			"If this wasn't you, you can ignore this email.\n",
+			int(magicLinkTTL.Minutes()), link),
+	}
+
+	// Send in the background so the response time does not reveal whether
+	// the account exists
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := config.Mailer.Send(ctx, msg); err != nil {
+			log.Printf("Error sending magic link email: %v", err)
+		}
+	}()
+	return nil
+}
+
+// VerifyMagicLink logs in with a token from a sign-in link.
+func (ac *AuthController) VerifyMagicLink(c *fiber.Ctx) error {
+	var req verifyMagicLinkRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+	if req.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Token is required",
+			"field": "token",
+		})
+	}
+
+	failed := func(err error) error {
+		log.Printf("Error verifying magic link: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return failed(err)
+	}
+	defer tx.Rollback()
+
+	var id, userID int
+	var email, bindingHash string
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = tx.QueryRow(`
+        SELECT id, user_id, email, binding_hash, expires_at, used_at
+        FROM magic_links WHERE token_hash = ? FOR UPDATE
+    `, hashToken(req.Token)).Scan(&id, &userID, &email, &bindingHash, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows || (err == nil && (usedAt.Valid || !expiresAt.After(time.Now()))) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "This sign-in link is invalid or has expired",
+		})
+	} else if err != nil {
+		return failed(err)
+	}
+
+	binding := c.Cookies(magicLinkCookie)
+	if binding == "" || subtle.ConstantTimeCompare([]byte(hashToken(binding)), []byte(bindingHash)) != 1 {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Open the sign-in link in the browser you requested it from",
+		})
+	}
+
+	if _, err := tx.Exec("UPDATE magic_links SET used_at = ? WHERE id = ?", time.Now(), id); err != nil {
+		return failed(err)
+	}
+	// Opening the link proves the address works
+	_, err = tx.Exec(
+		"UPDATE users SET email_verified_at = ? WHERE id = ? AND email = ? AND email_verified_at IS NULL",
+		time.Now(), userID, email,
+	)
+	if err != nil {
+		return failed(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return failed(err)
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     magicLinkCookie,
+		Path:     magicLinkCookiePath,
+		Expires:  time.Unix(0, 0),
+		HTTPOnly: true,
+		SameSite: "Lax",
+	})
+
+	sess, err := ac.store.Get(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+	if err := rotateSession(sess); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to regenerate session",
+		})
+	}
+
+	// The link replaces the password, not the second factor
+	mfaRequired, err := totpEnabled(userID)
+	if err != nil {
+		return failed(err)
+	}
+	if mfaRequired {
+		if err := startMFAChallenge(sess, userID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to save session",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"mfa_required": true,
+		})
+	}
+
+	if err := startSession(c, sess, userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save session",
+		})
+	}
+
+	user, err := loadUser(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+
+	return c.JSON(user)
+}
@@ -0,0 +1,365 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"go-rest-api/database"
+	"go-rest-api/internal/models"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Apps that use this server as their OAuth2 provider. Confidential clients
+// get a secret, shown once and stored hashed like every other token.
+const (
+	clientSecretPrefix    = "smcs_"
+	maxClientNameLength   = 100
+	maxClientRedirectURIs = 10
+)
+
+// oauthClient is a registered app as the authorization server sees it.
+type oauthClient struct {
+	id         int
+	secretHash sql.NullString
+	models.OAuthClient
+}
+
+// loadOAuthClient returns the client with the public clientID, or
+// sql.ErrNoRows.
+func loadOAuthClient(clientID string) (*oauthClient, error) {
+	var client oauthClient
+	var redirectURIs []byte
+	err := database.DB.QueryRow(`
+        SELECT id, client_id, secret_hash, name, redirect_uris, created_at
+        FROM oauth_clients WHERE client_id = ?
+    `, clientID).Scan(&client.id, &client.ClientID, &client.secretHash, &client.Name, &redirectURIs, &client.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(redirectURIs, &client.RedirectURIs); err != nil {
+		return nil, err
+	}
+	client.Confidential = client.secretHash.Valid
+	return &client, nil
+}
+
+// validRedirectURI accepts https URLs, http on the loopback interface for
+// development and the private-use schemes of native apps (RFC 8252), which
+// must look like a reversed domain name.
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Fragment != "" || u.Opaque != "" || len(raw) > 2000 {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	case "":
+		return false
+	}
+	return strings.Contains(u.Scheme, ".")
+}
+
+type registerClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Confidential bool     `json:"confidential"`
+}
+
+// RegisterOAuthClient registers an app owned by the logged in user. The
+// client secret is only ever returned here.
+func (ac *AuthController) RegisterOAuthClient(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	var req registerClientRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxClientNameLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name is required and must be at most 100 characters",
+			"field": "name",
+		})
+	}
+	if len(req.RedirectURIs) == 0 || len(req.RedirectURIs) > maxClientRedirectURIs {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Between 1 and 10 redirect URIs are required",
+			"field": "redirect_uris",
+		})
+	}
+	for _, uri := range req.RedirectURIs {
+		if !validRedirectURI(uri) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid redirect URI: " + uri,
+				"field": "redirect_uris",
+			})
+		}
+	}
+	redirectURIs, err := json.Marshal(req.RedirectURIs)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to register app",
+		})
+	}
+
+	clientID, err := newToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to register app",
+		})
+	}
+	var secret string
+	var secretHash sql.NullString
+	if req.Confidential {
+		raw, err := newToken()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to register app",
+			})
+		}
+		secret = clientSecretPrefix + raw
+		secretHash = sql.NullString{String: hashToken(secret), Valid: true}
+	}
+
+	client := models.OAuthClient{
+		ClientID:     clientID,
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		Confidential: req.Confidential,
+		CreatedAt:    time.Now(),
+	}
+	_, err = database.DB.Exec(`
+        INSERT INTO oauth_clients (client_id, secret_hash, name, redirect_uris, owner_id, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, client.ClientID, secretHash, client.Name, redirectURIs, userID, client.CreatedAt)
+	if err != nil {
+		log.Printf("Error registering OAuth client: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to register app",
+		})
+	}
+
+	response := fiber.Map{
+		"status": "success",
+		"data":   client,
+	}
+	if secret != "" {
+		response["client_secret"] = secret
+	}
+	return c.Status(fiber.StatusCreated).JSON(response)
+}
+
+// ListOAuthClients returns the apps the logged in user registered.
+func (ac *AuthController) ListOAuthClients(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	rows, err := database.DB.Query(`
+        SELECT client_id, secret_hash IS NOT NULL, name, redirect_uris, created_at
+        FROM oauth_clients WHERE owner_id = ?
+        ORDER BY created_at DESC
+    `, userID)
+	if err != nil {
+		log.Printf("Error listing OAuth clients: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list apps",
+		})
+	}
+	defer rows.Close()
+
+	clients := make([]models.OAuthClient, 0)
+	for rows.Next() {
+		var client models.OAuthClient
+		var redirectURIs []byte
+		err := rows.Scan(&client.ClientID, &client.Confidential, &client.Name, &redirectURIs, &client.CreatedAt)
+		if err == nil {
+			err = json.Unmarshal(redirectURIs, &client.RedirectURIs)
+		}
+		if err != nil {
+			log.Printf("Error scanning OAuth client: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to list apps",
+			})
+		}
+		clients = append(clients, client)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"count":  len(clients),
+		"data":   clients,
+	})
+}
+
+// DeleteOAuthClient removes an app, which also ends every grant and token
+// it had.
+func (ac *AuthController) DeleteOAuthClient(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	clientID := c.Params("client_id")
+	result, err := database.DB.Exec("DELETE FROM oauth_clients WHERE client_id = ? AND owner_id = ?", clientID, userID)
+	if err != nil {
+		log.Printf("Error deleting OAuth client: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete app",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "App not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"client_id": clientID,
+	})
+}
+
+// ListOAuthGrants returns the apps the logged in user allowed to act on
+// their behalf.
+func (ac *AuthController) ListOAuthGrants(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	rows, err := database.DB.Query(`
+        SELECT oc.client_id, oc.name, g.scopes, g.created_at, g.updated_at,
+            (SELECT MAX(t.last_used_at) FROM oauth_access_tokens t
+             WHERE t.user_id = g.user_id AND t.client_id = g.client_id)
+        FROM oauth_grants g JOIN oauth_clients oc ON oc.id = g.client_id
+        WHERE g.user_id = ?
+        ORDER BY g.updated_at DESC
+    `, userID)
+	if err != nil {
+		log.Printf("Error listing OAuth grants: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list apps",
+		})
+	}
+	defer rows.Close()
+
+	grants := make([]models.OAuthGrant, 0)
+	for rows.Next() {
+		var g models.OAuthGrant
+		var scopes string
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&g.ClientID, &g.ClientName, &scopes, &g.CreatedAt, &g.UpdatedAt, &lastUsed); err != nil {
+			log.Printf("Error scanning OAuth grant: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to list apps",
+			})
+		}
+		g.Scopes = strings.Fields(scopes)
+		if lastUsed.Valid {
+			g.LastUsedAt = &lastUsed.Time
+		}
+		grants = append(grants, g)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"count":  len(grants),
+		"data":   grants,
+	})
+}
+
+// RevokeOAuthGrant takes away an app's access and revokes its tokens.
+func (ac *AuthController) RevokeOAuthGrant(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	client, err := loadOAuthClient(c.Params("client_id"))
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "App not found",
+		})
+	} else if err != nil {
+		log.Printf("Error loading OAuth client: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke access",
+		})
+	}
+
+	found, err := revokeOAuthGrant(userID, client.id)
+	if err != nil {
+		log.Printf("Error revoking OAuth grant: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke access",
+		})
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "App not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"client_id": client.ClientID,
+	})
+}
+
+// revokeOAuthGrant deletes the grant of userID to the client and revokes
+// the tokens issued under it. It reports whether there was a grant.
+func revokeOAuthGrant(userID, clientID int) (bool, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM oauth_grants WHERE user_id = ? AND client_id = ?", userID, clientID)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`
+        UPDATE oauth_access_tokens SET revoked_at = ?
+        WHERE user_id = ? AND client_id = ? AND revoked_at IS NULL
+    `, time.Now(), userID, clientID)
+	if err != nil {
+		return false, err
+	}
+
+	n, _ := result.RowsAffected()
+	return n > 0, tx.Commit()
+}
+
+// mergeScopes returns the sorted union of scope lists.
+func mergeScopes(lists ...[]string) []string {
+	set := make(map[string]bool)
+	for _, list := range lists {
+		for _, s := range list {
+			set[s] = true
+		}
+	}
+	merged := make([]string, 0, len(set))
+	for s := range set {
+		merged = append(merged, s)
+	}
+	sort.Strings(merged)
+	return merged
+}
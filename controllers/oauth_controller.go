@@ -0,0 +1,189 @@
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"go-rest-api/config"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"golang.org/x/oauth2"
+)
+
+// The state of a login is single use and only valid for a few minutes
+const oauthFlowExpiry = 5 * time.Minute
+
+// oauthFlow is what the session remembers between redirecting to a provider
+// and the provider redirecting back.
+type oauthFlow struct {
+	Provider  string `json:"provider"`
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	StartedAt int64  `json:"started_at"`
+	// LinkUserID is set when a logged in user is linking the provider
+	LinkUserID int `json:"link_user_id,omitempty"`
+	// TokenMode logins end with a login code for the app instead of a
+	// session, AppChallenge and AppState come from the app
+	TokenMode    bool   `json:"token_mode,omitempty"`
+	AppChallenge string `json:"app_challenge,omitempty"`
+	AppState     string `json:"app_state,omitempty"`
+}
+
+var errEmailTaken = errors.New("email belongs to another account")
+
+// beginOAuthFlow fills in the state, OIDC nonce and PKCE verifier of flow
+// and stores it in the session.
+func beginOAuthFlow(sess *session.Session, flow oauthFlow) (oauthFlow, error) {
+	state, err := newToken()
+	if err != nil {
+		return oauthFlow{}, err
+	}
+	nonce, err := newToken()
+	if err != nil {
+		return oauthFlow{}, err
+	}
+
+	flow.State = state
+	flow.Nonce = nonce
+	flow.Verifier = oauth2.GenerateVerifier()
+	flow.StartedAt = time.Now().Unix()
+	b, err := json.Marshal(flow)
+	if err != nil {
+		return oauthFlow{}, err
+	}
+
+	sess.Set("oauth_flow", string(b))
+	return flow, sess.Save()
+}
+
+// takeOAuthFlow removes the pending flow from the session and returns it if
+// it belongs to provider, matches state and has not expired. Saving releases
+// the session the flow was read from, so it also returns a fresh copy for
+// the rest of the callback.
+func (ac *AuthController) takeOAuthFlow(c *fiber.Ctx, provider, state string) (*session.Session, oauthFlow, bool, error) {
+	sess, err := ac.store.Get(c)
+	if err != nil {
+		return nil, oauthFlow{}, false, err
+	}
+	raw, _ := sess.Get("oauth_flow").(string)
+	sess.Delete("oauth_flow")
+	if err := sess.Save(); err != nil {
+		return nil, oauthFlow{}, false, err
+	}
+	if sess, err = ac.store.Get(c); err != nil {
+		return nil, oauthFlow{}, false, err
+	}
+
+	var flow oauthFlow
+	if raw == "" || json.Unmarshal([]byte(raw), &flow) != nil {
+		return sess, oauthFlow{}, false, nil
+	}
+	valid := flow.Provider == provider &&
+		time.Since(time.Unix(flow.StartedAt, 0)) <= oauthFlowExpiry &&
+		state != "" &&
+		subtle.ConstantTimeCompare([]byte(state), []byte(flow.State)) == 1
+	return sess, flow, valid, nil
+}
+
+// ProviderLogin redirects to any provider in config.Providers.
+func (ac *AuthController) ProviderLogin(c *fiber.Ctx) error {
+	provider, ok := config.Providers.Get(c.Params("provider"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown login provider",
+		})
+	}
+
+	sess, err := ac.store.Get(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+
+	flow := oauthFlow{Provider: provider.Name}
+	if ok, err := tokenModeParams(c, &flow); !ok {
+		return err
+	}
+	flow, err = beginOAuthFlow(sess, flow)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start login",
+		})
+	}
+
+	return c.Redirect(provider.AuthCodeURL(flow.State, flow.Nonce, flow.Verifier))
+}
+
+func (ac *AuthController) ProviderCallback(c *fiber.Ctx) error {
+	provider, ok := config.Providers.Get(c.Params("provider"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Unknown login provider",
+		})
+	}
+
+	if errorMsg := c.Query("error"); errorMsg != "" {
+		log.Printf("OAuth error from %s: %s - %s", provider.Name, errorMsg, c.Query("error_description"))
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":       "Authentication failed: " + errorMsg,
+			"description": c.Query("error_description"),
+		})
+	}
+
+	sess, flow, valid, err := ac.takeOAuthFlow(c, provider.Name, c.Query("state"))
+	if err != nil {
+		log.Printf("Session error: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+	if !valid {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid OAuth state",
+		})
+	}
+
+	code := c.Query("code")
+	if code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing authorization code",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	token, profile, err := provider.Exchange(ctx, code, flow.Nonce, flow.Verifier)
+	if err != nil {
+		log.Printf("Login with %s failed: %v", provider.Name, err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Authentication failed",
+		})
+	}
+
+	return ac.completeProviderLogin(c, sess, flow, profile, token)
+}
+
+var invalidUsernameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// sanitizeUsername turns a display name into something validateUsername
+// accepts.
+func sanitizeUsername(name string) string {
+	name = invalidUsernameChars.ReplaceAllString(strings.TrimSpace(name), "_")
+	name = strings.Trim(name, "_")
+	if len(name) > maxUsernameLength {
+		name = name[:maxUsernameLength]
+	}
+	for len(name) < minUsernameLength {
+		name += "_"
+	}
+	return name
+}
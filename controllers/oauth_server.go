@@ -0,0 +1,697 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"go-rest-api/config"
+	"go-rest-api/database"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// The authorization server lets registered apps act for our users through
+// the authorization code flow with PKCE (RFC 6749, RFC 7636). The browser
+// lands on /oauth/authorize, the SPA shows the consent screen it gets from
+// LoginPage and posts the decision back, and the app swaps the code for an
+// access token at /oauth/token. Endpoints called by apps answer with the
+// error format of RFC 6749 so standard client libraries understand them.
+
+const (
+	appTokenPrefix      = "smo_"
+	appTokenTTL         = time.Hour
+	oauthCodeTTL        = 5 * time.Minute
+	authorizeRequestTTL = 10 * time.Minute
+)
+
+// scopeDescriptions is what the consent screen tells the user.
+var scopeDescriptions = map[string]string{
+	ScopePostsRead:   "Read posts",
+	ScopePostsWrite:  "Write, edit and delete your posts and like posts",
+	ScopeProfileRead: "See your profile",
+}
+
+// authorizeRequest is an authorization waiting for the user's consent. It
+// lives in the session between /oauth/authorize and the decision.
+// RedirectURISent is false when the app left redirect_uri out and got its
+// only registered one.
+type authorizeRequest struct {
+	ID              string   `json:"id"`
+	ClientID        string   `json:"client_id"`
+	RedirectURI     string   `json:"redirect_uri"`
+	RedirectURISent bool     `json:"redirect_uri_sent"`
+	Scopes          []string `json:"scopes"`
+	State           string   `json:"state"`
+	Challenge       string   `json:"challenge"`
+	CreatedAt       int64    `json:"created_at"`
+}
+
+func oauthError(c *fiber.Ctx, status int, code, description string) error {
+	return c.Status(status).JSON(fiber.Map{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// oauthRedirect sends the browser back to the app with params added to its
+// redirect URI.
+func oauthRedirect(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// parseScopes splits a space separated scope parameter, rejecting unknown
+// scopes.
+func parseScopes(raw string) ([]string, bool) {
+	scopes := strings.Fields(raw)
+	for _, s := range scopes {
+		if !validScopes[s] {
+			return nil, false
+		}
+	}
+	scopes = mergeScopes(scopes)
+	return scopes, len(scopes) > 0
+}
+
+// grantCovers reports whether userID already allowed the client every scope.
+func grantCovers(userID, clientID int, scopes []string) (bool, error) {
+	var granted string
+	err := database.DB.QueryRow(
+		"SELECT scopes FROM oauth_grants WHERE user_id = ? AND client_id = ?", userID, clientID,
+	).Scan(&granted)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	have := make(map[string]bool)
+	for _, s := range strings.Fields(granted) {
+		have[s] = true
+	}
+	for _, s := range scopes {
+		if !have[s] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// issueAuthorizationCode stores a single use code for req and returns the
+// URL that hands it to the app.
+func issueAuthorizationCode(client *oauthClient, userID int, req authorizeRequest) (string, error) {
+	code, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = database.DB.Exec(`
+        INSERT INTO oauth_codes (code_hash, client_id, user_id, redirect_uri, redirect_uri_sent, scopes, code_challenge, created_at, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, hashToken(code), client.id, userID, req.RedirectURI, req.RedirectURISent, strings.Join(req.Scopes, " "), req.Challenge,
+		now, now.Add(oauthCodeTTL))
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{"code": {code}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	return oauthRedirect(req.RedirectURI, params), nil
+}
+
+// Authorize starts an authorization. Problems with the client or redirect
+// URI are shown here, since redirecting would hand the browser to an
+// unverified URL. Everything else goes back to the app. Users who already
+// allowed every requested scope skip the consent screen.
+func (ac *AuthController) Authorize(c *fiber.Ctx) error {
+	client, err := loadOAuthClient(c.Query("client_id"))
+	if err == sql.ErrNoRows {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_client", "Unknown client_id")
+	} else if err != nil {
+		log.Printf("Error loading OAuth client: %v", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "Failed to load the app")
+	}
+
+	redirectURI := c.Query("redirect_uri")
+	redirectURISent := redirectURI != ""
+	if !redirectURISent && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	registered := false
+	for _, uri := range client.RedirectURIs {
+		if uri == redirectURI {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_request", "redirect_uri is not registered for this app")
+	}
+
+	state := c.Query("state")
+	fail := func(code, description string) error {
+		params := url.Values{"error": {code}, "error_description": {description}}
+		if state != "" {
+			params.Set("state", state)
+		}
+		return c.Redirect(oauthRedirect(redirectURI, params))
+	}
+
+	if c.Query("response_type") != "code" {
+		return fail("unsupported_response_type", "Only the code response type is supported")
+	}
+	challenge := c.Query("code_challenge")
+	if c.Query("code_challenge_method") != "S256" || len(challenge) < 43 || len(challenge) > 128 {
+		return fail("invalid_request", "An S256 code_challenge is required")
+	}
+	scopes, ok := parseScopes(c.Query("scope"))
+	if !ok {
+		return fail("invalid_scope", "Unknown or missing scope")
+	}
+
+	id, err := newToken()
+	if err != nil {
+		return fail("server_error", "Failed to start authorization")
+	}
+	req := authorizeRequest{
+		ID:              id,
+		ClientID:        client.ClientID,
+		RedirectURI:     redirectURI,
+		RedirectURISent: redirectURISent,
+		Scopes:          scopes,
+		State:           state,
+		Challenge:       challenge,
+		CreatedAt:       time.Now().Unix(),
+	}
+
+	sess, err := ac.store.Get(c)
+	if err != nil {
+		return fail("server_error", "Failed to get session")
+	}
+	userID, err := sessionUserID(c, sess)
+	if err != nil {
+		log.Printf("Error reading session user: %v", err)
+		return fail("server_error", "Failed to get session")
+	}
+	if userID != 0 {
+		covered, err := grantCovers(userID, client.id, scopes)
+		if err != nil {
+			log.Printf("Error checking OAuth grant: %v", err)
+			return fail("server_error", "Failed to check earlier consent")
+		}
+		if covered {
+			redirect, err := issueAuthorizationCode(client, userID, req)
+			if err != nil {
+				log.Printf("Error issuing authorization code: %v", err)
+				return fail("server_error", "Failed to issue code")
+			}
+			return c.Redirect(redirect)
+		}
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return fail("server_error", "Failed to start authorization")
+	}
+	sess.Set("oauth_authorize", string(b))
+	if err := sess.Save(); err != nil {
+		return fail("server_error", "Failed to save session")
+	}
+
+	return c.Redirect(config.GetConfig().FrontendURL + "/oauth/consent?request=" + url.QueryEscape(id))
+}
+
+// pendingAuthorization returns the authorization waiting in sess if it is
+// the one with id and has not expired.
+func pendingAuthorization(sess *session.Session, id string) (authorizeRequest, bool) {
+	var req authorizeRequest
+	raw, _ := sess.Get("oauth_authorize").(string)
+	if raw == "" || json.Unmarshal([]byte(raw), &req) != nil {
+		return req, false
+	}
+	valid := id != "" &&
+		subtle.ConstantTimeCompare([]byte(id), []byte(req.ID)) == 1 &&
+		time.Since(time.Unix(req.CreatedAt, 0)) <= authorizeRequestTTL
+	return req, valid
+}
+
+// consentScreen describes a pending authorization for the SPA to ask the
+// user about.
+func (ac *AuthController) consentScreen(c *fiber.Ctx, requestID string) error {
+	sess, err := ac.store.Get(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+	req, ok := pendingAuthorization(sess, requestID)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Authorization request expired, start again from the app",
+		})
+	}
+
+	userID, err := sessionUserID(c, sess)
+	if err != nil {
+		log.Printf("Error reading session user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+	if userID == 0 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error":   "Please log in",
+			"request": req.ID,
+		})
+	}
+
+	client, err := loadOAuthClient(req.ClientID)
+	if err != nil {
+		log.Printf("Error loading OAuth client: %v", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The app is no longer registered",
+		})
+	}
+	user, err := loadUser(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+
+	scopes := make([]fiber.Map, 0, len(req.Scopes))
+	for _, s := range req.Scopes {
+		scopes = append(scopes, fiber.Map{"name": s, "description": scopeDescriptions[s]})
+	}
+	return c.JSON(fiber.Map{
+		"request": req.ID,
+		"client": fiber.Map{
+			"client_id": client.ClientID,
+			"name":      client.Name,
+			"redirects": redirectTarget(req.RedirectURI),
+		},
+		"scopes": scopes,
+		"user": fiber.Map{
+			"id":       user.ID,
+			"username": user.Username,
+		},
+	})
+}
+
+// redirectTarget is how the consent screen names where the user is sent:
+// the origin of web redirect URIs and the scheme alone for the private-use
+// schemes of native apps, which have no host.
+func redirectTarget(redirectURI string) string {
+	u, err := url.Parse(redirectURI)
+	switch {
+	case err != nil || u.Scheme == "":
+		return redirectURI
+	case u.Host == "":
+		return u.Scheme + ":"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+type consentRequest struct {
+	Request string `json:"request" form:"request"`
+	Approve bool   `json:"approve" form:"approve"`
+}
+
+// Consent records the user's decision on the pending authorization and
+// returns where to send the browser next.
+func (ac *AuthController) Consent(c *fiber.Ctx) error {
+	sess, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	var body consentRequest
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	req, ok := pendingAuthorization(sess, body.Request)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Authorization request expired, start again from the app",
+		})
+	}
+	sess.Delete("oauth_authorize")
+	if err := sess.Save(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save session",
+		})
+	}
+
+	if !body.Approve {
+		params := url.Values{"error": {"access_denied"}}
+		if req.State != "" {
+			params.Set("state", req.State)
+		}
+		return c.JSON(fiber.Map{
+			"redirect_to": oauthRedirect(req.RedirectURI, params),
+		})
+	}
+
+	client, err := loadOAuthClient(req.ClientID)
+	if err != nil {
+		log.Printf("Error loading OAuth client: %v", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The app is no longer registered",
+		})
+	}
+
+	if err := saveOAuthGrant(userID, client.id, req.Scopes); err != nil {
+		log.Printf("Error saving OAuth grant: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save consent",
+		})
+	}
+	redirect, err := issueAuthorizationCode(client, userID, req)
+	if err != nil {
+		log.Printf("Error issuing authorization code: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to issue code",
+		})
+	}
+
+	log.Printf("User %d allowed app %s: %s", userID, client.ClientID, strings.Join(req.Scopes, " "))
+	return c.JSON(fiber.Map{
+		"redirect_to": redirect,
+	})
+}
+
+// saveOAuthGrant adds scopes to what userID allowed the client.
+func saveOAuthGrant(userID, clientID int, scopes []string) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var existing string
+	err = tx.QueryRow(
+		"SELECT scopes FROM oauth_grants WHERE user_id = ? AND client_id = ? FOR UPDATE", userID, clientID,
+	).Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	now := time.Now()
+	merged := strings.Join(mergeScopes(strings.Fields(existing), scopes), " ")
+	_, err = tx.Exec(`
+        INSERT INTO oauth_grants (user_id, client_id, scopes, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE scopes = VALUES(scopes), updated_at = VALUES(updated_at)
+    `, userID, clientID, merged, now, now)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// authenticateClient identifies the calling app from HTTP Basic auth or the
+// client_id and client_secret parameters. Public clients send no secret.
+// On failure it writes the error response and returns nil.
+func authenticateClient(c *fiber.Ctx, clientID, secret string) (*oauthClient, error) {
+	if header := c.Get(fiber.HeaderAuthorization); header != "" {
+		scheme, _, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Basic") {
+			return nil, oauthError(c, fiber.StatusUnauthorized, "invalid_client", "Use Basic client authentication")
+		}
+		var ok bool
+		clientID, secret, ok = parseBasicAuth(header)
+		if !ok {
+			return nil, oauthError(c, fiber.StatusUnauthorized, "invalid_client", "Malformed Basic credentials")
+		}
+	}
+
+	client, err := loadOAuthClient(clientID)
+	if err == sql.ErrNoRows {
+		return nil, oauthError(c, fiber.StatusUnauthorized, "invalid_client", "Unknown client")
+	} else if err != nil {
+		log.Printf("Error loading OAuth client: %v", err)
+		return nil, oauthError(c, fiber.StatusInternalServerError, "server_error", "Failed to load the app")
+	}
+
+	if client.Confidential {
+		if subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(client.secretHash.String)) != 1 {
+			return nil, oauthError(c, fiber.StatusUnauthorized, "invalid_client", "Wrong client secret")
+		}
+	} else if secret != "" {
+		return nil, oauthError(c, fiber.StatusUnauthorized, "invalid_client", "Public clients have no secret")
+	}
+	return client, nil
+}
+
+// parseBasicAuth decodes Basic credentials, which OAuth2 form-encodes
+// before base64 (RFC 6749 section 2.3.1).
+func parseBasicAuth(header string) (string, string, bool) {
+	_, encoded, _ := strings.Cut(header, " ")
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	id, secret, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+	id, err1 := url.QueryUnescape(id)
+	secret, err2 := url.QueryUnescape(secret)
+	return id, secret, err1 == nil && err2 == nil
+}
+
+type oauthTokenRequest struct {
+	ClientID     string `json:"client_id" form:"client_id"`
+	ClientSecret string `json:"client_secret" form:"client_secret"`
+	GrantType    string `json:"grant_type" form:"grant_type"`
+	Code         string `json:"code" form:"code"`
+	RedirectURI  string `json:"redirect_uri" form:"redirect_uri"`
+	CodeVerifier string `json:"code_verifier" form:"code_verifier"`
+}
+
+// OAuthToken swaps an authorization code for an access token.
+func (ac *AuthController) OAuthToken(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	var req oauthTokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_request", "Invalid request payload")
+	}
+	client, err := authenticateClient(c, req.ClientID, req.ClientSecret)
+	if client == nil {
+		return err
+	}
+	if req.GrantType != "authorization_code" {
+		return oauthError(c, fiber.StatusBadRequest, "unsupported_grant_type", "Only authorization_code is supported")
+	}
+
+	invalid := func() error {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_grant", "Invalid or expired authorization code")
+	}
+	failed := func(err error) error {
+		log.Printf("Error exchanging authorization code: %v", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "Failed to issue token")
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return failed(err)
+	}
+	defer tx.Rollback()
+
+	var codeID, codeClientID, userID int
+	var redirectURI, scopes, challenge string
+	var redirectURISent bool
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = tx.QueryRow(`
+        SELECT id, client_id, user_id, redirect_uri, redirect_uri_sent, scopes, code_challenge, expires_at, used_at
+        FROM oauth_codes WHERE code_hash = ? FOR UPDATE
+    `, hashToken(req.Code)).Scan(&codeID, &codeClientID, &userID, &redirectURI, &redirectURISent, &scopes, &challenge, &expiresAt, &usedAt)
+	if err == sql.ErrNoRows {
+		return invalid()
+	} else if err != nil {
+		return failed(err)
+	}
+
+	// A code used twice has leaked, so the tokens from its first use go too
+	if usedAt.Valid {
+		_, err := tx.Exec("UPDATE oauth_access_tokens SET revoked_at = ? WHERE code_id = ? AND revoked_at IS NULL", time.Now(), codeID)
+		if err != nil {
+			return failed(err)
+		}
+		if err := tx.Commit(); err != nil {
+			return failed(err)
+		}
+		log.Printf("Authorization code %d reused, revoked its tokens", codeID)
+		return invalid()
+	}
+	if _, err := tx.Exec("UPDATE oauth_codes SET used_at = ? WHERE id = ?", time.Now(), codeID); err != nil {
+		return failed(err)
+	}
+
+	// redirect_uri must be repeated only if it was sent to /oauth/authorize
+	redirectMismatch := (redirectURISent || req.RedirectURI != "") && req.RedirectURI != redirectURI
+	if codeClientID != client.id || redirectMismatch ||
+		!expiresAt.After(time.Now()) || !verifyPKCE(req.CodeVerifier, challenge) {
+		if err := tx.Commit(); err != nil {
+			return failed(err)
+		}
+		return invalid()
+	}
+
+	// The user may have revoked the app while the code was in flight
+	var granted bool
+	err = tx.QueryRow("SELECT TRUE FROM oauth_grants WHERE user_id = ? AND client_id = ?", userID, client.id).Scan(&granted)
+	if err == sql.ErrNoRows {
+		if err := tx.Commit(); err != nil {
+			return failed(err)
+		}
+		return invalid()
+	} else if err != nil {
+		return failed(err)
+	}
+
+	secret, err := newToken()
+	if err != nil {
+		return failed(err)
+	}
+	raw := appTokenPrefix + secret
+	now := time.Now()
+	_, err = tx.Exec(`
+        INSERT INTO oauth_access_tokens (token_hash, client_id, user_id, code_id, scopes, created_at, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, hashToken(raw), client.id, userID, codeID, scopes, now, now.Add(appTokenTTL))
+	if err != nil {
+		return failed(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return failed(err)
+	}
+
+	return c.JSON(fiber.Map{
+		"access_token": raw,
+		"token_type":   "Bearer",
+		"expires_in":   int(appTokenTTL.Seconds()),
+		"scope":        scopes,
+	})
+}
+
+// lookupAppToken returns the user and scopes of a valid token issued to an
+// app, or a zero user ID if the token is unknown, revoked or expired.
+func lookupAppToken(raw string) (int, map[string]bool, error) {
+	var id, userID int
+	var scopes string
+	var lastUsed sql.NullTime
+	err := database.DB.QueryRow(`
+        SELECT id, user_id, scopes, last_used_at FROM oauth_access_tokens
+        WHERE token_hash = ? AND revoked_at IS NULL AND expires_at > ?
+    `, hashToken(raw), time.Now()).Scan(&id, &userID, &scopes, &lastUsed)
+	if err == sql.ErrNoRows {
+		return 0, nil, nil
+	} else if err != nil {
+		log.Printf("Error looking up app token: %v", err)
+		return 0, nil, err
+	}
+
+	if !lastUsed.Valid || time.Since(lastUsed.Time) >= accessTokenTouchInterval {
+		_, err := database.DB.Exec("UPDATE oauth_access_tokens SET last_used_at = ? WHERE id = ?", time.Now(), id)
+		if err != nil {
+			log.Printf("Error recording app token use: %v", err)
+		}
+	}
+
+	granted := make(map[string]bool)
+	for _, s := range strings.Fields(scopes) {
+		granted[s] = true
+	}
+	return userID, granted, nil
+}
+
+type tokenParamRequest struct {
+	ClientID     string `json:"client_id" form:"client_id"`
+	ClientSecret string `json:"client_secret" form:"client_secret"`
+	Token        string `json:"token" form:"token"`
+}
+
+// Introspect tells an app whether one of its tokens is active (RFC 7662).
+// Tokens of other apps are reported as inactive.
+func (ac *AuthController) Introspect(c *fiber.Ctx) error {
+	var req tokenParamRequest
+	if err := c.BodyParser(&req); err != nil {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_request", "Invalid request payload")
+	}
+	client, err := authenticateClient(c, req.ClientID, req.ClientSecret)
+	if client == nil {
+		return err
+	}
+
+	var userID int
+	var username, scopes string
+	var createdAt, expiresAt time.Time
+	err = database.DB.QueryRow(`
+        SELECT t.user_id, u.username, t.scopes, t.created_at, t.expires_at
+        FROM oauth_access_tokens t JOIN users u ON u.id = t.user_id
+        WHERE t.token_hash = ? AND t.client_id = ? AND t.revoked_at IS NULL AND t.expires_at > ?
+    `, hashToken(req.Token), client.id, time.Now()).Scan(&userID, &username, &scopes, &createdAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return c.JSON(fiber.Map{"active": false})
+	} else if err != nil {
+		log.Printf("Error introspecting token: %v", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "Failed to look up token")
+	}
+
+	return c.JSON(fiber.Map{
+		"active":     true,
+		"scope":      scopes,
+		"client_id":  client.ClientID,
+		"username":   username,
+		"sub":        strconv.Itoa(userID),
+		"token_type": "Bearer",
+		"iat":        createdAt.Unix(),
+		"exp":        expiresAt.Unix(),
+	})
+}
+
+// RevokeAppToken lets an app revoke one of its tokens (RFC 7009). Unknown
+// tokens are not reported.
+func (ac *AuthController) RevokeAppToken(c *fiber.Ctx) error {
+	var req tokenParamRequest
+	if err := c.BodyParser(&req); err != nil {
+		return oauthError(c, fiber.StatusBadRequest, "invalid_request", "Invalid request payload")
+	}
+	client, err := authenticateClient(c, req.ClientID, req.ClientSecret)
+	if client == nil {
+		return err
+	}
+
+	_, err = database.DB.Exec(`
+        UPDATE oauth_access_tokens SET revoked_at = ?
+        WHERE token_hash = ? AND client_id = ? AND revoked_at IS NULL
+    `, time.Now(), hashToken(req.Token), client.id)
+	if err != nil {
+		log.Printf("Error revoking app token: %v", err)
+		return oauthError(c, fiber.StatusInternalServerError, "server_error", "Failed to revoke token")
+	}
+
+	return c.SendStatus(fiber.StatusOK)
+}
@@ -0,0 +1,323 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+const (
+	testOAuthCode     = "test-code"
+	testClientSecret  = "client secret"
+	testRedirectURI   = "https://app.example.com/callback"
+	testCodeVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	testOAuthClientID = "app"
+)
+
+func testCodeChallenge() string {
+	sum := sha256.Sum256([]byte(testCodeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// expectOAuthClient loads the client with the public clientID and internal
+// id. Confidential clients have the secret testClientSecret.
+func expectOAuthClient(mock sqlmock.Sqlmock, id int, clientID string, confidential bool) {
+	var secretHash interface{}
+	if confidential {
+		secretHash = hashToken(testClientSecret)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, client_id, secret_hash, name, redirect_uris, created_at FROM oauth_clients")).
+		WithArgs(clientID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "client_id", "secret_hash", "name", "redirect_uris", "created_at"}).
+			AddRow(id, clientID, secretHash, "Test app", `["`+testRedirectURI+`"]`, time.Now()))
+}
+
+// oauthCode is the row of testOAuthCode in oauth_codes.
+type oauthCode struct {
+	clientID     int
+	redirectSent bool
+	expiresAt    time.Time
+	usedAt       interface{}
+}
+
+func validCode() oauthCode {
+	return oauthCode{clientID: 1, redirectSent: true, expiresAt: time.Now().Add(time.Minute)}
+}
+
+func expectOAuthCode(mock sqlmock.Sqlmock, code oauthCode) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, client_id, user_id, redirect_uri, redirect_uri_sent, scopes, code_challenge, expires_at, used_at FROM oauth_codes")).
+		WithArgs(hashToken(testOAuthCode)).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"id", "client_id", "user_id", "redirect_uri", "redirect_uri_sent", "scopes", "code_challenge", "expires_at", "used_at",
+		}).AddRow(10, code.clientID, 1, testRedirectURI, code.redirectSent, "posts:read", testCodeChallenge(), code.expiresAt, code.usedAt))
+}
+
+// expectCodeRefused marks the code used and refuses it.
+func expectCodeRefused(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE oauth_codes SET used_at = ? WHERE id = ?")).
+		WithArgs(sqlmock.AnyArg(), 10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+// expectTokenIssued marks the code used and issues a token for the grant.
+func expectTokenIssued(mock sqlmock.Sqlmock, clientID int) {
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE oauth_codes SET used_at = ? WHERE id = ?")).
+		WithArgs(sqlmock.AnyArg(), 10).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT TRUE FROM oauth_grants WHERE user_id = ? AND client_id = ?")).
+		WithArgs(1, clientID).
+		WillReturnRows(sqlmock.NewRows([]string{"granted"}).AddRow(true))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO oauth_access_tokens")).
+		WithArgs(sqlmock.AnyArg(), clientID, 1, 10, "posts:read", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func basicAuth(clientID, secret string) http.Header {
+	raw := url.QueryEscape(clientID) + ":" + url.QueryEscape(secret)
+	return http.Header{fiber.HeaderAuthorization: {"Basic " + base64.StdEncoding.EncodeToString([]byte(raw))}}
+}
+
+func TestOAuthToken(t *testing.T) {
+	exchange := func(overrides map[string]string) map[string]string {
+		body := map[string]string{
+			"grant_type":    "authorization_code",
+			"client_id":     testOAuthClientID,
+			"client_secret": testClientSecret,
+			"code":          testOAuthCode,
+			"redirect_uri":  testRedirectURI,
+			"code_verifier": testCodeVerifier,
+		}
+		for k, v := range overrides {
+			if v == "" {
+				delete(body, k)
+			} else {
+				body[k] = v
+			}
+		}
+		return body
+	}
+	omittedRedirect := validCode()
+	omittedRedirect.redirectSent = false
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   map[string]string
+		expect func(sqlmock.Sqlmock)
+		status int
+		err    string
+	}{
+		{"secret in body", nil, exchange(nil), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+			expectOAuthCode(mock, validCode())
+			expectTokenIssued(mock, 1)
+		}, fiber.StatusOK, ""},
+		{"basic auth", basicAuth(testOAuthClientID, testClientSecret), exchange(map[string]string{"client_id": "", "client_secret": ""}), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+			expectOAuthCode(mock, validCode())
+			expectTokenIssued(mock, 1)
+		}, fiber.StatusOK, ""},
+		{"public client", nil, exchange(map[string]string{"client_secret": ""}), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, false)
+			expectOAuthCode(mock, validCode())
+			expectTokenIssued(mock, 1)
+		}, fiber.StatusOK, ""},
+		{"redirect_uri left out twice", nil, exchange(map[string]string{"redirect_uri": ""}), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+			expectOAuthCode(mock, omittedRedirect)
+			expectTokenIssued(mock, 1)
+		}, fiber.StatusOK, ""},
+		{"wrong secret", nil, exchange(map[string]string{"client_secret": "guess"}), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+		}, fiber.StatusUnauthorized, "invalid_client"},
+		{"wrong secret in basic auth", basicAuth(testOAuthClientID, "guess"), exchange(map[string]string{"client_id": "", "client_secret": ""}), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+		}, fiber.StatusUnauthorized, "invalid_client"},
+		{"public client sending a secret", nil, exchange(nil), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, false)
+		}, fiber.StatusUnauthorized, "invalid_client"},
+		{"wrong verifier", nil, exchange(map[string]string{"code_verifier": strings.Repeat("a", 43)}), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+			expectOAuthCode(mock, validCode())
+			expectCodeRefused(mock)
+		}, fiber.StatusBadRequest, "invalid_grant"},
+		{"wrong client", nil, exchange(map[string]string{"client_id": "other"}), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 2, "other", true)
+			expectOAuthCode(mock, validCode())
+			expectCodeRefused(mock)
+		}, fiber.StatusBadRequest, "invalid_grant"},
+		{"expired code", nil, exchange(nil), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+			code := validCode()
+			code.expiresAt = time.Now().Add(-time.Second)
+			expectOAuthCode(mock, code)
+			expectCodeRefused(mock)
+		}, fiber.StatusBadRequest, "invalid_grant"},
+		{"redirect_uri sent once", nil, exchange(map[string]string{"redirect_uri": ""}), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+			expectOAuthCode(mock, validCode())
+			expectCodeRefused(mock)
+		}, fiber.StatusBadRequest, "invalid_grant"},
+		{"different redirect_uri", nil, exchange(map[string]string{"redirect_uri": testRedirectURI + "/other"}), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+			expectOAuthCode(mock, omittedRedirect)
+			expectCodeRefused(mock)
+		}, fiber.StatusBadRequest, "invalid_grant"},
+		{"grant revoked meanwhile", nil, exchange(nil), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+			expectOAuthCode(mock, validCode())
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE oauth_codes SET used_at = ?")).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT TRUE FROM oauth_grants")).
+				WithArgs(1, 1).
+				WillReturnRows(sqlmock.NewRows([]string{"granted"}))
+			mock.ExpectCommit()
+		}, fiber.StatusBadRequest, "invalid_grant"},
+		// The tokens issued from the code's first use are revoked
+		{"reused code", nil, exchange(nil), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+			code := validCode()
+			code.usedAt = time.Now().Add(-time.Minute)
+			expectOAuthCode(mock, code)
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE oauth_access_tokens SET revoked_at = ? WHERE code_id = ? AND revoked_at IS NULL")).
+				WithArgs(sqlmock.AnyArg(), 10).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		}, fiber.StatusBadRequest, "invalid_grant"},
+		{"unsupported grant", nil, exchange(map[string]string{"grant_type": "password"}), func(mock sqlmock.Sqlmock) {
+			expectOAuthClient(mock, 1, testOAuthClientID, true)
+		}, fiber.StatusBadRequest, "unsupported_grant_type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			ac := NewAuthController(session.New())
+			app := fiber.New()
+			app.Post("/oauth/token", ac.OAuthToken)
+			tt.expect(mock)
+
+			status, body := newTestClient(t, app).do(http.MethodPost, "/oauth/token", mustJSON(t, tt.body), tt.header)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d: %v", status, tt.status, body)
+			}
+			if tt.err != "" && body["error"] != tt.err {
+				t.Errorf("error %v, want %s", body["error"], tt.err)
+			}
+			if token, _ := body["access_token"].(string); tt.status == fiber.StatusOK && !strings.HasPrefix(token, appTokenPrefix) {
+				t.Errorf("access_token %q", token)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRecordsRedirectURISent(t *testing.T) {
+	for _, sent := range []bool{true, false} {
+		mock := newMockDB(t)
+		store := session.New()
+		ac := NewAuthController(store)
+		app := fiber.New()
+		app.Post("/test/login/:id", testLogin(store))
+		app.Get("/oauth/authorize", ac.Authorize)
+		client := newTestClient(t, app)
+		if status, _ := client.post("/test/login/1", nil); status != fiber.StatusOK {
+			t.Fatalf("test login: %d", status)
+		}
+
+		params := url.Values{
+			"client_id":             {testOAuthClientID},
+			"response_type":         {"code"},
+			"scope":                 {"posts:read"},
+			"code_challenge":        {testCodeChallenge()},
+			"code_challenge_method": {"S256"},
+		}
+		if sent {
+			params.Set("redirect_uri", testRedirectURI)
+		}
+		expectOAuthClient(mock, 1, testOAuthClientID, false)
+		expectSessionUser(mock, 1)
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT scopes FROM oauth_grants")).
+			WithArgs(1, 1).
+			WillReturnRows(sqlmock.NewRows([]string{"scopes"}).AddRow("posts:read"))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO oauth_codes")).
+			WithArgs(sqlmock.AnyArg(), 1, 1, testRedirectURI, sent, "posts:read", testCodeChallenge(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(10, 1))
+
+		if status, body := client.do(http.MethodGet, "/oauth/authorize?"+params.Encode(), nil, nil); status != fiber.StatusFound {
+			t.Fatalf("sent %v: %d %v", sent, status, body)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("sent %v: %v", sent, err)
+		}
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	const token = appTokenPrefix + "test"
+	tests := []struct {
+		name     string
+		clientID string
+		id       int
+		found    bool
+	}{
+		{"own token", testOAuthClientID, 1, true},
+		// The lookup is limited to the caller's tokens
+		{"token of another app", "other", 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			ac := NewAuthController(session.New())
+			app := fiber.New()
+			app.Post("/oauth/introspect", ac.Introspect)
+
+			expectOAuthClient(mock, tt.id, tt.clientID, true)
+			rows := sqlmock.NewRows([]string{"user_id", "username", "scopes", "created_at", "expires_at"})
+			if tt.found {
+				rows.AddRow(1, "ada", "posts:read", time.Now(), time.Now().Add(time.Hour))
+			}
+			mock.ExpectQuery(regexp.QuoteMeta("FROM oauth_access_tokens t JOIN users u ON u.id = t.user_id")).
+				WithArgs(hashToken(token), tt.id, sqlmock.AnyArg()).
+				WillReturnRows(rows)
+
+			status, body := newTestClient(t, app).do(http.MethodPost, "/oauth/introspect", mustJSON(t, map[string]string{"token": token}),
+				basicAuth(tt.clientID, testClientSecret))
+			if status != fiber.StatusOK || body["active"] != tt.found {
+				t.Fatalf("introspect: %d %v", status, body)
+			}
+			if tt.found && body["sub"] != "1" {
+				t.Errorf("sub %v", body["sub"])
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	for uri, want := range map[string]string{
+		"https://app.example.com/callback?x=1": "https://app.example.com",
+		"http://127.0.0.1:8080/cb":             "http://127.0.0.1:8080",
+		"com.example.app:/cb":                  "com.example.app:",
+		"%zz":                                  "%zz",
+	} {
+		if got := redirectTarget(uri); got != want {
+			t.Errorf("redirectTarget(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
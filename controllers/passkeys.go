@@ -0,0 +1,470 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"go-rest-api/config"
+	"go-rest-api/database"
+	"go-rest-api/internal/models"
+	"go-rest-api/internal/storage"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// Passkeys are stored in webauthn_credentials. Every user who registers one
+// gets a random webauthn_user_handle, which is what authenticators hand back
+// during usernameless login instead of our numeric user ID.
+
+type webauthnUser struct {
+	id          int
+	handle      []byte
+	username    string
+	email       string
+	credentials []webauthn.Credential
+}
+
+func (u *webauthnUser) WebAuthnID() []byte                         { return u.handle }
+func (u *webauthnUser) WebAuthnName() string                       { return u.email }
+func (u *webauthnUser) WebAuthnDisplayName() string                { return u.username }
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// loadWebAuthnUser loads a user and their credentials, creating a user handle
+// if they do not have one yet.
+func loadWebAuthnUser(userID int) (*webauthnUser, error) {
+	u := &webauthnUser{id: userID}
+	err := database.DB.QueryRow(
+		"SELECT username, email, webauthn_user_handle FROM users WHERE id = ?", userID,
+	).Scan(&u.username, &u.email, &u.handle)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(u.handle) == 0 {
+		handle := make([]byte, 64)
+		if _, err := rand.Read(handle); err != nil {
+			return nil, err
+		}
+		_, err := database.DB.Exec("UPDATE users SET webauthn_user_handle = ? WHERE id = ?", handle, userID)
+		if err != nil {
+			return nil, err
+		}
+		u.handle = handle
+	}
+
+	u.credentials, err = loadWebAuthnCredentials(userID)
+	return u, err
+}
+
+func loadWebAuthnUserByHandle(handle []byte) (*webauthnUser, error) {
+	var userID int
+	err := database.DB.QueryRow("SELECT id FROM users WHERE webauthn_user_handle = ?", handle).Scan(&userID)
+	if err != nil {
+		return nil, err
+	}
+	return loadWebAuthnUser(userID)
+}
+
+func loadWebAuthnCredentials(userID int) ([]webauthn.Credential, error) {
+	rows, err := database.DB.Query(`
+        SELECT credential_id, public_key, attestation_type, transports, aaguid, sign_count, flags, clone_warning
+        FROM webauthn_credentials
+        WHERE user_id = ?
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := make([]webauthn.Credential, 0)
+	for rows.Next() {
+		var cred webauthn.Credential
+		var transports string
+		var flags uint8
+		err := rows.Scan(
+			&cred.ID,
+			&cred.PublicKey,
+			&cred.AttestationType,
+			&transports,
+			&cred.Authenticator.AAGUID,
+			&cred.Authenticator.SignCount,
+			&flags,
+			&cred.Authenticator.CloneWarning,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		cred.Flags = webauthn.NewCredentialFlags(protocol.AuthenticatorFlags(flags))
+		if transports != "" {
+			for _, t := range strings.Split(transports, ",") {
+				cred.Transport = append(cred.Transport, protocol.AuthenticatorTransport(t))
+			}
+		}
+		credentials = append(credentials, cred)
+	}
+	return credentials, rows.Err()
+}
+
+func saveWebAuthnCredential(userID int, name string, cred *webauthn.Credential) (int, error) {
+	transports := make([]string, len(cred.Transport))
+	for i, t := range cred.Transport {
+		transports[i] = string(t)
+	}
+
+	result, err := database.DB.Exec(`
+        INSERT INTO webauthn_credentials
+            (user_id, name, credential_id, public_key, attestation_type, transports, aaguid, sign_count, flags, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `,
+		userID,
+		name,
+		cred.ID,
+		cred.PublicKey,
+		cred.AttestationType,
+		strings.Join(transports, ","),
+		cred.Authenticator.AAGUID,
+		cred.Authenticator.SignCount,
+		uint8(cred.Flags.ProtocolValue()),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// storeCeremony keeps the challenge of a started ceremony in the session.
+func storeCeremony(sess *session.Session, key string, data *webauthn.SessionData) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	sess.Set(key, string(b))
+	return sess.Save()
+}
+
+// takeCeremony returns and forgets the ceremony stored under key, so every
+// challenge can only be answered once. It saves sess, which must not be used
+// afterwards.
+func takeCeremony(sess *session.Session, key string) (*webauthn.SessionData, error) {
+	raw, _ := sess.Get(key).(string)
+	if raw == "" {
+		return nil, errors.New("no ceremony in progress")
+	}
+	sess.Delete(key)
+	if err := sess.Save(); err != nil {
+		return nil, err
+	}
+
+	var data webauthn.SessionData
+	if err := json.Unmarshal([]byte(raw), &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+func (ac *AuthController) BeginPasskeyRegistration(c *fiber.Ctx) error {
+	sess, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	user, err := loadWebAuthnUser(userID)
+	if err != nil {
+		log.Printf("Error loading passkey user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, len(user.credentials))
+	for i, cred := range user.credentials {
+		exclusions[i] = cred.Descriptor()
+	}
+
+	creation, data, err := config.WebAuthn.BeginRegistration(user,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(exclusions),
+	)
+	if err != nil {
+		log.Printf("Error starting passkey registration: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start passkey registration",
+		})
+	}
+
+	if err := storeCeremony(sess, "webauthn_registration", data); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save session",
+		})
+	}
+
+	return c.JSON(creation)
+}
+
+func (ac *AuthController) FinishPasskeyRegistration(c *fiber.Ctx) error {
+	sess, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	data, err := takeCeremony(sess, "webauthn_registration")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No passkey registration in progress",
+		})
+	}
+
+	user, err := loadWebAuthnUser(userID)
+	if err != nil {
+		log.Printf("Error loading passkey user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(c.Body())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid passkey response",
+		})
+	}
+
+	cred, err := config.WebAuthn.CreateCredential(user, *data, parsed)
+	if err != nil {
+		log.Printf("Passkey registration failed: %v", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Passkey registration failed",
+		})
+	}
+
+	name := strings.TrimSpace(c.Query("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+	name = storage.Truncate(name, 100)
+
+	id, err := saveWebAuthnCredential(userID, name, cred)
+	if err != nil {
+		if _, dup := duplicateKeyField(err); dup {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Passkey is already registered",
+			})
+		}
+		log.Printf("Error saving passkey: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save passkey",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(models.Passkey{
+		ID:        id,
+		Name:      name,
+		CreatedAt: time.Now(),
+	})
+}
+
+// BeginPasskeyLogin starts a usernameless login: the authenticator picks the
+// credential and tells us whose it is.
+func (ac *AuthController) BeginPasskeyLogin(c *fiber.Ctx) error {
+	sess, err := ac.store.Get(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+
+	assertion, data, err := config.WebAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		log.Printf("Error starting passkey login: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start passkey login",
+		})
+	}
+
+	if err := storeCeremony(sess, "webauthn_login", data); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save session",
+		})
+	}
+
+	return c.JSON(assertion)
+}
+
+func (ac *AuthController) FinishPasskeyLogin(c *fiber.Ctx) error {
+	sess, err := ac.store.Get(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+
+	data, err := takeCeremony(sess, "webauthn_login")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No passkey login in progress",
+		})
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(c.Body())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid passkey response",
+		})
+	}
+
+	found, cred, err := config.WebAuthn.ValidatePasskeyLogin(
+		func(rawID, userHandle []byte) (webauthn.User, error) {
+			return loadWebAuthnUserByHandle(userHandle)
+		},
+		*data,
+		parsed,
+	)
+	if err != nil {
+		log.Printf("Passkey login failed: %v", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Passkey login failed",
+		})
+	}
+	user := found.(*webauthnUser)
+
+	// A sign count that did not go up means two copies of the private key
+	// may be in use
+	if cred.Authenticator.CloneWarning {
+		_, err := database.DB.Exec(
+			"UPDATE webauthn_credentials SET clone_warning = TRUE WHERE credential_id = ?", cred.ID,
+		)
+		if err != nil {
+			log.Printf("Error flagging cloned passkey: %v", err)
+		}
+		log.Printf("Possible cloned passkey for user %d", user.id)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "This passkey may have been cloned and has been disabled",
+		})
+	}
+
+	_, err = database.DB.Exec(
+		"UPDATE webauthn_credentials SET sign_count = ?, flags = ?, last_used_at = ? WHERE credential_id = ? AND clone_warning = FALSE",
+		cred.Authenticator.SignCount, uint8(cred.Flags.ProtocolValue()), time.Now(), cred.ID,
+	)
+	if err != nil {
+		log.Printf("Error updating passkey: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+
+	// takeCeremony saved and so released the session, start from a fresh copy
+	sess, err = ac.store.Get(c)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+	if err := rotateSession(sess); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to regenerate session",
+		})
+	}
+	if err := startSession(c, sess, user.id); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save session",
+		})
+	}
+
+	u, err := loadUser(user.id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+
+	return c.JSON(u)
+}
+
+func (ac *AuthController) ListPasskeys(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	rows, err := database.DB.Query(`
+        SELECT id, name, created_at, last_used_at, clone_warning
+        FROM webauthn_credentials
+        WHERE user_id = ?
+        ORDER BY created_at
+    `, userID)
+	if err != nil {
+		log.Printf("Error listing passkeys: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list passkeys",
+		})
+	}
+	defer rows.Close()
+
+	passkeys := make([]models.Passkey, 0)
+	for rows.Next() {
+		var p models.Passkey
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &lastUsed, &p.CloneWarning); err != nil {
+			log.Printf("Error scanning passkey: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to list passkeys",
+			})
+		}
+		if lastUsed.Valid {
+			p.LastUsedAt = &lastUsed.Time
+		}
+		passkeys = append(passkeys, p)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"count":  len(passkeys),
+		"data":   passkeys,
+	})
+}
+
+func (ac *AuthController) DeletePasskey(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid passkey ID",
+		})
+	}
+
+	result, err := database.DB.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		log.Printf("Error deleting passkey: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete passkey",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Passkey not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"id":     id,
+	})
+}
@@ -0,0 +1,432 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"go-rest-api/config"
+	"go-rest-api/internal/storage"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:5173"
+)
+
+var testUserHandle = bytes.Repeat([]byte{0x42}, 64)
+
+// softAuthenticator is a platform authenticator in software: a P-256 key,
+// a credential ID and a signature counter.
+type softAuthenticator struct {
+	key     *ecdsa.PrivateKey
+	credID  []byte
+	counter uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID := make([]byte, 32)
+	rand.Read(credID)
+	return &softAuthenticator{key: key, credID: credID}
+}
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// publicKey is the credential public key as a COSE EC2 key.
+func (a *softAuthenticator) publicKey(t *testing.T) []byte {
+	t.Helper()
+	cose, err := webauthncbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cose
+}
+
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	return append(data, attested...)
+}
+
+func clientData(t *testing.T, ceremony, challenge string) []byte {
+	t.Helper()
+	b, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// create answers a registration challenge with a "none" attestation.
+func (a *softAuthenticator) create(t *testing.T, challenge string) []byte {
+	t.Helper()
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credID)))
+	attested = append(attested, a.credID...)
+	attested = append(attested, a.publicKey(t)...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(flagUserPresent|flagUserVerified|flagAttested, attested),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mustJSON(t, map[string]interface{}{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"attestationObject": b64(attestation),
+			"clientDataJSON":    b64(clientData(t, "webauthn.create", challenge)),
+			"transports":        []string{"internal"},
+		},
+	})
+}
+
+// get answers a login challenge with the current counter.
+func (a *softAuthenticator) get(t *testing.T, challenge string) []byte {
+	t.Helper()
+	authData := a.authData(flagUserPresent|flagUserVerified, nil)
+	cdj := clientData(t, "webauthn.get", challenge)
+	cdjHash := sha256.Sum256(cdj)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdjHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mustJSON(t, map[string]interface{}{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"authenticatorData": b64(authData),
+			"clientDataJSON":    b64(cdj),
+			"signature":         b64(sig),
+			"userHandle":        b64(testUserHandle),
+		},
+	})
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// passkeyClient drives the passkey endpoints like a browser.
+type passkeyClient struct {
+	*testClient
+}
+
+func newPasskeyClient(t *testing.T) (*passkeyClient, sqlmock.Sqlmock) {
+	t.Helper()
+
+	mock := newMockDB(t)
+	prevWebAuthn := config.WebAuthn
+	t.Cleanup(func() { config.WebAuthn = prevWebAuthn })
+	var err error
+	config.WebAuthn, err = webauthn.New(&webauthn.Config{
+		RPID:          testRPID,
+		RPDisplayName: "SocMed",
+		RPOrigins:     []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := session.New()
+	ac := NewAuthController(store)
+	app := fiber.New()
+	app.Post("/test/login/:id", testLogin(store))
+	app.Post("/api/passkeys/register/begin", ac.BeginPasskeyRegistration)
+	app.Post("/api/passkeys/register/finish", ac.FinishPasskeyRegistration)
+	app.Post("/api/passkeys/login/begin", ac.BeginPasskeyLogin)
+	app.Post("/api/passkeys/login/finish", ac.FinishPasskeyLogin)
+
+	return &passkeyClient{newTestClient(t, app)}, mock
+}
+
+// challenge reads the challenge out of WebAuthn creation or request options.
+func (pc *passkeyClient) challenge(options map[string]interface{}) string {
+	pc.t.Helper()
+	pk, _ := options["publicKey"].(map[string]interface{})
+	challenge, _ := pk["challenge"].(string)
+	if challenge == "" {
+		pc.t.Fatalf("no challenge in %v", options)
+	}
+	return challenge
+}
+
+// storedPasskey is a webauthn_credentials row.
+type storedPasskey struct {
+	credID       []byte
+	publicKey    []byte
+	signCount    uint32
+	cloneWarning bool
+}
+
+func expectSessionUser(mock sqlmock.Sqlmock, userID int) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT session_epoch FROM users WHERE id = ?")).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"session_epoch"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT last_seen_at FROM user_sessions")).
+		WillReturnRows(sqlmock.NewRows([]string{"last_seen_at"}).AddRow(time.Now()))
+}
+
+func expectWebAuthnUser(mock sqlmock.Sqlmock, userID int, passkeys ...storedPasskey) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT username, email, webauthn_user_handle FROM users WHERE id = ?")).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "email", "webauthn_user_handle"}).
+			AddRow("ada", "ada@example.com", testUserHandle))
+
+	rows := sqlmock.NewRows([]string{
+		"credential_id", "public_key", "attestation_type", "transports", "aaguid", "sign_count", "flags", "clone_warning",
+	})
+	for _, p := range passkeys {
+		rows.AddRow(p.credID, p.publicKey, "none", "internal", make([]byte, 16), p.signCount,
+			flagUserPresent|flagUserVerified, p.cloneWarning)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT credential_id, public_key")).
+		WithArgs(userID).
+		WillReturnRows(rows)
+}
+
+func expectPasskeyOwner(mock sqlmock.Sqlmock, userID int, passkeys ...storedPasskey) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE webauthn_user_handle = ?")).
+		WithArgs(testUserHandle).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(userID))
+	expectWebAuthnUser(mock, userID, passkeys...)
+}
+
+// captured records the value an argument was executed with.
+type captured struct {
+	value []byte
+}
+
+func (c *captured) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	c.value = b
+	return ok
+}
+
+// indexedSessionID matches the hash of a real session ID, not of the empty
+// ID a released session reports.
+type indexedSessionID struct{}
+
+func (indexedSessionID) Match(v driver.Value) bool {
+	id, ok := v.(string)
+	return ok && id != storage.HashKey("")
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	pc, mock := newPasskeyClient(t)
+	authenticator := newSoftAuthenticator(t)
+
+	if status, _ := pc.post("/test/login/1", nil); status != fiber.StatusOK {
+		t.Fatalf("test login: %d", status)
+	}
+
+	expectSessionUser(mock, 1)
+	expectWebAuthnUser(mock, 1)
+	status, options := pc.post("/api/passkeys/register/begin", nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("begin registration: %d %v", status, options)
+	}
+
+	credID, publicKey := &captured{}, &captured{}
+	expectSessionUser(mock, 1)
+	expectWebAuthnUser(mock, 1)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO webauthn_credentials")).
+		WithArgs(1, "Laptop", credID, publicKey, "none", "internal", sqlmock.AnyArg(), 0, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(5, 1))
+	status, body := pc.post("/api/passkeys/register/finish?name=Laptop", authenticator.create(t, pc.challenge(options)))
+	if status != fiber.StatusCreated {
+		t.Fatalf("finish registration: %d %v", status, body)
+	}
+	if body["id"] != float64(5) || body["name"] != "Laptop" {
+		t.Errorf("registration response = %v", body)
+	}
+	if !bytes.Equal(credID.value, authenticator.credID) {
+		t.Errorf("stored credential ID %x, want %x", credID.value, authenticator.credID)
+	}
+	if !bytes.Equal(publicKey.value, authenticator.publicKey(t)) {
+		t.Error("stored public key is not the authenticator's")
+	}
+
+	// The challenge is single use
+	expectSessionUser(mock, 1)
+	if status, _ := pc.post("/api/passkeys/register/finish", authenticator.create(t, pc.challenge(options))); status != fiber.StatusBadRequest {
+		t.Errorf("replayed registration: %d, want 400", status)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasskeyRegistrationWrongChallenge(t *testing.T) {
+	pc, mock := newPasskeyClient(t)
+	authenticator := newSoftAuthenticator(t)
+	pc.post("/test/login/1", nil)
+
+	expectSessionUser(mock, 1)
+	expectWebAuthnUser(mock, 1)
+	pc.post("/api/passkeys/register/begin", nil)
+
+	expectSessionUser(mock, 1)
+	expectWebAuthnUser(mock, 1)
+	status, _ := pc.post("/api/passkeys/register/finish", authenticator.create(t, b64([]byte("some other challenge"))))
+	if status != fiber.StatusBadRequest {
+		t.Errorf("finish registration: %d, want 400", status)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	pc, mock := newPasskeyClient(t)
+	authenticator := newSoftAuthenticator(t)
+	stored := storedPasskey{credID: authenticator.credID, publicKey: authenticator.publicKey(t), signCount: 10}
+
+	status, options := pc.post("/api/passkeys/login/begin", nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("begin login: %d %v", status, options)
+	}
+
+	authenticator.counter = 11
+	expectPasskeyOwner(mock, 1, stored)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE webauthn_credentials SET sign_count = ?")).
+		WithArgs(11, sqlmock.AnyArg(), sqlmock.AnyArg(), authenticator.credID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM user_sessions WHERE id = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT session_epoch FROM users WHERE id = ?")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"session_epoch"}).AddRow(0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_sessions")).
+		WithArgs(indexedSessionID{}, 1, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, username, email")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"id", "username", "email", "verified", "avatar_url", "display_name", "job_title",
+			"preferred_language", "profile_overrides", "graph_synced_at", "role", "created_at",
+		}).AddRow(1, "ada", "ada@example.com", true, nil, nil, nil, nil, "", nil, "user", time.Now()))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT role, 0 FROM users")).
+		WillReturnRows(sqlmock.NewRows([]string{"role", "extra"}).AddRow("user", false))
+
+	status, body := pc.post("/api/passkeys/login/finish", authenticator.get(t, pc.challenge(options)))
+	if status != fiber.StatusOK {
+		t.Fatalf("finish login: %d %v", status, body)
+	}
+	if body["username"] != "ada" {
+		t.Errorf("login response = %v", body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasskeyLoginRefusesOtherKey(t *testing.T) {
+	pc, mock := newPasskeyClient(t)
+	authenticator := newSoftAuthenticator(t)
+	// The stored public key belongs to a different authenticator
+	stored := storedPasskey{credID: authenticator.credID, publicKey: newSoftAuthenticator(t).publicKey(t)}
+
+	_, options := pc.post("/api/passkeys/login/begin", nil)
+	authenticator.counter = 1
+	expectPasskeyOwner(mock, 1, stored)
+
+	if status, _ := pc.post("/api/passkeys/login/finish", authenticator.get(t, pc.challenge(options))); status != fiber.StatusUnauthorized {
+		t.Errorf("finish login: %d, want 401", status)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasskeySignCountRegression(t *testing.T) {
+	pc, mock := newPasskeyClient(t)
+	authenticator := newSoftAuthenticator(t)
+	stored := storedPasskey{credID: authenticator.credID, publicKey: authenticator.publicKey(t), signCount: 10}
+
+	// A counter that went backwards means a second copy of the key
+	_, options := pc.post("/api/passkeys/login/begin", nil)
+	authenticator.counter = 5
+	expectPasskeyOwner(mock, 1, stored)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE webauthn_credentials SET clone_warning = TRUE WHERE credential_id = ?")).
+		WithArgs(authenticator.credID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	status, body := pc.post("/api/passkeys/login/finish", authenticator.get(t, pc.challenge(options)))
+	if status != fiber.StatusUnauthorized {
+		t.Fatalf("finish login: %d %v, want 401", status, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once flagged the credential stays disabled, even with a counter that
+	// goes up again
+	stored.cloneWarning = true
+	_, options = pc.post("/api/passkeys/login/begin", nil)
+	authenticator.counter = 50
+	expectPasskeyOwner(mock, 1, stored)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE webauthn_credentials SET clone_warning = TRUE WHERE credential_id = ?")).
+		WithArgs(authenticator.credID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if status, _ := pc.post("/api/passkeys/login/finish", authenticator.get(t, pc.challenge(options))); status != fiber.StatusUnauthorized {
+		t.Errorf("login with a flagged passkey: %d, want 401", status)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const bcryptCost = 12
+
+// dummyPasswordHash is compared against when no account matches a login so
+// that unknown users take as long to reject as wrong passwords.
+const dummyPasswordHash = "$2a$12$76rV65mwZYgPQy/lNjDVbunUBQp..mAF6O5aKeNaO5Nlm.m7AwMDO"
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// uniqueKeyFields maps the unique indexes on users to the field they guard.
+// MySQL names an inline UNIQUE index after its column.
+var uniqueKeyFields = map[string]string{
+	"username": "username",
+	"email":    "email",
+}
+
+// duplicateKeyField reports whether err is a MySQL duplicate entry error and,
+// if it can tell, which unique column caused it.
+func duplicateKeyField(err error) (string, bool) {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1062 {
+		return "", false
+	}
+	// Duplicate entry '<value>' for key '<index>', where MySQL 8 writes the
+	// index as table.index. The value can contain anything, so only the
+	// index name is looked at.
+	i := strings.LastIndex(mysqlErr.Message, "for key '")
+	if i < 0 {
+		return "", true
+	}
+	key := strings.TrimSuffix(mysqlErr.Message[i+len("for key '"):], "'")
+	if dot := strings.LastIndex(key, "."); dot >= 0 {
+		if !strings.HasPrefix(key, "users.") {
+			return "", true
+		}
+		key = key[dot+1:]
+	}
+	return uniqueKeyFields[key], true
+}
+
+// isForeignKeyError reports whether err is a MySQL foreign key violation,
+// either a missing parent row (1452) or a referenced row (1451).
+func isForeignKeyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1451 || mysqlErr.Number == 1452)
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-rest-api/config"
+	"go-rest-api/database"
+	"go-rest-api/internal/mailer"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const passwordResetTTL = 30 * time.Minute
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ForgotPassword emails a reset link if the address belongs to an account.
+// The response is the same either way so it cannot be used to find accounts.
+func (ac *AuthController) ForgotPassword(c *fiber.Ctx) error {
+	var req forgotPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if err := validateEmail(email); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+			"field": "email",
+		})
+	}
+
+	if err := sendPasswordReset(email); err != nil {
+		log.Printf("Error sending password reset: %v", err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "If an account exists for this email, a reset link has been sent",
+	})
+}
+
+func sendPasswordReset(email string) error {
+	var userID int
+	err := database.DB.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = database.DB.Exec(
+		"INSERT INTO password_resets (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		userID, hashToken(token), now, now.Add(passwordResetTTL),
+	)
+	if err != nil {
+		return err
+	}
+
+	link := config.GetConfig().FrontendURL + "/reset-password?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your account.\n\n"+
+			"Use this link within %d minutes to choose a new password:\n\n%s\n\n"+
+			"If this wasn't you, you can ignore this email.\n",
+			int(passwordResetTTL.Minutes()), link),
+	}
+
+	// Send in the background so the response time does not reveal whether
+	// the account exists
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := config.Mailer.Send(ctx, msg); err != nil {
+			log.Printf("Error sending password reset email: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (ac *AuthController) ResetPassword(c *fiber.Ctx) error {
+	var req resetPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	if req.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Token is required",
+			"field": "token",
+		})
+	}
+	if err := validatePassword(req.Password); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+			"field": "password",
+		})
+	}
+
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to reset password",
+		})
+	}
+
+	userID, err := consumePasswordReset(req.Token, passwordHash)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or expired reset token",
+		})
+	} else if err != nil {
+		log.Printf("Error resetting password: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to reset password",
+		})
+	}
+
+	// Whoever knew the old password should not stay logged in
+	if err := revokeAllSessions(userID); err != nil {
+		log.Printf("Error revoking sessions after password reset: %v", err)
+	}
+	if err := clearLoginFailures(loginScopeUser, strconv.Itoa(userID)); err != nil {
+		log.Printf("Error clearing login failures: %v", err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Password has been reset",
+	})
+}
+
+// consumePasswordReset sets the new password for the owner of token and
+// invalidates every outstanding reset token of that user. It returns
+// sql.ErrNoRows if the token is unknown, used or expired.
+func consumePasswordReset(token, passwordHash string) (int, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	var userID int
+	err = tx.QueryRow(
+		"SELECT user_id FROM password_resets WHERE token_hash = ? AND used_at IS NULL AND expires_at > ? FOR UPDATE",
+		hashToken(token), now,
+	).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, userID); err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL", now, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
@@ -0,0 +1,38 @@
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestDuplicateKeyField(t *testing.T) {
+	tests := []struct {
+		message string
+		field   string
+	}{
+		{"Duplicate entry 'ada' for key 'users.username'", "username"},
+		{"Duplicate entry 'ada@example.com' for key 'users.email'", "email"},
+		{"Duplicate entry 'ada' for key 'username'", "username"},
+		// The value names another column, the index decides
+		{"Duplicate entry 'username@example.com' for key 'users.email'", "email"},
+		{"Duplicate entry 'email' for key 'users.username'", "username"},
+		{"Duplicate entry 'microsoft-x' for key 'user_identities.provider_subject'", ""},
+		{"Duplicate entry 'x' for key 'oauth_clients.email'", ""},
+	}
+	for _, tt := range tests {
+		err := &mysql.MySQLError{Number: 1062, Message: tt.message}
+		field, dup := duplicateKeyField(err)
+		if !dup || field != tt.field {
+			t.Errorf("duplicateKeyField(%q) = %q, %v, want %q, true", tt.message, field, dup, tt.field)
+		}
+	}
+
+	if _, dup := duplicateKeyField(errors.New("boom")); dup {
+		t.Error("plain error reported as a duplicate")
+	}
+	if _, dup := duplicateKeyField(&mysql.MySQLError{Number: 1452}); dup {
+		t.Error("foreign key error reported as a duplicate")
+	}
+}
@@ -0,0 +1,247 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"go-rest-api/config"
+	"go-rest-api/database"
+	"go-rest-api/internal/graph"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/oauth2"
+)
+
+const (
+	maxDisplayNameLength = 100
+	maxJobTitleLength    = 100
+	maxAvatarURLLength   = 512
+)
+
+var languageTagPattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// syncMicrosoftProfile syncs the Graph profile of userID right after login,
+// using the token from the login so it works without token storage.
+func syncMicrosoftProfile(userID int, token *oauth2.Token) {
+	oauthConfig := config.MicrosoftOAuthConfig()
+	if oauthConfig == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	gc := &graph.Client{HTTP: oauthConfig.Client(ctx, token), BaseURL: config.GraphBaseURL()}
+	if err := graph.SyncProfile(ctx, database.DB, gc, userID); err != nil {
+		log.Printf("Graph profile sync for user %d failed: %v", userID, err)
+	}
+}
+
+// UpdateProfile sets profile fields the user wants to control themselves.
+// A value overrides what the Microsoft sync would write, null hands the
+// field back to the sync.
+func (ac *AuthController) UpdateProfile(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	fields := map[string]struct {
+		column string
+		field  string
+	}{
+		"display_name":       {"display_name", graph.FieldDisplayName},
+		"job_title":          {"job_title", graph.FieldJobTitle},
+		"preferred_language": {"preferred_language", graph.FieldPreferredLanguage},
+		"avatar_url":         {"avatar_url", graph.FieldAvatar},
+	}
+
+	var sets []string
+	var args []any
+	override := make(map[string]bool)
+	for key, raw := range req {
+		f, ok := fields[key]
+		if !ok {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Unknown profile field: " + key,
+			})
+		}
+
+		var value *string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": key + " must be a string or null",
+			})
+		}
+		if value == nil {
+			override[f.field] = false
+			continue
+		}
+
+		v := strings.TrimSpace(*value)
+		if msg := validateProfileField(key, v); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": msg,
+				"field": key,
+			})
+		}
+		override[f.field] = true
+		sets = append(sets, f.column+" = ?")
+		if v == "" {
+			args = append(args, nil)
+		} else {
+			args = append(args, v)
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update profile",
+		})
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow("SELECT profile_overrides FROM users WHERE id = ? FOR UPDATE", userID).Scan(&current)
+	if err != nil {
+		log.Printf("Error loading profile overrides: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update profile",
+		})
+	}
+
+	overrides := make([]string, 0)
+	released := false
+	for _, f := range strings.Split(current, ",") {
+		if f == "" {
+			continue
+		}
+		if set, ok := override[f]; ok && !set {
+			released = true
+			continue
+		}
+		if !override[f] {
+			overrides = append(overrides, f)
+		}
+	}
+	for f, set := range override {
+		if set {
+			overrides = append(overrides, f)
+		}
+	}
+
+	sets = append(sets, "profile_overrides = ?")
+	args = append(args, strings.Join(overrides, ","))
+	if released {
+		// Let the next sync run pick the released fields up again
+		sets = append(sets, "graph_sync_attempted_at = NULL")
+	}
+	args = append(args, userID)
+	if _, err := tx.Exec("UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...); err != nil {
+		log.Printf("Error updating profile: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update profile",
+		})
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing profile: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update profile",
+		})
+	}
+
+	user, err := loadUser(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load user",
+		})
+	}
+	return c.JSON(user)
+}
+
+// validateProfileField returns a message describing what is wrong with a
+// profile value, or "" if it is acceptable.
+func validateProfileField(key, value string) string {
+	switch key {
+	case "display_name":
+		if len(value) > maxDisplayNameLength {
+			return "Display name is too long"
+		}
+	case "job_title":
+		if len(value) > maxJobTitleLength {
+			return "Job title is too long"
+		}
+	case "preferred_language":
+		if value != "" && !languageTagPattern.MatchString(value) {
+			return "Preferred language must be a language tag such as en-US"
+		}
+	case "avatar_url":
+		if len(value) > maxAvatarURLLength {
+			return "Avatar URL is too long"
+		}
+		if value != "" {
+			u, err := url.Parse(value)
+			if err != nil || u.Scheme != "https" || u.Host == "" {
+				return "Avatar URL must be an https URL"
+			}
+		}
+	}
+	return ""
+}
+
+// GetAvatar serves an avatar synced from Microsoft.
+func (ac *AuthController) GetAvatar(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var contentType, hash string
+	var data []byte
+	err = database.DB.QueryRow(
+		"SELECT content_type, data, sha256 FROM user_avatars WHERE user_id = ?", id,
+	).Scan(&contentType, &data, &hash)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Avatar not found",
+		})
+	} else if err != nil {
+		log.Printf("Error loading avatar: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load avatar",
+		})
+	}
+
+	// Photos stored before the type allowlist may be SVG or worse
+	if !graph.AllowedPhotoType(contentType) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Avatar not found",
+		})
+	}
+
+	etag := `"` + hash + `"`
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderCacheControl, "public, max-age=86400")
+	c.Set("X-Content-Type-Options", "nosniff")
+	if c.Get(fiber.HeaderIfNoneMatch) == etag {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	return c.Send(data)
+}
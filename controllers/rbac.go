@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"go-rest-api/database"
+	"go-rest-api/internal/auth"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Every user has a primary role in users.role, assigned by admins. Roles in
+// user_roles are added on top, e.g. from Microsoft tenant groups. A user can
+// do whatever any of their roles allows.
+
+// tokenPermissions is what a personal access token scope can be used for,
+// on top of what the user's roles allow.
+var tokenPermissions = map[string][]string{
+	ScopePostsWrite: {auth.PermPostsCreate, auth.PermPostsUpdateOwn, auth.PermPostsDeleteOwn, auth.PermLikesWrite},
+}
+
+// hasPermission reports whether any role of userID grants permission.
+func hasPermission(userID int, permission string) (bool, error) {
+	var n int
+	err := database.DB.QueryRow(`
+        SELECT COUNT(*) FROM role_permissions
+        WHERE permission = ? AND role IN (
+            SELECT role FROM users WHERE id = ?
+            UNION
+            SELECT role FROM user_roles WHERE user_id = ?
+        )
+    `, permission, userID, userID).Scan(&n)
+	return n > 0, err
+}
+
+// userPermissions returns everything the roles of userID allow, narrowed to
+// what the request's personal access token covers.
+func userPermissions(c *fiber.Ctx, userID int) (map[string]bool, error) {
+	rows, err := database.DB.Query(`
+        SELECT DISTINCT permission FROM role_permissions
+        WHERE role IN (
+            SELECT role FROM users WHERE id = ?
+            UNION
+            SELECT role FROM user_roles WHERE user_id = ?
+        )
+    `, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make(map[string]bool)
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		if tokenAllows(c, permission) {
+			permissions[permission] = true
+		}
+	}
+	return permissions, rows.Err()
+}
+
+// userRoles returns the primary role of userID and every role they have.
+func userRoles(userID int) (string, []string, error) {
+	rows, err := database.DB.Query(`
+        SELECT role, 0 FROM users WHERE id = ?
+        UNION
+        SELECT role, 1 FROM user_roles WHERE user_id = ?
+        ORDER BY 2, 1
+    `, userID, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	var primary string
+	roles := make([]string, 0)
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var role string
+		var extra bool
+		if err := rows.Scan(&role, &extra); err != nil {
+			return "", nil, err
+		}
+		if !extra {
+			primary = role
+		}
+		if !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	return primary, roles, rows.Err()
+}
+
+// tokenAllows reports whether the request, if it came with a personal access
+// token or a token issued to an app, has a scope that covers permission.
+func tokenAllows(c *fiber.Ctx, permission string) bool {
+	if method, _ := c.Locals(localAuthMethod).(string); method != "token" && method != "app" {
+		return true
+	}
+	scopes, _ := c.Locals(localScopes).(map[string]bool)
+	for scope, perms := range tokenPermissions {
+		if !scopes[scope] {
+			continue
+		}
+		for _, p := range perms {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RequirePermission lets the request through only if the user RequireAuth
+// resolved has permission. It must come after RequireAuth.
+func (ac *AuthController) RequirePermission(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := currentUserID(c)
+		if userID == 0 {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Not authenticated",
+			})
+		}
+
+		allowed, err := hasPermission(userID, permission)
+		if err != nil {
+			log.Printf("Error checking permission %s: %v", permission, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check permissions",
+			})
+		}
+		if !allowed || !tokenAllows(c, permission) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "You do not have permission to do this",
+			})
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"go-rest-api/internal/auth"
+	"net/http"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// withAuth stands in for RequireAuth, resolving every request to userID
+// authenticated by method with scopes.
+func withAuth(userID int, method string, scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if userID != 0 {
+			granted := make(map[string]bool)
+			for _, s := range scopes {
+				granted[s] = true
+			}
+			c.Locals(localUserID, userID)
+			c.Locals(localAuthMethod, method)
+			c.Locals(localScopes, granted)
+		}
+		return c.Next()
+	}
+}
+
+func expectHasPermission(mock sqlmock.Sqlmock, userID int, permission string, allowed bool) {
+	n := 0
+	if allowed {
+		n = 1
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM role_permissions")).
+		WithArgs(permission, userID, userID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(n))
+}
+
+// expectMemberModerator returns the permissions of user 1, a member whose
+// extra role from user_roles is moderator.
+func expectMemberModerator(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT DISTINCT permission FROM role_permissions")).
+		WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"permission"}).
+			AddRow(auth.PermPostsCreate).
+			AddRow(auth.PermPostsUpdateOwn).
+			AddRow(auth.PermLikesWrite).
+			AddRow(auth.PermPostsUpdateAny).
+			AddRow(auth.PermPostsDeleteAny))
+}
+
+func ptr(b bool) *bool {
+	return &b
+}
+
+func TestRequirePermission(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    fiber.Handler
+		allowed *bool
+		status  int
+	}{
+		{"not authenticated", withAuth(0, ""), nil, fiber.StatusUnauthorized},
+		{"role allows", withAuth(1, "session"), ptr(true), fiber.StatusOK},
+		{"no role allows", withAuth(1, "session"), ptr(false), fiber.StatusForbidden},
+		{"login token", withAuth(1, "jwt"), ptr(true), fiber.StatusOK},
+		{"access token with posts:write", withAuth(1, "token", ScopePostsWrite), ptr(true), fiber.StatusOK},
+		{"access token without posts:write", withAuth(1, "token", ScopePostsRead, ScopeProfileRead), ptr(true), fiber.StatusForbidden},
+		{"app token without posts:write", withAuth(1, "app", ScopePostsRead), ptr(true), fiber.StatusForbidden},
+		// A scope does not add to what the user's roles allow
+		{"access token beyond the roles", withAuth(1, "token", ScopePostsWrite), ptr(false), fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			ac := NewAuthController(session.New())
+			app := fiber.New()
+			app.Post("/posts", tt.auth, ac.RequirePermission(auth.PermPostsCreate), func(c *fiber.Ctx) error {
+				return c.JSON(fiber.Map{"ok": true})
+			})
+			if tt.allowed != nil {
+				expectHasPermission(mock, 1, auth.PermPostsCreate, *tt.allowed)
+			}
+
+			if status, body := newTestClient(t, app).post("/posts", nil); status != tt.status {
+				t.Fatalf("status %d, want %d: %v", status, tt.status, body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUserPermissions(t *testing.T) {
+	tests := []struct {
+		name string
+		auth fiber.Handler
+		want []string
+	}{
+		{"session", withAuth(1, "session"), []string{
+			auth.PermLikesWrite, auth.PermPostsCreate, auth.PermPostsDeleteAny, auth.PermPostsUpdateAny, auth.PermPostsUpdateOwn,
+		}},
+		// posts:write covers the member's permissions, not the moderator's
+		{"access token with posts:write", withAuth(1, "token", ScopePostsWrite), []string{
+			auth.PermLikesWrite, auth.PermPostsCreate, auth.PermPostsUpdateOwn,
+		}},
+		{"access token without posts:write", withAuth(1, "token", ScopePostsRead), []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			app := fiber.New()
+			app.Get("/permissions", tt.auth, func(c *fiber.Ctx) error {
+				permissions, err := userPermissions(c, 1)
+				if err != nil {
+					return err
+				}
+				list := make([]string, 0, len(permissions))
+				for p := range permissions {
+					list = append(list, p)
+				}
+				return c.JSON(fiber.Map{"permissions": list})
+			})
+			expectMemberModerator(mock)
+
+			status, body := newTestClient(t, app).do(http.MethodGet, "/permissions", nil, nil)
+			if status != fiber.StatusOK {
+				t.Fatalf("status %d: %v", status, body)
+			}
+			got := make(map[string]bool)
+			for _, p := range body["permissions"].([]interface{}) {
+				got[p.(string)] = true
+			}
+			want := make(map[string]bool)
+			for _, p := range tt.want {
+				want[p] = true
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("permissions %v, want %v", got, want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	mock := newMockDB(t)
+	// The primary role comes first, the extra roles after it. member is
+	// also granted through user_roles and is listed once.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT role, 0 FROM users WHERE id = ?")).
+		WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role", "extra"}).
+			AddRow("member", false).
+			AddRow("member", true).
+			AddRow("moderator", true))
+
+	primary, roles, err := userRoles(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if primary != "member" || !reflect.DeepEqual(roles, []string{"member", "moderator"}) {
+		t.Errorf("userRoles = %q, %v", primary, roles)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
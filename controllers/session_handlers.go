@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"go-rest-api/config"
+	"go-rest-api/internal/models"
+	"go-rest-api/internal/storage"
+	"go-rest-api/internal/useragent"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func (ac *AuthController) ListSessions(c *fiber.Ctx) error {
+	sess, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	indexed, err := config.SessionIndex.List(userID)
+	if err != nil {
+		log.Printf("Error listing sessions: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list sessions",
+		})
+	}
+
+	currentID := storage.HashKey(sess.ID())
+	sessions := make([]models.Session, 0, len(indexed))
+	for _, s := range indexed {
+		ua := useragent.Parse(s.UserAgent)
+		sessions = append(sessions, models.Session{
+			ID:         s.ID,
+			IP:         s.IP,
+			UserAgent:  s.UserAgent,
+			Browser:    ua.Browser,
+			OS:         ua.OS,
+			Device:     ua.Device,
+			Current:    s.ID == currentID,
+			CreatedAt:  s.CreatedAt,
+			LastSeenAt: s.LastSeenAt,
+			ExpiresAt:  s.ExpiresAt,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"count":  len(sessions),
+		"data":   sessions,
+	})
+}
+
+func (ac *AuthController) RevokeSession(c *fiber.Ctx) error {
+	sess, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	id := c.Params("id")
+	if id == storage.HashKey(sess.ID()) {
+		if err := endSession(sess); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to destroy session",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"status": "success",
+			"id":     id,
+		})
+	}
+
+	removed, err := config.SessionIndex.RemoveByHash(id, userID)
+	if err != nil {
+		log.Printf("Error revoking session: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke session",
+		})
+	}
+	if !removed {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Session not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"id":     id,
+	})
+}
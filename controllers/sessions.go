@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"database/sql"
+	"go-rest-api/config"
+	"go-rest-api/database"
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+// Every user has a session_epoch that is copied into the session at login.
+// Logging out everywhere bumps the epoch, which invalidates every session
+// issued before it no matter which device or storage it lives in. Logged in
+// sessions are also recorded in config.SessionIndex, and a session that is
+// missing from the index is treated as revoked.
+
+// startSession marks sess as logged in as userID and saves it.
+func startSession(c *fiber.Ctx, sess *session.Session, userID int) error {
+	var epoch int
+	err := database.DB.QueryRow("SELECT session_epoch FROM users WHERE id = ?", userID).Scan(&epoch)
+	if err != nil {
+		return err
+	}
+
+	// Save releases sess, its ID is gone afterwards
+	id := sess.ID()
+	sess.Set("user_id", userID)
+	sess.Set("session_epoch", epoch)
+	if err := sess.Save(); err != nil {
+		return err
+	}
+
+	return config.SessionIndex.Add(id, userID, c.IP(), c.Get(fiber.HeaderUserAgent), config.SessionExpiration)
+}
+
+// sessionUserID returns the logged in user for sess, or 0 if the session is
+// anonymous or has been revoked.
+func sessionUserID(c *fiber.Ctx, sess *session.Session) (int, error) {
+	userID, ok := sess.Get("user_id").(int)
+	if !ok {
+		return 0, nil
+	}
+	sessionEpoch, _ := sess.Get("session_epoch").(int)
+
+	var epoch int
+	err := database.DB.QueryRow("SELECT session_epoch FROM users WHERE id = ?", userID).Scan(&epoch)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err == sql.ErrNoRows || epoch != sessionEpoch {
+		return 0, sess.Destroy()
+	}
+
+	indexed, err := config.SessionIndex.Touch(sess.ID(), userID, c.IP())
+	if err != nil {
+		return 0, err
+	}
+	if !indexed {
+		return 0, sess.Destroy()
+	}
+
+	return userID, nil
+}
+
+// requireSessionUser loads the session and its user, which is the
+// impersonated user while an admin impersonates someone. If there is no
+// logged in user it writes the error response and returns a zero user ID.
+func (ac *AuthController) requireSessionUser(c *fiber.Ctx) (*session.Session, int, error) {
+	sess, err := ac.store.Get(c)
+	if err != nil {
+		return nil, 0, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+
+	userID, err := sessionUserID(c, sess)
+	if err != nil {
+		log.Printf("Error reading session user: %v", err)
+		return nil, 0, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+	if userID == 0 {
+		return nil, 0, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Not authenticated",
+		})
+	}
+
+	sess, userID, err = ac.resolveImpersonation(c, sess, userID)
+	if err != nil {
+		log.Printf("Error resolving impersonation: %v", err)
+		return nil, 0, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get session",
+		})
+	}
+
+	return sess, userID, nil
+}
+
+// rotateSession gives sess a new ID, dropping the old one from storage and
+// the index, so an ID planted before login cannot be reused.
+func rotateSession(sess *session.Session) error {
+	if err := config.SessionIndex.Remove(sess.ID()); err != nil {
+		return err
+	}
+	return sess.Regenerate()
+}
+
+// endSession destroys sess and removes it from the index.
+func endSession(sess *session.Session) error {
+	id := sess.ID()
+	if err := sess.Destroy(); err != nil {
+		return err
+	}
+	return config.SessionIndex.Remove(id)
+}
+
+// revokeAllSessions invalidates every session userID currently has,
+// including token clients.
+func revokeAllSessions(userID int) error {
+	_, err := database.DB.Exec("UPDATE users SET session_epoch = session_epoch + 1 WHERE id = ?", userID)
+	if err != nil {
+		return err
+	}
+	if err := revokeTokenFamilies(userID); err != nil {
+		return err
+	}
+	return config.SessionIndex.RemoveAll(userID)
+}
@@ -0,0 +1,409 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"go-rest-api/config"
+	"go-rest-api/database"
+	"go-rest-api/internal/storage"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// In token mode a login ends in a short-lived JWT access token and an opaque
+// refresh token instead of a session cookie. Every refresh token belongs to
+// a family started by one login. Refreshing uses up the token and hands out
+// the next one in the family. Presenting a used token again means it was
+// copied, so the whole family is revoked and every device holding a token
+// from it has to log in again.
+
+const (
+	refreshTokenPrefix    = "smr_"
+	refreshTokenExpiry    = 30 * 24 * time.Hour
+	refreshFamilyLifetime = 90 * 24 * time.Hour
+	// External logins hand the app a code it swaps for tokens
+	loginCodeExpiry = 2 * time.Minute
+)
+
+// dbExecer is satisfied by both *sql.DB and *sql.Tx.
+type dbExecer interface {
+	Exec(string, ...any) (sql.Result, error)
+}
+
+// insertRefreshToken adds a new token to familyID and returns it.
+func insertRefreshToken(exec dbExecer, familyID string) (string, error) {
+	secret, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	raw := refreshTokenPrefix + secret
+
+	now := time.Now()
+	_, err = exec.Exec(
+		"INSERT INTO refresh_tokens (family_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		familyID, hashToken(raw), now, now.Add(refreshTokenExpiry),
+	)
+	return raw, err
+}
+
+// respondWithTokens starts a new token family for userID and writes the
+// first token pair.
+func (ac *AuthController) respondWithTokens(c *fiber.Ctx, userID int) error {
+	familyID, err := newToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to issue tokens",
+		})
+	}
+
+	now := time.Now()
+	_, err = database.DB.Exec(`
+        INSERT INTO refresh_token_families (id, user_id, ip, user_agent, created_at, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, familyID, userID, c.IP(), storage.Truncate(c.Get(fiber.HeaderUserAgent), 255), now, now.Add(refreshFamilyLifetime))
+	if err != nil {
+		log.Printf("Error creating token family: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to issue tokens",
+		})
+	}
+
+	refresh, err := insertRefreshToken(database.DB, familyID)
+	if err != nil {
+		log.Printf("Error creating refresh token: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to issue tokens",
+		})
+	}
+
+	return writeTokenPair(c, userID, familyID, refresh)
+}
+
+func writeTokenPair(c *fiber.Ctx, userID int, familyID, refresh string) error {
+	tokenID, err := newToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to issue tokens",
+		})
+	}
+	access, expiry, err := config.JWT.Issue(userID, familyID, tokenID)
+	if err != nil {
+		log.Printf("Error signing access token: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to issue tokens",
+		})
+	}
+
+	user, err := loadUser(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(fiber.Map{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int(time.Until(expiry).Seconds()),
+		"refresh_token": refresh,
+		"user":          user,
+	})
+}
+
+// accessTokenUser returns the user of a valid JWT access token whose family
+// has not been revoked, or 0.
+func accessTokenUser(raw string) (int, error) {
+	claims, err := config.JWT.Verify(raw)
+	if err != nil {
+		return 0, nil
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return 0, nil
+	}
+
+	var active bool
+	err = database.DB.QueryRow(`
+        SELECT revoked_at IS NULL AND expires_at > ? FROM refresh_token_families
+        WHERE id = ? AND user_id = ?
+    `, time.Now(), claims.SessionID, userID).Scan(&active)
+	if err == sql.ErrNoRows || (err == nil && !active) {
+		return 0, nil
+	}
+	return userID, err
+}
+
+// revokeTokenFamilies logs userID out of every token client.
+func revokeTokenFamilies(userID int) error {
+	_, err := database.DB.Exec(
+		"UPDATE refresh_token_families SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL",
+		time.Now(), userID,
+	)
+	return err
+}
+
+// issueLoginCode stores a one-time code for an external login in token mode.
+// The app proves it started the login with the PKCE verifier for challenge.
+func issueLoginCode(userID int, challenge string) (string, error) {
+	code, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = database.DB.Exec(
+		"INSERT INTO login_codes (code_hash, user_id, code_challenge, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		hashToken(code), userID, challenge, now, now.Add(loginCodeExpiry),
+	)
+	return code, err
+}
+
+// redirectWithLoginCode sends the browser back to the app with a login code.
+func redirectWithLoginCode(c *fiber.Ctx, userID int, flow oauthFlow) error {
+	code, err := issueLoginCode(userID, flow.AppChallenge)
+	if err != nil {
+		log.Printf("Error issuing login code: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+
+	target, err := url.Parse(config.MobileRedirectURL())
+	if err != nil {
+		log.Printf("Invalid MOBILE_REDIRECT_URL: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+	q := target.Query()
+	q.Set("code", code)
+	if flow.AppState != "" {
+		q.Set("state", flow.AppState)
+	}
+	target.RawQuery = q.Encode()
+	return c.Redirect(target.String())
+}
+
+// tokenModeParams reads the token mode parameters of an external login. If
+// they are invalid it writes the error response and returns false.
+func tokenModeParams(c *fiber.Ctx, flow *oauthFlow) (bool, error) {
+	if c.Query("mode") != "token" {
+		return true, nil
+	}
+	if config.MobileRedirectURL() == "" {
+		return false, c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Token login is not configured",
+		})
+	}
+
+	challenge := c.Query("code_challenge")
+	if c.Query("code_challenge_method") != "S256" || len(challenge) < 43 || len(challenge) > 128 {
+		return false, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Token mode needs an S256 code_challenge",
+		})
+	}
+	flow.TokenMode = true
+	flow.AppChallenge = challenge
+	flow.AppState = c.Query("state")
+	return true, nil
+}
+
+type tokenRequest struct {
+	GrantType    string `json:"grant_type" form:"grant_type"`
+	RefreshToken string `json:"refresh_token" form:"refresh_token"`
+	Code         string `json:"code" form:"code"`
+	CodeVerifier string `json:"code_verifier" form:"code_verifier"`
+}
+
+// Token swaps a refresh token or a login code for a new token pair.
+func (ac *AuthController) Token(c *fiber.Ctx) error {
+	var req tokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	switch req.GrantType {
+	case "refresh_token":
+		return ac.refreshTokenGrant(c, req.RefreshToken)
+	case "authorization_code":
+		return ac.loginCodeGrant(c, req.Code, req.CodeVerifier)
+	}
+	return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+		"error": "Unsupported grant_type",
+	})
+}
+
+func (ac *AuthController) refreshTokenGrant(c *fiber.Ctx, raw string) error {
+	invalid := func() error {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid refresh token",
+		})
+	}
+	failed := func(err error) error {
+		log.Printf("Error refreshing token: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to refresh token",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return failed(err)
+	}
+	defer tx.Rollback()
+
+	var tokenID, userID int
+	var familyID string
+	var used, familyRevoked sql.NullTime
+	var expiresAt, familyExpiresAt time.Time
+	err = tx.QueryRow(`
+        SELECT t.id, t.family_id, t.used_at, t.expires_at, f.user_id, f.revoked_at, f.expires_at
+        FROM refresh_tokens t JOIN refresh_token_families f ON f.id = t.family_id
+        WHERE t.token_hash = ?
+        FOR UPDATE
+    `, hashToken(raw)).Scan(&tokenID, &familyID, &used, &expiresAt, &userID, &familyRevoked, &familyExpiresAt)
+	if err == sql.ErrNoRows {
+		return invalid()
+	} else if err != nil {
+		return failed(err)
+	}
+
+	if used.Valid {
+		log.Printf("Refresh token reused for user %d, revoking token family", userID)
+		_, err := tx.Exec(
+			"UPDATE refresh_token_families SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL",
+			time.Now(), familyID,
+		)
+		if err != nil {
+			return failed(err)
+		}
+		if err := tx.Commit(); err != nil {
+			return failed(err)
+		}
+		return invalid()
+	}
+
+	now := time.Now()
+	if familyRevoked.Valid || !familyExpiresAt.After(now) || !expiresAt.After(now) {
+		return invalid()
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = ? WHERE id = ?", now, tokenID); err != nil {
+		return failed(err)
+	}
+	next, err := insertRefreshToken(tx, familyID)
+	if err != nil {
+		return failed(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return failed(err)
+	}
+
+	return writeTokenPair(c, userID, familyID, next)
+}
+
+func (ac *AuthController) loginCodeGrant(c *fiber.Ctx, code, verifier string) error {
+	invalid := func() error {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or expired login code",
+		})
+	}
+
+	var userID int
+	var challenge string
+	var expiresAt time.Time
+	err := database.DB.QueryRow(
+		"SELECT user_id, code_challenge, expires_at FROM login_codes WHERE code_hash = ?",
+		hashToken(code),
+	).Scan(&userID, &challenge, &expiresAt)
+	if err == sql.ErrNoRows {
+		return invalid()
+	} else if err != nil {
+		log.Printf("Error loading login code: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+
+	// Deleting first makes the code single use even under concurrent requests
+	result, err := database.DB.Exec("DELETE FROM login_codes WHERE code_hash = ?", hashToken(code))
+	if err != nil {
+		log.Printf("Error using login code: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+	if n, _ := result.RowsAffected(); n == 0 || !expiresAt.After(time.Now()) {
+		return invalid()
+	}
+
+	if !verifyPKCE(verifier, challenge) {
+		return invalid()
+	}
+
+	// Same as a password login in token mode: the app posts the second
+	// factor to /api/login/2fa with the mfa_token and gets its tokens there
+	mfaRequired, err := totpEnabled(userID)
+	if err != nil {
+		log.Printf("Error checking two-factor status: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+	if mfaRequired {
+		return respondWithMFAToken(c, userID)
+	}
+
+	return ac.respondWithTokens(c, userID)
+}
+
+// verifyPKCE reports whether verifier matches an S256 code challenge.
+func verifyPKCE(verifier, challenge string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return verifier != "" && subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+type revokeTokenRequest struct {
+	RefreshToken string `json:"refresh_token" form:"refresh_token"`
+}
+
+// RevokeToken logs a token client out by revoking the family of its refresh
+// token. Unknown tokens are not reported.
+func (ac *AuthController) RevokeToken(c *fiber.Ctx) error {
+	var req revokeTokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	_, err := database.DB.Exec(`
+        UPDATE refresh_token_families f JOIN refresh_tokens t ON t.family_id = f.id
+        SET f.revoked_at = ?
+        WHERE t.token_hash = ? AND f.revoked_at IS NULL
+    `, time.Now(), hashToken(req.RefreshToken))
+	if err != nil {
+		log.Printf("Error revoking token family: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke token",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Token revoked",
+	})
+}
+
+// JWKS publishes the keys access tokens are signed with.
+func (ac *AuthController) JWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=3600")
+	return c.JSON(config.JWT.Keys.JWKS())
+}
@@ -0,0 +1,550 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"go-rest-api/config"
+	"go-rest-api/database"
+	"go-rest-api/internal/totp"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+const (
+	totpIssuer = "SocMed"
+	// accept codes from one step either side to allow for clock drift
+	totpSkew           = 1
+	recoveryCodeCount  = 10
+	mfaChallengeExpiry = 5 * time.Minute
+)
+
+// When a user with two-factor authentication logs in with their password the
+// session only gets mfa_user_id. user_id is written once the second factor has
+// been checked by LoginTwoFactor. Logins in token mode never get a session:
+// they are answered with an mfa_token instead, which the app sends back to
+// LoginTwoFactor as a bearer token along with the second factor.
+
+func totpEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := database.DB.QueryRow("SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = ?", userID).Scan(&enabled)
+	return enabled, err
+}
+
+// startMFAChallenge records in the session that userID passed the first
+// factor.
+func startMFAChallenge(sess *session.Session, userID int) error {
+	sess.Set("mfa_user_id", userID)
+	sess.Set("mfa_started_at", time.Now().Unix())
+	return sess.Save()
+}
+
+// respondWithMFAToken answers a token mode login that still needs the second
+// factor. Only the hash of the token is stored, and it expires with the
+// challenge.
+func respondWithMFAToken(c *fiber.Ctx, userID int) error {
+	token, err := newToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+
+	now := time.Now()
+	_, err = database.DB.Exec(
+		"INSERT INTO mfa_tokens (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), userID, now, now.Add(mfaChallengeExpiry),
+	)
+	if err != nil {
+		log.Printf("Error creating MFA token: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(fiber.Map{
+		"mfa_required": true,
+		"mfa_token":    token,
+		"expires_in":   int(mfaChallengeExpiry.Seconds()),
+	})
+}
+
+// mfaTokenUser returns the user whose login waits for the second factor
+// under token, or 0 if the token is unknown or expired.
+func mfaTokenUser(token string) (int, error) {
+	var userID int
+	err := database.DB.QueryRow(
+		"SELECT user_id FROM mfa_tokens WHERE token_hash = ? AND expires_at > ?", hashToken(token), time.Now(),
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return userID, err
+}
+
+// useMFAToken deletes token and reports whether it was still there, so a
+// token completes at most one login even under concurrent requests.
+func useMFAToken(token string) (bool, error) {
+	result, err := database.DB.Exec("DELETE FROM mfa_tokens WHERE token_hash = ?", hashToken(token))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// generateRecoveryCodes returns codes formatted as xxxxx-xxxxx.
+func generateRecoveryCodes() ([]string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		for j := range b {
+			b[j] = alphabet[int(b[j])%len(alphabet)]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// verifyTOTP checks code for userID and remembers the step it was valid for
+// so the same code cannot be used twice.
+func verifyTOTP(userID int, code string) (bool, error) {
+	var sealed []byte
+	var keyID, lastStep sql.NullInt64
+	err := database.DB.QueryRow(
+		"SELECT totp_secret, totp_key_id, totp_last_step FROM users WHERE id = ? AND totp_enabled_at IS NOT NULL", userID,
+	).Scan(&sealed, &keyID, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	secret, err := openTOTPSecret(userID, keyID, sealed)
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now(), totpSkew)
+	if !ok || (lastStep.Valid && step <= lastStep.Int64) {
+		return false, nil
+	}
+
+	// Only one request can move the step forward
+	result, err := database.DB.Exec(
+		"UPDATE users SET totp_last_step = ? WHERE id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)",
+		step, userID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// openTOTPSecret decrypts the stored secret of userID. Secrets from before
+// encryption are plain text and readable without keys.
+func openTOTPSecret(userID int, keyID sql.NullInt64, sealed []byte) (string, error) {
+	if !keyID.Valid {
+		return string(sealed), nil
+	}
+	if config.TOTPSecrets == nil {
+		return "", errors.New("TOTP secret is encrypted but OAUTH_TOKEN_KEYS is not set")
+	}
+	return config.TOTPSecrets.Open(userID, keyID, sealed)
+}
+
+// useRecoveryCode marks one of the user's unused recovery codes as used.
+func useRecoveryCode(userID int, code string) (bool, error) {
+	result, err := database.DB.Exec(
+		"UPDATE totp_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now(), userID, hashToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (ac *AuthController) EnrollTwoFactor(c *fiber.Ctx) error {
+	sess, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	// Secrets are only ever stored encrypted
+	if config.TOTPSecrets == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Two-factor authentication is not available",
+		})
+	}
+
+	var username string
+	var enabled bool
+	err = database.DB.QueryRow(
+		"SELECT username, totp_enabled_at IS NOT NULL FROM users WHERE id = ?", userID,
+	).Scan(&username, &enabled)
+	if err != nil {
+		log.Printf("Error loading user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+	if enabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate secret",
+		})
+	}
+
+	// The secret only reaches the database once the user proves their app
+	// has it
+	sess.Set("totp_pending_secret", secret)
+	if err := sess.Save(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save session",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(totpIssuer, username, secret),
+	})
+}
+
+type twoFactorCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func (ac *AuthController) ConfirmTwoFactor(c *fiber.Ctx) error {
+	sess, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	var req twoFactorCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	secret, _ := sess.Get("totp_pending_secret").(string)
+	if secret == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No two-factor enrollment in progress",
+		})
+	}
+
+	step, valid := totp.Validate(secret, req.Code, time.Now(), totpSkew)
+	if !valid {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid code",
+			"field": "code",
+		})
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+
+	if err := enableTwoFactor(userID, secret, step, codes); err != nil {
+		log.Printf("Error enabling two-factor authentication: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to enable two-factor authentication",
+		})
+	}
+
+	sess.Delete("totp_pending_secret")
+	if err := sess.Save(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save session",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+func enableTwoFactor(userID int, secret string, step int64, codes []string) error {
+	if config.TOTPSecrets == nil {
+		return errors.New("OAUTH_TOKEN_KEYS is not set")
+	}
+	keyID, sealed, err := config.TOTPSecrets.Seal(userID, secret)
+	if err != nil {
+		return err
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE users SET totp_secret = ?, totp_key_id = ?, totp_enabled_at = ?, totp_last_step = ? WHERE id = ?",
+		sealed, keyID, time.Now(), step, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		_, err := tx.Exec(
+			"INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES (?, ?)",
+			userID, hashToken(normalizeRecoveryCode(code)),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// disableTwoFactorRequest proves the user is at the keyboard with one of
+// their password, a current code or a recovery code. Users who log in with
+// Microsoft, magic links or passkeys have no password.
+type disableTwoFactorRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func (ac *AuthController) DisableTwoFactor(c *fiber.Ctx) error {
+	_, userID, err := ac.requireSessionUser(c)
+	if userID == 0 {
+		return err
+	}
+
+	var req disableTwoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	// Wrong answers count towards the account's login lockout, a stolen
+	// session must not be able to guess codes
+	userKey := strconv.Itoa(userID)
+	if locked, err := ac.checkLoginLock(c, loginScopeUser, userKey); locked || err != nil {
+		return err
+	}
+
+	var valid bool
+	var field, msg string
+	switch {
+	case req.Code != "":
+		field, msg = "code", "Invalid code"
+		valid, err = verifyTOTP(userID, req.Code)
+	case req.RecoveryCode != "":
+		field, msg = "recovery_code", "Invalid recovery code"
+		valid, err = useRecoveryCode(userID, req.RecoveryCode)
+	default:
+		field, msg = "password", "Invalid password"
+		valid, err = checkUserPassword(userID, req.Password)
+	}
+	if err != nil {
+		log.Printf("Error checking two-factor disable request: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to disable two-factor authentication",
+		})
+	}
+	if !valid {
+		if err := recordLoginFailure(loginScopeUser, userKey, userFreeAttempts); err != nil {
+			log.Printf("Error recording login failure: %v", err)
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": msg,
+			"field": field,
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to disable two-factor authentication",
+		})
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE users SET totp_secret = NULL, totp_key_id = NULL, totp_enabled_at = NULL, totp_last_step = NULL WHERE id = ?",
+		userID,
+	)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = ?", userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error disabling two-factor authentication: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to disable two-factor authentication",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// checkUserPassword reports whether password is userID's. Accounts without
+// a password never match.
+func checkUserPassword(userID int, password string) (bool, error) {
+	var passwordHash sql.NullString
+	err := database.DB.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&passwordHash)
+	if err != nil {
+		return false, err
+	}
+	return passwordHash.Valid && password != "" && checkPassword(passwordHash.String, password), nil
+}
+
+// LoginTwoFactor completes a password login for users with two-factor
+// authentication, using either an authenticator code or a recovery code.
+// Token mode logins send their mfa_token in the Authorization header.
+func (ac *AuthController) LoginTwoFactor(c *fiber.Ctx) error {
+	var req twoFactorCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
+	}
+
+	var mfaToken string
+	if header := c.Get(fiber.HeaderAuthorization); header != "" {
+		scheme, raw, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(raw) == "" {
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_request"`)
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid Authorization header",
+			})
+		}
+		mfaToken = strings.TrimSpace(raw)
+	}
+
+	var sess *session.Session
+	var userID int
+	var err error
+	if mfaToken != "" {
+		userID, err = mfaTokenUser(mfaToken)
+		if err != nil {
+			log.Printf("Error looking up MFA token: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to log in",
+			})
+		}
+	} else {
+		sess, err = ac.store.Get(c)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to get session",
+			})
+		}
+		userID, _ = sess.Get("mfa_user_id").(int)
+		startedAt, _ := sess.Get("mfa_started_at").(int64)
+		if time.Since(time.Unix(startedAt, 0)) > mfaChallengeExpiry {
+			userID = 0
+		}
+	}
+	if userID == 0 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "No pending login, please log in again",
+		})
+	}
+
+	userKey := strconv.Itoa(userID)
+	if locked, err := ac.checkLoginLock(c, loginScopeUser, userKey); locked || err != nil {
+		return err
+	}
+
+	var valid bool
+	if req.RecoveryCode != "" {
+		valid, err = useRecoveryCode(userID, req.RecoveryCode)
+	} else {
+		valid, err = verifyTOTP(userID, req.Code)
+	}
+	if err != nil {
+		log.Printf("Error checking second factor: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to log in",
+		})
+	}
+	if !valid {
+		return ac.loginFailed(c, true, userKey, c.IP())
+	}
+
+	if err := clearLoginFailures(loginScopeUser, userKey); err != nil {
+		log.Printf("Error clearing login failures: %v", err)
+	}
+
+	if mfaToken != "" {
+		used, err := useMFAToken(mfaToken)
+		if err != nil {
+			log.Printf("Error using MFA token: %v", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to log in",
+			})
+		}
+		if !used {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "No pending login, please log in again",
+			})
+		}
+		return ac.respondWithTokens(c, userID)
+	}
+
+	sess.Delete("mfa_user_id")
+	sess.Delete("mfa_started_at")
+	if err := rotateSession(sess); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to regenerate session",
+		})
+	}
+	if err := startSession(c, sess, userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save session",
+		})
+	}
+
+	user, err := loadUser(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get user",
+		})
+	}
+
+	return c.JSON(user)
+}
@@ -0,0 +1,312 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"go-rest-api/config"
+	"go-rest-api/internal/storage"
+	"go-rest-api/internal/totp"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+)
+
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// useTestTOTPKeys sets config.TOTPSecrets to a keyring with one random key
+// for the length of the test.
+func useTestTOTPKeys(t *testing.T) *storage.TOTPSecrets {
+	t.Helper()
+	key := make([]byte, 32)
+	rand.Read(key)
+	keys, err := storage.ParseKeyring("1:" + base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := config.TOTPSecrets
+	t.Cleanup(func() { config.TOTPSecrets = prev })
+	config.TOTPSecrets = storage.NewTOTPSecrets(nil, keys)
+	return config.TOTPSecrets
+}
+
+func newTwoFactorClient(t *testing.T) (*testClient, sqlmock.Sqlmock) {
+	t.Helper()
+	mock := newMockDB(t)
+	store := session.New()
+	ac := NewAuthController(store)
+	app := fiber.New()
+	app.Post("/test/login/:id", testLogin(store))
+	app.Post("/api/2fa/enroll", ac.EnrollTwoFactor)
+	app.Post("/api/2fa/confirm", ac.ConfirmTwoFactor)
+	app.Post("/api/2fa/disable", ac.DisableTwoFactor)
+
+	client := newTestClient(t, app)
+	if status, _ := client.post("/test/login/1", nil); status != fiber.StatusOK {
+		t.Fatalf("test login: %d", status)
+	}
+	return client, mock
+}
+
+func expectNoLoginLock(mock sqlmock.Sqlmock, scope, identifier string) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT locked_until FROM login_attempts")).
+		WithArgs(scope, identifier).
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}))
+}
+
+// expectTOTPSecret returns the stored secret of userID, sealed with secrets.
+func expectTOTPSecret(t *testing.T, mock sqlmock.Sqlmock, secrets *storage.TOTPSecrets, userID int) {
+	t.Helper()
+	keyID, sealed, err := secrets.Seal(userID, testTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT totp_secret, totp_key_id, totp_last_step FROM users")).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"totp_secret", "totp_key_id", "totp_last_step"}).
+			AddRow(sealed, keyID, nil))
+}
+
+func expectDisable(mock sqlmock.Sqlmock, userID int) {
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET totp_secret = NULL, totp_key_id = NULL")).
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM totp_recovery_codes WHERE user_id = ?")).
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectCommit()
+}
+
+func expectLoginFailure(mock sqlmock.Sqlmock, scope, identifier string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT failures, last_failure_at FROM login_attempts")).
+		WithArgs(scope, identifier).
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "last_failure_at"}))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO login_attempts")).
+		WithArgs(scope, identifier, 1, nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestEnrollTwoFactorStoresSecretEncrypted(t *testing.T) {
+	secrets := useTestTOTPKeys(t)
+	client, mock := newTwoFactorClient(t)
+
+	expectSessionUser(mock, 1)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT username, totp_enabled_at IS NOT NULL FROM users")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "enabled"}).AddRow("ada", false))
+	status, body := client.post("/api/2fa/enroll", nil)
+	secret, _ := body["secret"].(string)
+	if status != fiber.StatusOK || secret == "" {
+		t.Fatalf("enroll: %d %v", status, body)
+	}
+
+	sealed := &captured{}
+	expectSessionUser(mock, 1)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET totp_secret = ?, totp_key_id = ?")).
+		WithArgs(sealed, 1, sqlmock.AnyArg(), sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM totp_recovery_codes")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < recoveryCodeCount; i++ {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO totp_recovery_codes")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+	status, body = client.post("/api/2fa/confirm", mustJSON(t, map[string]string{"code": code}))
+	if status != fiber.StatusOK {
+		t.Fatalf("confirm: %d %v", status, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(sealed.value) == secret {
+		t.Fatal("secret stored in plain text")
+	}
+	opened, err := secrets.Open(1, sql.NullInt64{Int64: 1, Valid: true}, sealed.value)
+	if err != nil || opened != secret {
+		t.Errorf("stored secret opens to %q, %v", opened, err)
+	}
+}
+
+func TestEnrollTwoFactorWithoutKeys(t *testing.T) {
+	prev := config.TOTPSecrets
+	t.Cleanup(func() { config.TOTPSecrets = prev })
+	config.TOTPSecrets = nil
+	client, mock := newTwoFactorClient(t)
+
+	expectSessionUser(mock, 1)
+	if status, body := client.post("/api/2fa/enroll", nil); status != fiber.StatusServiceUnavailable {
+		t.Fatalf("enroll: %d %v", status, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDisableTwoFactorWithCode(t *testing.T) {
+	secrets := useTestTOTPKeys(t)
+	client, mock := newTwoFactorClient(t)
+
+	expectSessionUser(mock, 1)
+	expectNoLoginLock(mock, loginScopeUser, "1")
+	expectTOTPSecret(t, mock, secrets, 1)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET totp_last_step = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectDisable(mock, 1)
+
+	code, _ := totp.Code(testTOTPSecret, totp.Step(time.Now()))
+	status, body := client.post("/api/2fa/disable", mustJSON(t, map[string]string{"code": code}))
+	if status != fiber.StatusOK {
+		t.Fatalf("disable: %d %v", status, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDisableTwoFactorWithRecoveryCode(t *testing.T) {
+	client, mock := newTwoFactorClient(t)
+
+	expectSessionUser(mock, 1)
+	expectNoLoginLock(mock, loginScopeUser, "1")
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE totp_recovery_codes SET used_at = ?")).
+		WithArgs(sqlmock.AnyArg(), 1, hashToken("abcdefghjk")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectDisable(mock, 1)
+
+	status, body := client.post("/api/2fa/disable", mustJSON(t, map[string]string{"recovery_code": "ABCDE-FGHJK"}))
+	if status != fiber.StatusOK {
+		t.Fatalf("disable: %d %v", status, body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDisableTwoFactorRefusals(t *testing.T) {
+	secrets := useTestTOTPKeys(t)
+
+	tests := []struct {
+		name   string
+		body   map[string]string
+		expect func(sqlmock.Sqlmock)
+		field  string
+	}{
+		{"wrong code", map[string]string{"code": "000000"}, func(mock sqlmock.Sqlmock) {
+			expectTOTPSecret(t, mock, secrets, 1)
+		}, "code"},
+		{"used recovery code", map[string]string{"recovery_code": "abcde-fghjk"}, func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE totp_recovery_codes SET used_at = ?")).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+		}, "recovery_code"},
+		// Accounts without a password cannot use one
+		{"no password", map[string]string{"password": "anything"}, func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT password_hash FROM users WHERE id = ?")).
+				WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"password_hash"}).AddRow(nil))
+		}, "password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newTwoFactorClient(t)
+			expectSessionUser(mock, 1)
+			expectNoLoginLock(mock, loginScopeUser, "1")
+			tt.expect(mock)
+			expectLoginFailure(mock, loginScopeUser, "1")
+
+			status, body := client.post("/api/2fa/disable", mustJSON(t, tt.body))
+			if status != fiber.StatusUnauthorized || body["field"] != tt.field {
+				t.Fatalf("disable: %d %v", status, body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLoginTwoFactorTokenMode(t *testing.T) {
+	secrets := useTestTOTPKeys(t)
+	prevJWT := config.JWT
+	t.Cleanup(func() { config.JWT = prevJWT })
+	config.SetupJWT()
+
+	mock := newMockDB(t)
+	ac := NewAuthController(session.New())
+	app := fiber.New()
+	app.Post("/api/login", ac.Login)
+	app.Post("/api/login/2fa", ac.LoginTwoFactor)
+	client := newTestClient(t, app)
+
+	expectLoginUser(t, mock, 1, "correct horse")
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE login_attempts SET failures = GREATEST(failures - ?, 0)")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT totp_enabled_at IS NOT NULL FROM users WHERE id = ?")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(true))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO mfa_tokens")).
+		WithArgs(sqlmock.AnyArg(), 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	status, body := client.post("/api/login", mustJSON(t, map[string]string{
+		"email": "ada@example.com", "password": "correct horse", "mode": "token",
+	}))
+	token, _ := body["mfa_token"].(string)
+	if status != fiber.StatusOK || body["mfa_required"] != true || token == "" {
+		t.Fatalf("login: %d %v", status, body)
+	}
+
+	bearer := http.Header{fiber.HeaderAuthorization: {"Bearer " + token}}
+	code, _ := totp.Code(testTOTPSecret, totp.Step(time.Now()))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM mfa_tokens")).
+		WithArgs(hashToken(token), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+	expectNoLoginLock(mock, loginScopeUser, "1")
+	expectTOTPSecret(t, mock, secrets, 1)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET totp_last_step = ?")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM login_attempts")).
+		WithArgs(loginScopeUser, "1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM mfa_tokens WHERE token_hash = ?")).
+		WithArgs(hashToken(token)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO refresh_token_families")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO refresh_tokens")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectUser(mock, 1, "member")
+
+	status, body = client.do(http.MethodPost, "/api/login/2fa", mustJSON(t, map[string]string{"code": code}), bearer)
+	if status != fiber.StatusOK || body["access_token"] == nil || body["refresh_token"] == nil {
+		t.Fatalf("2fa: %d %v", status, body)
+	}
+
+	// The token is used up
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id FROM mfa_tokens")).
+		WithArgs(hashToken(token), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	status, body = client.do(http.MethodPost, "/api/login/2fa", mustJSON(t, map[string]string{"code": code}), bearer)
+	if status != fiber.StatusUnauthorized {
+		t.Fatalf("reused token: %d %v", status, body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.cookies) > 0 {
+		t.Errorf("token mode login set cookies: %v", client.cookies)
+	}
+}
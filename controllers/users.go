@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"database/sql"
+	"go-rest-api/database"
+	"go-rest-api/internal/models"
+	"strings"
+)
+
+// loadUser returns the public view of a user.
+func loadUser(userID int) (models.User, error) {
+	var user models.User
+	var avatarURL, displayName, jobTitle, language sql.NullString
+	var overrides string
+	var syncedAt sql.NullTime
+	err := database.DB.QueryRow(`
+        SELECT id, username, email, email_verified_at IS NOT NULL, avatar_url,
+            display_name, job_title, preferred_language, profile_overrides, graph_synced_at, role, created_at
+        FROM users WHERE id = ?
+    `, userID).Scan(
+		&user.ID, &user.Username, &user.Email, &user.EmailVerified, &avatarURL,
+		&displayName, &jobTitle, &language, &overrides, &syncedAt, &user.Role, &user.CreatedAt,
+	)
+	if err != nil {
+		return user, err
+	}
+
+	user.AvatarURL = avatarURL.String
+	user.DisplayName = displayName.String
+	user.JobTitle = jobTitle.String
+	user.PreferredLanguage = language.String
+	user.ProfileOverrides = make([]string, 0)
+	if overrides != "" {
+		user.ProfileOverrides = strings.Split(overrides, ",")
+	}
+	if syncedAt.Valid {
+		user.ProfileSyncedAt = &syncedAt.Time
+	}
+
+	_, user.Roles, err = userRoles(userID)
+	return user, err
+}
@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 50
+	maxEmailLength    = 100
+	minPasswordLength = 8
+	// bcrypt only looks at the first 72 bytes of the input
+	maxPasswordLength = 72
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+func validateUsername(username string) error {
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return errors.New("Username must be between 3 and 50 characters")
+	}
+	if !usernamePattern.MatchString(username) {
+		return errors.New("Username may only contain letters, numbers, '.', '_' and '-'")
+	}
+	return nil
+}
+
+func validateEmail(email string) error {
+	if email == "" || len(email) > maxEmailLength {
+		return errors.New("Email must be between 1 and 100 characters")
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@")+1:], ".") {
+		return errors.New("Invalid email address")
+	}
+	return nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return errors.New("Password must be at least 8 characters")
+	}
+	if len(password) > maxPasswordLength {
+		return errors.New("Password must be at most 72 bytes")
+	}
+
+	var hasLower, hasUpper, hasDigit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLower || !hasUpper || !hasDigit {
+		return errors.New("Password must contain an uppercase letter, a lowercase letter and a digit")
+	}
+	return nil
+}
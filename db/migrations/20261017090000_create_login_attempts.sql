@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS login_attempts (
+    scope ENUM('user', 'ip') NOT NULL,
+    identifier VARCHAR(100) NOT NULL,
+    failures INT NOT NULL DEFAULT 0,
+    locked_until DATETIME,
+    last_failure_at DATETIME NOT NULL,
+    PRIMARY KEY (scope, identifier)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS login_attempts;
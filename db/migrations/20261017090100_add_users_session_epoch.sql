@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN session_epoch INT NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN session_epoch;
@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS sessions (
+    id CHAR(64) PRIMARY KEY,
+    data BLOB NOT NULL,
+    expires_at DATETIME,
+    INDEX idx_sessions_expires_at (expires_at)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS sessions;
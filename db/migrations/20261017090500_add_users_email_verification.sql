@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE users
+    ADD COLUMN email_verified_at DATETIME,
+    ADD COLUMN verification_sent_at DATETIME;
+
+-- +goose Down
+ALTER TABLE users
+    DROP COLUMN email_verified_at,
+    DROP COLUMN verification_sent_at;
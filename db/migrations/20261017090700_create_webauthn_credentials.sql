@@ -0,0 +1,24 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN webauthn_user_handle VARBINARY(64) UNIQUE;
+
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    credential_id VARBINARY(255) NOT NULL UNIQUE,
+    public_key BLOB NOT NULL,
+    attestation_type VARCHAR(32) NOT NULL,
+    transports VARCHAR(255) NOT NULL DEFAULT '',
+    aaguid VARBINARY(16),
+    sign_count INT UNSIGNED NOT NULL DEFAULT 0,
+    flags TINYINT UNSIGNED NOT NULL DEFAULT 0,
+    clone_warning BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME NOT NULL,
+    last_used_at DATETIME,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS webauthn_credentials;
+
+ALTER TABLE users DROP COLUMN webauthn_user_handle;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE users ADD COLUMN avatar_url VARCHAR(512);
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN avatar_url;
@@ -0,0 +1,31 @@
+-- +goose Up
+ALTER TABLE users MODIFY password_hash VARCHAR(255) NULL;
+UPDATE users SET password_hash = NULL WHERE password_hash = '';
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255),
+    email VARCHAR(100),
+    created_at DATETIME NOT NULL,
+    last_login_at DATETIME,
+    UNIQUE KEY provider_subject (provider, subject),
+    INDEX idx_user_identities_user_id (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Accounts without a password were created by the Microsoft login, which
+-- stored the Graph id as the email when there was no address. Everything
+-- else gets a pending identity whose subject is filled in with the Graph id
+-- on the next Microsoft login.
+INSERT INTO user_identities (user_id, provider, subject, email, created_at)
+SELECT id, 'microsoft', IF(email LIKE '%@%', NULL, email), IF(email LIKE '%@%', email, NULL), created_at
+FROM users
+WHERE password_hash IS NULL;
+
+-- +goose Down
+DROP TABLE IF EXISTS user_identities;
+
+UPDATE users SET password_hash = '' WHERE password_hash IS NULL;
+ALTER TABLE users MODIFY password_hash VARCHAR(255) NOT NULL;
@@ -0,0 +1,13 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS oauth_tokens (
+    identity_id INT PRIMARY KEY,
+    key_id INT NOT NULL,
+    data BLOB NOT NULL,
+    expires_at DATETIME,
+    updated_at DATETIME NOT NULL,
+    INDEX idx_oauth_tokens_key_id (key_id),
+    FOREIGN KEY (identity_id) REFERENCES user_identities(id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS oauth_tokens;
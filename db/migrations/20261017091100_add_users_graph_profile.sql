@@ -0,0 +1,30 @@
+-- +goose Up
+ALTER TABLE users
+    ADD COLUMN display_name VARCHAR(100),
+    ADD COLUMN job_title VARCHAR(100),
+    ADD COLUMN preferred_language VARCHAR(20),
+    ADD COLUMN profile_overrides SET('display_name', 'avatar', 'job_title', 'preferred_language') NOT NULL DEFAULT '',
+    ADD COLUMN graph_synced_at DATETIME,
+    ADD COLUMN graph_sync_attempted_at DATETIME,
+    ADD COLUMN graph_sync_error VARCHAR(255);
+
+CREATE TABLE IF NOT EXISTS user_avatars (
+    user_id INT PRIMARY KEY,
+    content_type VARCHAR(50) NOT NULL,
+    data MEDIUMBLOB NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    updated_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS user_avatars;
+
+ALTER TABLE users
+    DROP COLUMN display_name,
+    DROP COLUMN job_title,
+    DROP COLUMN preferred_language,
+    DROP COLUMN profile_overrides,
+    DROP COLUMN graph_synced_at,
+    DROP COLUMN graph_sync_attempted_at,
+    DROP COLUMN graph_sync_error;
@@ -0,0 +1,75 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(50) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    builtin BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+    name VARCHAR(50) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role VARCHAR(50) NOT NULL,
+    permission VARCHAR(50) NOT NULL,
+    PRIMARY KEY (role, permission),
+    FOREIGN KEY (role) REFERENCES roles(name) ON DELETE CASCADE,
+    FOREIGN KEY (permission) REFERENCES permissions(name) ON DELETE CASCADE
+);
+
+INSERT INTO roles (name, description, builtin) VALUES
+    ('user', 'Every account', TRUE),
+    ('moderator', 'Keeps posts in line', TRUE),
+    ('admin', 'Manages users and roles', TRUE);
+
+INSERT INTO permissions (name, description) VALUES
+    ('posts:create', 'Write posts'),
+    ('posts:update:own', 'Edit own posts'),
+    ('posts:delete:own', 'Delete own posts'),
+    ('posts:update:any', 'Edit anyone''s posts'),
+    ('posts:delete:any', 'Delete anyone''s posts'),
+    ('likes:write', 'Like posts'),
+    ('users:read:any', 'See other users'' account details'),
+    ('roles:assign', 'Change the role of a user'),
+    ('roles:manage', 'Create roles and edit their permissions');
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('user', 'posts:create'),
+    ('user', 'posts:update:own'),
+    ('user', 'posts:delete:own'),
+    ('user', 'likes:write'),
+    ('moderator', 'posts:create'),
+    ('moderator', 'posts:update:own'),
+    ('moderator', 'posts:delete:own'),
+    ('moderator', 'likes:write'),
+    ('moderator', 'posts:update:any'),
+    ('moderator', 'posts:delete:any'),
+    ('admin', 'posts:create'),
+    ('admin', 'posts:update:own'),
+    ('admin', 'posts:delete:own'),
+    ('admin', 'likes:write'),
+    ('admin', 'posts:update:any'),
+    ('admin', 'posts:delete:any'),
+    ('admin', 'users:read:any'),
+    ('admin', 'roles:assign'),
+    ('admin', 'roles:manage');
+
+-- The first admin has to be promoted by hand:
+-- UPDATE users SET role = 'admin' WHERE email = '...';
+ALTER TABLE users ADD COLUMN role VARCHAR(50) NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD CONSTRAINT fk_users_role FOREIGN KEY (role) REFERENCES roles(name);
+
+-- Roles granted through tenant groups must exist too
+DELETE FROM user_roles WHERE role NOT IN (SELECT name FROM roles);
+ALTER TABLE user_roles ADD CONSTRAINT fk_user_roles_role FOREIGN KEY (role) REFERENCES roles(name) ON DELETE CASCADE;
+
+-- +goose Down
+ALTER TABLE user_roles DROP FOREIGN KEY fk_user_roles_role;
+ALTER TABLE users DROP FOREIGN KEY fk_users_role;
+ALTER TABLE users DROP COLUMN role;
+
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS permissions;
+DROP TABLE IF EXISTS roles;
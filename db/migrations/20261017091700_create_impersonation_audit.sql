@@ -0,0 +1,40 @@
+-- +goose Up
+INSERT INTO permissions (name, description) VALUES
+    ('users:impersonate', 'Use the app as another user');
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('admin', 'users:impersonate');
+
+-- One row per event. Stop and expire rows point at the start row through
+-- impersonation_id. No foreign keys so the trail outlives deleted users.
+CREATE TABLE IF NOT EXISTS impersonation_audit (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    impersonation_id BIGINT,
+    event ENUM('start', 'stop', 'expire') NOT NULL,
+    admin_id INT NOT NULL,
+    user_id INT NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    allow_destructive BOOLEAN NOT NULL DEFAULT FALSE,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    INDEX idx_impersonation_audit_admin (admin_id, created_at),
+    INDEX idx_impersonation_audit_user (user_id, created_at)
+);
+
+-- +goose StatementBegin
+CREATE TRIGGER impersonation_audit_no_update BEFORE UPDATE ON impersonation_audit
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'impersonation_audit is append-only';
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER impersonation_audit_no_delete BEFORE DELETE ON impersonation_audit
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'impersonation_audit is append-only';
+-- +goose StatementEnd
+
+-- +goose Down
+DROP TRIGGER IF EXISTS impersonation_audit_no_delete;
+DROP TRIGGER IF EXISTS impersonation_audit_no_update;
+DROP TABLE IF EXISTS impersonation_audit;
+DELETE FROM role_permissions WHERE permission = 'users:impersonate';
+DELETE FROM permissions WHERE name = 'users:impersonate';
@@ -0,0 +1,9 @@
+-- +goose Up
+-- Lists the likes of a post newest first without sorting
+ALTER TABLE likes ADD INDEX idx_likes_post_created (post_id, created_at);
+
+-- Counters set by hand through PATCH before likes became read-only
+UPDATE posts p SET likes = (SELECT COUNT(*) FROM likes l WHERE l.post_id = p.id);
+
+-- +goose Down
+ALTER TABLE likes DROP INDEX idx_likes_post_created;
@@ -0,0 +1,17 @@
+-- +goose Up
+-- Secrets are sealed with the OAUTH_TOKEN_KEYS keyring from now on. Rows
+-- without a key ID are still plain text until the startup rotation seals
+-- them.
+ALTER TABLE users
+    MODIFY totp_secret VARBINARY(255),
+    ADD COLUMN totp_key_id INT AFTER totp_secret;
+
+-- +goose Down
+-- Encrypted secrets cannot be turned back into text here, those users have
+-- to enroll again.
+DELETE FROM totp_recovery_codes WHERE user_id IN (SELECT id FROM users WHERE totp_key_id IS NOT NULL);
+UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL WHERE totp_key_id IS NOT NULL;
+
+ALTER TABLE users
+    DROP COLUMN totp_key_id,
+    MODIFY totp_secret VARCHAR(64);
@@ -0,0 +1,7 @@
+-- +goose Up
+-- Whether the app sent redirect_uri to /oauth/authorize. Only then must the
+-- token request repeat it (RFC 6749 section 4.1.3).
+ALTER TABLE oauth_codes ADD COLUMN redirect_uri_sent BOOLEAN NOT NULL DEFAULT TRUE AFTER redirect_uri;
+
+-- +goose Down
+ALTER TABLE oauth_codes DROP COLUMN redirect_uri_sent;
@@ -1,9 +0,0 @@
-package handlers
-
-import (
-	"net/http"
-)
-
-func PostRouter(w http.ResponseWriter, r *http.Request) {
-	PostHandler(w, r)
-}
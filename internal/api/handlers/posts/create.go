@@ -1,45 +1,46 @@
 package posts
 
 import (
-	"encoding/json"
 	"go-rest-api/database"
+	"go-rest-api/internal/auth"
 	"go-rest-api/internal/models"
 	"log"
-	"net/http"
 	"time"
+
+	"github.com/gofiber/fiber/v2"
 )
 
-func AddPostHandler(w http.ResponseWriter, r *http.Request) {
+func AddPostHandler(c *fiber.Ctx) error {
+	p, err := requirePrincipal(c)
+	if p == nil {
+		return err
+	}
+
 	db := database.DB
 
 	var newPost models.Post
-	err := json.NewDecoder(r.Body).Decode(&newPost)
-	if err != nil {
-		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
-		return
-	}
-
-	if newPost.UserID <= 0 {
-		http.Error(w, "Valid user_id is required", http.StatusBadRequest)
-		return
+	if err := c.BodyParser(&newPost); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Error parsing JSON",
+		})
 	}
 
 	if newPost.Content == "" {
-		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
-		return
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Content cannot be empty",
+		})
 	}
 
-	var userExists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", newPost.UserID).Scan(&userExists)
-	if err != nil {
-		log.Println("Error checking if user exists:", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+	if !p.Can(auth.PermPostsCreate) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You do not have permission to create posts",
+		})
 	}
 
-	if !userExists {
-		http.Error(w, "User not found", http.StatusBadRequest)
-		return
+	if !p.User.EmailVerified {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Email address must be verified before posting",
+		})
 	}
 
 	stmt, err := db.Prepare(`
@@ -48,11 +49,15 @@ func AddPostHandler(w http.ResponseWriter, r *http.Request) {
     `)
 	if err != nil {
 		log.Println("Error preparing statement:", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
 	}
 	defer stmt.Close()
 
+	// The author is whoever is logged in, never the user_id in the body
+	newPost.UserID = p.User.ID
+
 	now := time.Now()
 	result, err := stmt.Exec(
 		newPost.UserID,
@@ -63,31 +68,25 @@ func AddPostHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("Error inserting post: %v (UserID=%d, Content=%s)",
 			err, newPost.UserID, newPost.Content)
-		http.Error(w, "Error creating post", http.StatusInternalServerError)
-		return
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error creating post",
+		})
 	}
 
 	lastInsertID, err := result.LastInsertId()
 	if err != nil {
 		log.Println("Error getting last insert ID:", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
 	}
 
 	newPost.ID = int(lastInsertID)
 	newPost.CreatedAt = now
 	newPost.Likes = 0
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-
-	response := struct {
-		Status string      `json:"status"`
-		Data   models.Post `json:"data"`
-	}{
-		Status: "success",
-		Data:   newPost,
-	}
-
-	json.NewEncoder(w).Encode(response)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"status": "success",
+		"data":   newPost,
+	})
 }
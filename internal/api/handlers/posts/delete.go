@@ -1,28 +1,48 @@
 package posts
 
 import (
-	"encoding/json"
+	"database/sql"
 	"go-rest-api/database"
+	"go-rest-api/internal/auth"
 	"log"
-	"net/http"
-)
 
-func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("DELETE request received: %s", r.URL.String())
+	"github.com/gofiber/fiber/v2"
+)
 
-	if IsCollectionRequest(r) {
-		http.Error(w, "Cannot delete entire collection", http.StatusMethodNotAllowed)
-		return
+func DeletePostHandler(c *fiber.Ctx) error {
+	p, err := requirePrincipal(c)
+	if p == nil {
+		return err
 	}
 
-	id, ok := ExtractPostID(w, r)
-	if !ok {
-		return
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid post ID",
+		})
 	}
 
 	db := database.DB
 
-	_, err := db.Exec("DELETE FROM likes WHERE post_id = ?", id)
+	post, err := getExistingPost(db, id)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Post not found",
+		})
+	} else if err != nil {
+		log.Println("Database query error:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if !canModify(p, post, auth.PermPostsDeleteOwn, auth.PermPostsDeleteAny) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You can only delete your own posts",
+		})
+	}
+
+	_, err = db.Exec("DELETE FROM likes WHERE post_id = ?", id)
 	if err != nil {
 		log.Println("Error deleting related likes:", err)
 	}
@@ -30,29 +50,27 @@ func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
 	result, err := db.Exec("DELETE FROM posts WHERE id = ?", id)
 	if err != nil {
 		log.Println("Database delete error:", err)
-		http.Error(w, "Error deleting post", http.StatusInternalServerError)
-		return
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error deleting post",
+		})
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		log.Println("Error getting affected rows:", err)
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
 	}
 
 	if rowsAffected == 0 {
-		http.Error(w, "Post not found", http.StatusNotFound)
-		return
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Post not found",
+		})
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	response := struct {
-		Status string `json:"status"`
-		ID     int    `json:"id"`
-	}{
-		Status: "success",
-		ID:     id,
-	}
-	json.NewEncoder(w).Encode(response)
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"id":     id,
+	})
 }
@@ -0,0 +1,224 @@
+package posts
+
+import (
+	"database/sql"
+	"go-rest-api/database"
+	"go-rest-api/internal/auth"
+	"go-rest-api/internal/models"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// posts.likes is a counter of the rows in likes. It only changes in the
+// same transaction as those rows, with the post row locked, so concurrent
+// likes cannot make it drift.
+
+// LikePostHandler likes the post as the current user. Liking twice is not
+// an error and does not count twice.
+func LikePostHandler(c *fiber.Ctx) error {
+	return setLike(c, true)
+}
+
+// UnlikePostHandler takes back the current user's like, if there is one.
+func UnlikePostHandler(c *fiber.Ctx) error {
+	return setLike(c, false)
+}
+
+func setLike(c *fiber.Ctx, liked bool) error {
+	p, err := requirePrincipal(c)
+	if p == nil {
+		return err
+	}
+
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid post ID",
+		})
+	}
+
+	if !p.Can(auth.PermLikesWrite) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You do not have permission to like posts",
+		})
+	}
+	if !p.User.EmailVerified {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Email address must be verified before liking",
+		})
+	}
+
+	failed := func(err error) error {
+		log.Println("Error updating like:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return failed(err)
+	}
+	defer tx.Rollback()
+
+	var likes int
+	err = tx.QueryRow("SELECT likes FROM posts WHERE id = ? FOR UPDATE", id).Scan(&likes)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Post not found",
+		})
+	} else if err != nil {
+		return failed(err)
+	}
+
+	var result sql.Result
+	if liked {
+		result, err = tx.Exec(
+			"INSERT IGNORE INTO likes (post_id, user_id, created_at) VALUES (?, ?, ?)",
+			id, p.User.ID, time.Now(),
+		)
+	} else {
+		result, err = tx.Exec("DELETE FROM likes WHERE post_id = ? AND user_id = ?", id, p.User.ID)
+	}
+	if err != nil {
+		return failed(err)
+	}
+
+	if n, _ := result.RowsAffected(); n > 0 {
+		delta := 1
+		if !liked {
+			delta = -1
+		}
+		if _, err := tx.Exec("UPDATE posts SET likes = GREATEST(likes + ?, 0) WHERE id = ?", delta, id); err != nil {
+			return failed(err)
+		}
+		likes += delta
+		if likes < 0 {
+			likes = 0
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return failed(err)
+	}
+
+	return c.JSON(fiber.Map{
+		"status":      "success",
+		"post_id":     id,
+		"liked_by_me": liked,
+		"likes":       likes,
+	})
+}
+
+// GetPostLikesHandler lists who liked a post, newest first.
+func GetPostLikesHandler(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid post ID",
+		})
+	}
+
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if limit > 100 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Limit cannot be greater than 100",
+		})
+	}
+	if page < 1 || limit < 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Page and limit must be positive",
+		})
+	}
+
+	db := database.DB
+
+	var total int
+	err = db.QueryRow("SELECT likes FROM posts WHERE id = ?", id).Scan(&total)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Post not found",
+		})
+	} else if err != nil {
+		log.Println("Database query error:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database query error",
+		})
+	}
+
+	rows, err := db.Query(`
+        SELECT l.user_id, u.username, l.post_id, l.created_at
+        FROM likes l JOIN users u ON u.id = l.user_id
+        WHERE l.post_id = ?
+        ORDER BY l.created_at DESC, l.id DESC
+        LIMIT ? OFFSET ?
+    `, id, limit, (page-1)*limit)
+	if err != nil {
+		log.Println("Database query error:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database query error",
+		})
+	}
+	defer rows.Close()
+
+	likes := make([]models.Like, 0)
+	for rows.Next() {
+		var like models.Like
+		if err := rows.Scan(&like.UserID, &like.Username, &like.PostID, &like.CreatedAt); err != nil {
+			log.Println("Database scan error:", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database scan error",
+			})
+		}
+		likes = append(likes, like)
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"count":  total,
+		"page":   page,
+		"data":   likes,
+	})
+}
+
+// likedPostIDs returns which of ids userID has liked.
+func likedPostIDs(db *sql.DB, userID int, ids ...int) (map[int]bool, error) {
+	liked := make(map[int]bool)
+	if userID == 0 || len(ids) == 0 {
+		return liked, nil
+	}
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, userID)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+
+	rows, err := db.Query("SELECT post_id FROM likes WHERE user_id = ? AND post_id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		liked[id] = true
+	}
+	return liked, rows.Err()
+}
+
+// viewerID is the user the response is for, or 0 for anonymous visitors.
+func viewerID(c *fiber.Ctx) int {
+	if p, ok := auth.FromContext(c.UserContext()); ok {
+		return p.User.ID
+	}
+	return 0
+}
@@ -0,0 +1,522 @@
+package posts
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"go-rest-api/database"
+	"go-rest-api/internal/auth"
+	"go-rest-api/internal/models"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofiber/fiber/v2"
+)
+
+var created = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+var postColumns = []string{"id", "user_id", "content", "image_url", "created_at", "updated_at", "likes"}
+
+// author may change their own posts, stranger is another ordinary user and
+// moderator may change anyone's posts.
+var (
+	author    = member(7)
+	stranger  = member(8)
+	moderator = &auth.Principal{
+		User:   models.User{ID: 9, EmailVerified: true},
+		Method: "session",
+		Permissions: map[string]bool{
+			auth.PermPostsUpdateAny: true,
+			auth.PermPostsDeleteAny: true,
+		},
+	}
+)
+
+func member(id int) *auth.Principal {
+	return &auth.Principal{
+		User:   models.User{ID: id, EmailVerified: true},
+		Method: "session",
+		Permissions: map[string]bool{
+			auth.PermPostsCreate:    true,
+			auth.PermPostsUpdateOwn: true,
+			auth.PermPostsDeleteOwn: true,
+			auth.PermLikesWrite:     true,
+		},
+	}
+}
+
+// newApp routes /api/posts like routes.Setup, with p as the logged in user
+// (nil for none) and database.DB swapped for a mock.
+func newApp(t *testing.T, p *auth.Principal) (*fiber.App, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = prev
+		db.Close()
+	})
+
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		if p != nil {
+			c.SetUserContext(auth.NewContext(c.UserContext(), p))
+		}
+		return c.Next()
+	})
+	app.Get("/api/posts", GetPostsHandler)
+	app.Get("/api/posts/:id", GetPostHandler)
+	app.Get("/api/posts/:id/likes", GetPostLikesHandler)
+	app.Put("/api/posts/:id/like", LikePostHandler)
+	app.Delete("/api/posts/:id/like", UnlikePostHandler)
+	app.Post("/api/posts", AddPostHandler)
+	app.Put("/api/posts/:id", UpdatePostHandler)
+	app.Patch("/api/posts/:id", PatchPostHandler)
+	app.Delete("/api/posts/:id", DeletePostHandler)
+	return app, mock
+}
+
+// do sends the request and decodes the JSON response into out.
+func do(t *testing.T, app *fiber.App, method, path, body string, out interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("decode %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func expectPost(mock sqlmock.Sqlmock, id, userID int) {
+	mock.ExpectQuery(regexp.QuoteMeta("FROM posts")).
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows(postColumns).AddRow(id, userID, "hello", nil, created, nil, 3))
+}
+
+func expectNoPost(mock sqlmock.Sqlmock, id int) {
+	mock.ExpectQuery(regexp.QuoteMeta("FROM posts")).
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows(postColumns))
+}
+
+func expectLiked(mock sqlmock.Sqlmock, userID int, postIDs ...int) {
+	args := []driver.Value{userID}
+	for _, id := range postIDs {
+		args = append(args, id)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT post_id FROM likes WHERE user_id = ?")).
+		WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"post_id"}).AddRow(postIDs[0]))
+}
+
+func expectUpdate(mock sqlmock.Sqlmock, id int, content string) {
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE posts")).
+		WithArgs(content, "", sqlmock.AnyArg(), id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+// expectLikeChange locks post id with likes and changes the like of userID,
+// which affects n rows. Only a changed row moves the counter by delta.
+func expectLikeChange(mock sqlmock.Sqlmock, id, userID, likes int, n int64, delta int) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT likes FROM posts WHERE id = ? FOR UPDATE")).
+		WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"likes"}).AddRow(likes))
+	if delta > 0 {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT IGNORE INTO likes")).
+			WithArgs(id, userID, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, n))
+	} else {
+		mock.ExpectExec(regexp.QuoteMeta("DELETE FROM likes WHERE post_id = ? AND user_id = ?")).
+			WithArgs(id, userID).
+			WillReturnResult(sqlmock.NewResult(0, n))
+	}
+	if n > 0 {
+		mock.ExpectExec(regexp.QuoteMeta("UPDATE posts SET likes = GREATEST(likes + ?, 0) WHERE id = ?")).
+			WithArgs(delta, id).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+}
+
+type likeResponse struct {
+	PostID    int  `json:"post_id"`
+	LikedByMe bool `json:"liked_by_me"`
+	Likes     int  `json:"likes"`
+}
+
+func TestGetPosts(t *testing.T) {
+	app, mock := newApp(t, author)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM posts ORDER BY created_at DESC LIMIT ? OFFSET ?")).
+		WithArgs(2, 2).
+		WillReturnRows(sqlmock.NewRows(postColumns).
+			AddRow(3, 7, "third", "https://img.example/3.png", created, created, 1).
+			AddRow(2, 8, "second", nil, created, nil, 0))
+	expectLiked(mock, 7, 3, 2)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(id) FROM posts")).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
+
+	var body struct {
+		Count int           `json:"count"`
+		Data  []models.Post `json:"data"`
+	}
+	if status := do(t, app, "GET", "/api/posts?page=2&limit=2", "", &body); status != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if body.Count != 4 || len(body.Data) != 2 {
+		t.Fatalf("count = %d with %d posts, want 4 with 2", body.Count, len(body.Data))
+	}
+	if p := body.Data[0]; p.ID != 3 || p.ImageURL != "https://img.example/3.png" || !p.LikedByMe {
+		t.Errorf("first post = %+v", p)
+	}
+	if p := body.Data[1]; p.ID != 2 || p.LikedByMe || !p.UpdatedAt.IsZero() {
+		t.Errorf("second post = %+v", p)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetPostsBadPaging(t *testing.T) {
+	app, mock := newApp(t, nil)
+
+	for _, query := range []string{"limit=101", "page=0", "limit=-1"} {
+		if status := do(t, app, "GET", "/api/posts?"+query, "", nil); status != fiber.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, status)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetPost(t *testing.T) {
+	// Anonymous visitors get the post without asking who liked it
+	app, mock := newApp(t, nil)
+	expectPost(mock, 5, 7)
+
+	var post models.Post
+	if status := do(t, app, "GET", "/api/posts/5", "", &post); status != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if post.ID != 5 || post.UserID != 7 || post.Content != "hello" || post.Likes != 3 || post.LikedByMe {
+		t.Errorf("post = %+v", post)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddPost(t *testing.T) {
+	app, mock := newApp(t, author)
+
+	// The author is the logged in user whatever the body says
+	mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO posts")).
+		ExpectExec().
+		WithArgs(7, "hello", "", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(42, 1))
+
+	var body struct {
+		Data models.Post `json:"data"`
+	}
+	status := do(t, app, "POST", "/api/posts", `{"content":"hello","user_id":8,"likes":99}`, &body)
+	if status != fiber.StatusCreated {
+		t.Fatalf("status = %d, want 201", status)
+	}
+	if p := body.Data; p.ID != 42 || p.UserID != 7 || p.Likes != 0 {
+		t.Errorf("post = %+v", p)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdatePost(t *testing.T) {
+	app, mock := newApp(t, author)
+	expectPost(mock, 5, 7)
+	expectUpdate(mock, 5, "edited")
+	expectLiked(mock, 7, 5)
+
+	var post models.Post
+	status := do(t, app, "PUT", "/api/posts/5", `{"content":"edited","user_id":8,"likes":99}`, &post)
+	if status != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if post.ID != 5 || post.UserID != 7 || post.Content != "edited" || post.Likes != 3 || !post.LikedByMe {
+		t.Errorf("post = %+v", post)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPatchPost(t *testing.T) {
+	app, mock := newApp(t, author)
+	expectPost(mock, 5, 7)
+	expectUpdate(mock, 5, "patched")
+	expectLiked(mock, 7, 5)
+
+	var post models.Post
+	status := do(t, app, "PATCH", "/api/posts/5", `{"content":"patched","likes":99,"user_id":8}`, &post)
+	if status != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if post.UserID != 7 || post.Content != "patched" || post.Likes != 3 {
+		t.Errorf("post = %+v", post)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeletePost(t *testing.T) {
+	app, mock := newApp(t, author)
+	expectPost(mock, 5, 7)
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM likes WHERE post_id = ?")).
+		WithArgs(5).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM posts WHERE id = ?")).
+		WithArgs(5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	var body map[string]interface{}
+	if status := do(t, app, "DELETE", "/api/posts/5", "", &body); status != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if body["id"] != float64(5) {
+		t.Errorf("body = %v", body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModeratorChangesOthersPosts(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+		expect func(sqlmock.Sqlmock)
+	}{
+		{"PUT", `{"content":"moderated"}`, func(m sqlmock.Sqlmock) {
+			expectUpdate(m, 5, "moderated")
+			expectLiked(m, 9, 5)
+		}},
+		{"PATCH", `{"content":"moderated"}`, func(m sqlmock.Sqlmock) {
+			expectUpdate(m, 5, "moderated")
+			expectLiked(m, 9, 5)
+		}},
+		{"DELETE", "", func(m sqlmock.Sqlmock) {
+			m.ExpectExec(regexp.QuoteMeta("DELETE FROM likes WHERE post_id = ?")).
+				WithArgs(5).
+				WillReturnResult(sqlmock.NewResult(0, 3))
+			m.ExpectExec(regexp.QuoteMeta("DELETE FROM posts WHERE id = ?")).
+				WithArgs(5).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			app, mock := newApp(t, moderator)
+			expectPost(mock, 5, 7)
+			tt.expect(mock)
+
+			var body map[string]interface{}
+			if status := do(t, app, tt.method, "/api/posts/5", tt.body, &body); status != fiber.StatusOK {
+				t.Fatalf("status = %d, want 200: %v", status, body)
+			}
+			// The post keeps its author
+			if uid, ok := body["user_id"]; ok && uid != float64(7) {
+				t.Errorf("user_id = %v, want 7", uid)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLikePostTwice(t *testing.T) {
+	app, mock := newApp(t, stranger)
+	expectLikeChange(mock, 5, 8, 3, 1, 1)
+	// The like is already there: INSERT IGNORE changes nothing and the
+	// counter is left alone
+	expectLikeChange(mock, 5, 8, 4, 0, 1)
+
+	for i := 0; i < 2; i++ {
+		var body likeResponse
+		if status := do(t, app, "PUT", "/api/posts/5/like", "", &body); status != fiber.StatusOK {
+			t.Fatalf("like %d: status = %d, want 200", i+1, status)
+		}
+		if body.PostID != 5 || !body.LikedByMe || body.Likes != 4 {
+			t.Errorf("like %d: %+v", i+1, body)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnlikePost(t *testing.T) {
+	tests := []struct {
+		name  string
+		n     int64
+		likes int
+	}{
+		{"liked", 1, 2},
+		{"not liked", 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newApp(t, stranger)
+			expectLikeChange(mock, 5, 8, 3, tt.n, -1)
+
+			var body likeResponse
+			if status := do(t, app, "DELETE", "/api/posts/5/like", "", &body); status != fiber.StatusOK {
+				t.Fatalf("status = %d, want 200", status)
+			}
+			if body.LikedByMe || body.Likes != tt.likes {
+				t.Errorf("body = %+v, want %d likes", body, tt.likes)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestGetPostLikes(t *testing.T) {
+	app, mock := newApp(t, nil)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT likes FROM posts WHERE id = ?")).
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"likes"}).AddRow(3))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM likes l JOIN users u ON u.id = l.user_id")).
+		WithArgs(5, 2, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "post_id", "created_at"}).
+			AddRow(7, "ada", 5, created))
+
+	var body struct {
+		Count int           `json:"count"`
+		Page  int           `json:"page"`
+		Data  []models.Like `json:"data"`
+	}
+	if status := do(t, app, "GET", "/api/posts/5/likes?page=2&limit=2", "", &body); status != fiber.StatusOK {
+		t.Fatalf("status = %d, want 200", status)
+	}
+	if body.Count != 3 || body.Page != 2 || len(body.Data) != 1 || body.Data[0].Username != "ada" {
+		t.Errorf("body = %+v", body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectNoLikeTarget(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT likes FROM posts WHERE id = ? FOR UPDATE")).
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"likes"}))
+	mock.ExpectRollback()
+}
+
+// TestPostRefusals checks every refused request answers with the right
+// status and error, and never writes to the database.
+func TestPostRefusals(t *testing.T) {
+	unverified := member(7)
+	unverified.User.EmailVerified = false
+	reader := &auth.Principal{User: models.User{ID: 9, EmailVerified: true}, Method: "session"}
+	editor := &auth.Principal{
+		User:        models.User{ID: 9, EmailVerified: true},
+		Method:      "session",
+		Permissions: map[string]bool{auth.PermPostsUpdateAny: true},
+	}
+
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		method    string
+		path      string
+		body      string
+		expect    func(sqlmock.Sqlmock)
+		status    int
+		err       string
+	}{
+		{"get bad id", nil, "GET", "/api/posts/abc", "", nil, 400, "Invalid post ID"},
+		{"get missing", nil, "GET", "/api/posts/5", "", func(m sqlmock.Sqlmock) { expectNoPost(m, 5) }, 404, "Post not found"},
+
+		{"create anonymous", nil, "POST", "/api/posts", `{"content":"hi"}`, nil, 401, "Not authenticated"},
+		{"create empty", author, "POST", "/api/posts", `{"content":""}`, nil, 400, "Content cannot be empty"},
+		{"create bad json", author, "POST", "/api/posts", `{"content":`, nil, 400, "Error parsing JSON"},
+		{"create without permission", reader, "POST", "/api/posts", `{"content":"hi"}`, nil, 403, "You do not have permission to create posts"},
+		{"create unverified", unverified, "POST", "/api/posts", `{"content":"hi"}`, nil, 403, "Email address must be verified before posting"},
+
+		{"update anonymous", nil, "PUT", "/api/posts/5", `{"content":"hi"}`, nil, 401, "Not authenticated"},
+		{"update bad id", author, "PUT", "/api/posts/abc", `{"content":"hi"}`, nil, 400, "Invalid post ID"},
+		{"update empty", author, "PUT", "/api/posts/5", `{"content":""}`, func(m sqlmock.Sqlmock) { expectPost(m, 5, 7) }, 400, "Content cannot be empty"},
+		{"update not owner", stranger, "PUT", "/api/posts/5", `{"content":"hi"}`, func(m sqlmock.Sqlmock) { expectPost(m, 5, 7) }, 403, "You can only edit your own posts"},
+		{"update missing", author, "PUT", "/api/posts/5", `{"content":"hi"}`, func(m sqlmock.Sqlmock) { expectNoPost(m, 5) }, 404, "Post not found"},
+
+		{"patch anonymous", nil, "PATCH", "/api/posts/5", `{"content":"hi"}`, nil, 401, "Not authenticated"},
+		{"patch bad id", author, "PATCH", "/api/posts/abc", `{"content":"hi"}`, nil, 400, "Invalid post ID"},
+		{"patch not owner", stranger, "PATCH", "/api/posts/5", `{"content":"hi"}`, func(m sqlmock.Sqlmock) { expectPost(m, 5, 7) }, 403, "You can only edit your own posts"},
+		{"patch missing", author, "PATCH", "/api/posts/5", `{"content":"hi"}`, func(m sqlmock.Sqlmock) { expectNoPost(m, 5) }, 404, "Post not found"},
+
+		{"delete anonymous", nil, "DELETE", "/api/posts/5", "", nil, 401, "Not authenticated"},
+		{"delete bad id", author, "DELETE", "/api/posts/abc", "", nil, 400, "Invalid post ID"},
+		{"delete not owner", stranger, "DELETE", "/api/posts/5", "", func(m sqlmock.Sqlmock) { expectPost(m, 5, 7) }, 403, "You can only delete your own posts"},
+		{"delete with update:any only", editor, "DELETE", "/api/posts/5", "", func(m sqlmock.Sqlmock) { expectPost(m, 5, 7) }, 403, "You can only delete your own posts"},
+		{"delete missing", author, "DELETE", "/api/posts/5", "", func(m sqlmock.Sqlmock) { expectNoPost(m, 5) }, 404, "Post not found"},
+
+		{"like anonymous", nil, "PUT", "/api/posts/5/like", "", nil, 401, "Not authenticated"},
+		{"like bad id", author, "PUT", "/api/posts/abc/like", "", nil, 400, "Invalid post ID"},
+		{"like without permission", reader, "PUT", "/api/posts/5/like", "", nil, 403, "You do not have permission to like posts"},
+		{"like unverified", unverified, "PUT", "/api/posts/5/like", "", nil, 403, "Email address must be verified before liking"},
+		{"unlike unverified", unverified, "DELETE", "/api/posts/5/like", "", nil, 403, "Email address must be verified before liking"},
+		{"like missing", author, "PUT", "/api/posts/5/like", "", expectNoLikeTarget, 404, "Post not found"},
+		{"unlike missing", author, "DELETE", "/api/posts/5/like", "", expectNoLikeTarget, 404, "Post not found"},
+
+		{"likes bad id", nil, "GET", "/api/posts/abc/likes", "", nil, 400, "Invalid post ID"},
+		{"likes limit too high", nil, "GET", "/api/posts/5/likes?limit=101", "", nil, 400, "Limit cannot be greater than 100"},
+		{"likes page zero", nil, "GET", "/api/posts/5/likes?page=0", "", nil, 400, "Page and limit must be positive"},
+		{"likes negative limit", nil, "GET", "/api/posts/5/likes?limit=-1", "", nil, 400, "Page and limit must be positive"},
+		{"likes missing", nil, "GET", "/api/posts/5/likes", "", func(m sqlmock.Sqlmock) {
+			m.ExpectQuery(regexp.QuoteMeta("SELECT likes FROM posts WHERE id = ?")).
+				WithArgs(5).
+				WillReturnRows(sqlmock.NewRows([]string{"likes"}))
+		}, 404, "Post not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mock := newApp(t, tt.principal)
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+
+			var body struct {
+				Error string `json:"error"`
+			}
+			status := do(t, app, tt.method, tt.path, tt.body, &body)
+			if status != tt.status || body.Error != tt.err {
+				t.Errorf("got %d %q, want %d %q", status, body.Error, tt.status, tt.err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
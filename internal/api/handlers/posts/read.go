@@ -2,50 +2,29 @@ package posts
 
 import (
 	"database/sql"
-	"encoding/json"
 	"go-rest-api/database"
 	"go-rest-api/internal/models"
 	"log"
-	"net/http"
-	"strconv"
-)
 
-func GetPostHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("GET request received: %s", r.URL.String())
+	"github.com/gofiber/fiber/v2"
+)
 
+func GetPostsHandler(c *fiber.Ctx) error {
 	db := database.DB
 
-	if IsCollectionRequest(r) {
-		getPostCollection(w, r, db)
-		return
-	}
-
-	id, ok := ExtractPostID(w, r)
-	if !ok {
-		return
-	}
-
-	getSinglePost(w, r, db, id)
-}
-
-func getPostCollection(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	pageStr := r.URL.Query().Get("page")
-	limitStr := r.URL.Query().Get("limit")
-
-	if pageStr == "" {
-		pageStr = "1"
-	}
-	if limitStr == "" {
-		limitStr = "10"
-	}
-
-	page, _ := strconv.Atoi(pageStr)
-	limit, _ := strconv.Atoi(limitStr)
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 10)
 
 	maxLimit := 100
 	if limit > maxLimit {
-		http.Error(w, "Limit cannot be greater than 100", http.StatusBadRequest)
-		return
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Limit cannot be greater than 100",
+		})
+	}
+	if page < 1 || limit < 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Page and limit must be positive",
+		})
 	}
 
 	query := "SELECT id, user_id, content, image_url, created_at, updated_at, likes FROM posts ORDER BY created_at DESC LIMIT ? OFFSET ?"
@@ -56,8 +35,9 @@ func getPostCollection(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	rows, err := db.Query(query, limit, offset)
 	if err != nil {
 		log.Println("Database query error:", err)
-		http.Error(w, "Database query error", http.StatusInternalServerError)
-		return
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database query error",
+		})
 	}
 	defer rows.Close()
 
@@ -70,8 +50,9 @@ func getPostCollection(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		err := rows.Scan(&post.ID, &post.UserID, &post.Content, &imageURL, &post.CreatedAt, &updatedAt, &post.Likes)
 		if err != nil {
 			log.Println("Database scan error:", err)
-			http.Error(w, "Database scan error", http.StatusInternalServerError)
-			return
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database scan error",
+			})
 		}
 
 		if imageURL.Valid {
@@ -85,6 +66,21 @@ func getPostCollection(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		postList = append(postList, post)
 	}
 
+	ids := make([]int, len(postList))
+	for i, post := range postList {
+		ids[i] = post.ID
+	}
+	liked, err := likedPostIDs(db, viewerID(c), ids...)
+	if err != nil {
+		log.Println("Database query error:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database query error",
+		})
+	}
+	for i := range postList {
+		postList[i].LikedByMe = liked[postList[i].ID]
+	}
+
 	var totalPosts int
 	err = db.QueryRow(queryCount).Scan(&totalPosts)
 	if err != nil {
@@ -92,53 +88,43 @@ func getPostCollection(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		totalPosts = 0
 	}
 
-	response := struct {
-		Status string        `json:"status"`
-		Count  int           `json:"count"`
-		Data   []models.Post `json:"data"`
-	}{
-		Status: "success",
-		Count:  totalPosts,
-		Data:   postList,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"count":  totalPosts,
+		"data":   postList,
+	})
 }
 
-func getSinglePost(w http.ResponseWriter, r *http.Request, db *sql.DB, id int) {
-	var post models.Post
-	var updatedAt sql.NullTime
-	var imageURL sql.NullString
-
-	query := "SELECT id, user_id, content, image_url, created_at, updated_at, likes FROM posts WHERE id = ?"
-	err := db.QueryRow(query, id).Scan(
-		&post.ID,
-		&post.UserID,
-		&post.Content,
-		&imageURL,
-		&post.CreatedAt,
-		&updatedAt,
-		&post.Likes,
-	)
+func GetPostHandler(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid post ID",
+		})
+	}
+
+	db := database.DB
 
+	post, err := getExistingPost(db, id)
 	if err == sql.ErrNoRows {
-		http.Error(w, "Post not found", http.StatusNotFound)
-		return
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Post not found",
+		})
 	} else if err != nil {
 		log.Println("Database query error:", err)
-		http.Error(w, "Database query error", http.StatusInternalServerError)
-		return
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database query error",
+		})
 	}
 
-	if imageURL.Valid {
-		post.ImageURL = imageURL.String
-	}
-
-	if updatedAt.Valid {
-		post.UpdatedAt = updatedAt.Time
+	liked, err := likedPostIDs(db, viewerID(c), post.ID)
+	if err != nil {
+		log.Println("Database query error:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database query error",
+		})
 	}
+	post.LikedByMe = liked[post.ID]
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(post)
+	return c.JSON(post)
 }
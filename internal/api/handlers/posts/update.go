@@ -2,53 +2,62 @@ package posts
 
 import (
 	"database/sql"
-	"encoding/json"
 	"go-rest-api/database"
+	"go-rest-api/internal/auth"
 	"go-rest-api/internal/models"
 	"log"
-	"net/http"
 	"reflect"
 	"strings"
 	"time"
-)
 
-func UpdatePostHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("PUT request received: %s", r.URL.String())
+	"github.com/gofiber/fiber/v2"
+)
 
-	if IsCollectionRequest(r) {
-		http.Error(w, "Cannot update entire collection", http.StatusMethodNotAllowed)
-		return
+func UpdatePostHandler(c *fiber.Ctx) error {
+	p, err := requirePrincipal(c)
+	if p == nil {
+		return err
 	}
 
-	id, ok := ExtractPostID(w, r)
-	if !ok {
-		return
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid post ID",
+		})
 	}
 
 	var updatedPost models.Post
-	err := json.NewDecoder(r.Body).Decode(&updatedPost)
-	if err != nil {
+	if err := c.BodyParser(&updatedPost); err != nil {
 		log.Println(err)
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
 	}
 
 	db := database.DB
 
 	existingPost, err := getExistingPost(db, id)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Post not found", http.StatusNotFound)
-		} else {
-			log.Println("Database query error:", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-		}
-		return
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Post not found",
+		})
+	} else if err != nil {
+		log.Println("Database query error:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if !canModify(p, existingPost, auth.PermPostsUpdateOwn, auth.PermPostsUpdateAny) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You can only edit your own posts",
+		})
 	}
 
 	if updatedPost.Content == "" {
-		http.Error(w, "Content cannot be empty", http.StatusBadRequest)
-		return
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Content cannot be empty",
+		})
 	}
 
 	updatedPost.ID = existingPost.ID
@@ -72,55 +81,74 @@ func UpdatePostHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err != nil {
 		log.Println("Database update error:", err)
-		http.Error(w, "Error updating post", http.StatusInternalServerError)
-		return
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error updating post",
+		})
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(updatedPost)
-}
+	liked, err := likedPostIDs(db, p.User.ID, id)
+	if err != nil {
+		log.Println("Database query error:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	updatedPost.LikedByMe = liked[id]
 
-func PatchPostHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("PATCH request received: %s", r.URL.String())
+	return c.JSON(updatedPost)
+}
 
-	if IsCollectionRequest(r) {
-		http.Error(w, "Cannot patch entire collection", http.StatusMethodNotAllowed)
-		return
+func PatchPostHandler(c *fiber.Ctx) error {
+	p, err := requirePrincipal(c)
+	if p == nil {
+		return err
 	}
 
-	id, ok := ExtractPostID(w, r)
-	if !ok {
-		return
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid post ID",
+		})
 	}
 
 	var updates map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&updates)
-	if err != nil {
+	if err := c.BodyParser(&updates); err != nil {
 		log.Println(err)
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request payload",
+		})
 	}
 
 	db := database.DB
 
 	existingPost, err := getExistingPost(db, id)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Post not found", http.StatusNotFound)
-		} else {
-			log.Println("Database query error:", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-		}
-		return
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Post not found",
+		})
+	} else if err != nil {
+		log.Println("Database query error:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if !canModify(p, existingPost, auth.PermPostsUpdateOwn, auth.PermPostsUpdateAny) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "You can only edit your own posts",
+		})
 	}
 
 	postVal := reflect.ValueOf(&existingPost).Elem()
 	postType := postVal.Type()
 
+	// likes only changes through the like endpoints
 	protectedFields := map[string]bool{
-		"id":         true,
-		"user_id":    true,
-		"created_at": true,
+		"id":          true,
+		"user_id":     true,
+		"created_at":  true,
+		"likes":       true,
+		"liked_by_me": true,
 	}
 
 	for k, v := range updates {
@@ -144,10 +172,6 @@ func PatchPostHandler(w http.ResponseWriter, r *http.Request) {
 					if strVal, ok := v.(string); ok {
 						fieldVal.SetString(strVal)
 					}
-				case "likes":
-					if numVal, ok := v.(float64); ok {
-						fieldVal.SetInt(int64(numVal))
-					}
 				}
 			}
 		}
@@ -157,7 +181,7 @@ func PatchPostHandler(w http.ResponseWriter, r *http.Request) {
 
 	query := `
         UPDATE posts
-        SET content = ?, image_url = ?, updated_at = ?, likes = ?
+        SET content = ?, image_url = ?, updated_at = ?
         WHERE id = ?
     `
 
@@ -166,18 +190,26 @@ func PatchPostHandler(w http.ResponseWriter, r *http.Request) {
 		existingPost.Content,
 		existingPost.ImageURL,
 		existingPost.UpdatedAt,
-		existingPost.Likes,
 		id,
 	)
 
 	if err != nil {
 		log.Println("Database update error:", err)
-		http.Error(w, "Error updating post", http.StatusInternalServerError)
-		return
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Error updating post",
+		})
+	}
+
+	liked, err := likedPostIDs(db, p.User.ID, id)
+	if err != nil {
+		log.Println("Database query error:", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
 	}
+	existingPost.LikedByMe = liked[id]
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(existingPost)
+	return c.JSON(existingPost)
 }
 
 func getExistingPost(db *sql.DB, id int) (models.Post, error) {
@@ -1,49 +1,29 @@
 package posts
 
 import (
-	"fmt"
-	"log"
-	"net/http"
-	"strconv"
-	"strings"
-)
-
-func ExtractPostID(w http.ResponseWriter, r *http.Request) (int, bool) {
-	log.Printf("Processing URL: %s", r.URL.String())
-
-	urlPath := r.URL.Path
-	log.Printf("URL path: %s", urlPath)
-
-	if urlPath == "/posts" || urlPath == "/posts/" {
-		return 0, true
-	}
-
-	parts := strings.Split(urlPath, "/")
-	var idPart string
+	"go-rest-api/internal/auth"
+	"go-rest-api/internal/models"
 
-	for i := 0; i < len(parts)-1; i++ {
-		if parts[i] == "posts" && i+1 < len(parts) {
-			idPart = parts[i+1]
-			break
-		}
-	}
-
-	if idPart == "" {
-		return 0, true
-	}
+	"github.com/gofiber/fiber/v2"
+)
 
-	id, err := strconv.Atoi(idPart)
-	if err != nil {
-		errMsg := fmt.Sprintf("Invalid post ID: %s", idPart)
-		log.Println(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
-		return 0, false
+// requirePrincipal returns the user the auth middleware stored in the
+// request context. Without one it writes a 401 and returns nil.
+func requirePrincipal(c *fiber.Ctx) (*auth.Principal, error) {
+	p, ok := auth.FromContext(c.UserContext())
+	if !ok {
+		return nil, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Not authenticated",
+		})
 	}
-
-	return id, true
+	return p, nil
 }
 
-func IsCollectionRequest(r *http.Request) bool {
-	path := r.URL.Path
-	return path == "/posts" || path == "/posts/"
+// canModify reports whether p may change post. The author needs ownPerm,
+// anyone else anyPerm, which moderators have.
+func canModify(p *auth.Principal, post models.Post, ownPerm, anyPerm string) bool {
+	if post.UserID == p.User.ID && p.Can(ownPerm) {
+		return true
+	}
+	return p.Can(anyPerm)
 }
@@ -0,0 +1,53 @@
+// Package auth carries the authenticated user of a request and the
+// permissions the roles in the database grant them.
+package auth
+
+import (
+	"context"
+	"go-rest-api/internal/models"
+)
+
+// Permissions checked in code. The full list and which role has which live
+// in the permissions and role_permissions tables.
+const (
+	PermPostsCreate      = "posts:create"
+	PermPostsUpdateOwn   = "posts:update:own"
+	PermPostsDeleteOwn   = "posts:delete:own"
+	PermPostsUpdateAny   = "posts:update:any"
+	PermPostsDeleteAny   = "posts:delete:any"
+	PermLikesWrite       = "likes:write"
+	PermUsersReadAny     = "users:read:any"
+	PermRolesAssign      = "roles:assign"
+	PermRolesManage      = "roles:manage"
+	PermUsersImpersonate = "users:impersonate"
+)
+
+// Principal is the user a request is made as.
+type Principal struct {
+	User models.User
+	// Method is how the request authenticated: session, token or jwt
+	Method string
+	// Permissions is what the user's roles allow, narrowed to the token's
+	// scopes for personal access tokens
+	Permissions map[string]bool
+	// ImpersonatorID is the admin acting as User, or 0
+	ImpersonatorID int
+}
+
+// Can reports whether the principal has permission.
+func (p *Principal) Can(permission string) bool {
+	return p != nil && p.Permissions[permission]
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying p.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal stored in ctx, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(*Principal)
+	return p, ok && p != nil
+}
@@ -0,0 +1,104 @@
+package graph
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-rest-api/internal/storage"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const DefaultBaseURL = "https://graph.microsoft.com/v1.0"
+
+// ErrNotLinked is returned for users without a linked Microsoft account or
+// without a stored token for it.
+var ErrNotLinked = errors.New("graph: user has no linked Microsoft account")
+
+// Error is a non-2xx response from Graph.
+type Error struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("graph: status %d: %s", e.StatusCode, e.Body)
+}
+
+// Client makes Graph requests on behalf of one user.
+type Client struct {
+	HTTP    *http.Client
+	BaseURL string
+}
+
+// Get requests path relative to the base URL and returns the response if it
+// succeeded. The caller closes the body.
+func (c *Client) Get(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(c.BaseURL, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &Error{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return resp, nil
+}
+
+// GetJSON requests path and decodes the response into v.
+func (c *Client) GetJSON(ctx context.Context, path string, v any) error {
+	resp, err := c.Get(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Service hands out Graph clients that use the stored, automatically
+// refreshed token of a user's Microsoft identity.
+type Service struct {
+	DB      *sql.DB
+	OAuth   *oauth2.Config
+	Tokens  *storage.TokenStore
+	BaseURL string
+}
+
+// ClientForUser returns a client acting as userID.
+func (s *Service) ClientForUser(ctx context.Context, userID int) (*Client, error) {
+	var identityID int
+	err := s.DB.QueryRow(`
+        SELECT id FROM user_identities
+        WHERE user_id = ? AND provider = 'microsoft' AND subject IS NOT NULL
+        ORDER BY last_login_at DESC
+        LIMIT 1
+    `, userID).Scan(&identityID)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotLinked
+	} else if err != nil {
+		return nil, err
+	}
+
+	ts, err := s.Tokens.TokenSource(ctx, s.OAuth, identityID)
+	if err == storage.ErrNoToken {
+		return nil, ErrNotLinked
+	} else if err != nil {
+		return nil, err
+	}
+
+	baseURL := s.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &Client{HTTP: oauth2.NewClient(ctx, ts), BaseURL: baseURL}, nil
+}
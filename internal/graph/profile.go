@@ -0,0 +1,83 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// MaxPhotoSize is the largest profile photo that will be downloaded.
+const MaxPhotoSize = 4 << 20
+
+// photoTypes are the image formats avatars are accepted in. Avatars are
+// served from the API origin, so anything a browser could run as a document,
+// like SVG, must not get through.
+var photoTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// AllowedPhotoType reports whether an avatar of contentType may be stored
+// and served.
+func AllowedPhotoType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && photoTypes[mediaType]
+}
+
+// Profile is the part of /me that is synced to the user's account.
+type Profile struct {
+	ID                string `json:"id"`
+	DisplayName       string `json:"displayName"`
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+	JobTitle          string `json:"jobTitle"`
+	PreferredLanguage string `json:"preferredLanguage"`
+}
+
+// Photo is a profile picture as returned by Graph.
+type Photo struct {
+	ContentType string
+	Data        []byte
+}
+
+// Me returns the signed in user's profile.
+func (c *Client) Me(ctx context.Context) (*Profile, error) {
+	var p Profile
+	err := c.GetJSON(ctx, "/me?$select=id,displayName,mail,userPrincipalName,jobTitle,preferredLanguage", &p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// MyPhoto returns the signed in user's profile photo, or nil if they have
+// none.
+func (c *Client) MyPhoto(ctx context.Context) (*Photo, error) {
+	resp, err := c.Get(ctx, "/me/photo/$value")
+	var gerr *Error
+	if errors.As(err, &gerr) && gerr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	if !AllowedPhotoType(contentType) {
+		return nil, fmt.Errorf("graph: unsupported photo type %q", contentType)
+	}
+	contentType, _, _ = mime.ParseMediaType(contentType)
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxPhotoSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxPhotoSize {
+		return nil, errors.New("graph: photo is too large")
+	}
+	return &Photo{ContentType: contentType, Data: data}, nil
+}
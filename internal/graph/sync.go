@@ -0,0 +1,206 @@
+package graph
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-rest-api/internal/storage"
+	"log"
+	"strings"
+	"time"
+)
+
+// Fields users can override, these are the values of users.profile_overrides.
+// An overridden field is left alone by the sync.
+const (
+	FieldDisplayName       = "display_name"
+	FieldAvatar            = "avatar"
+	FieldJobTitle          = "job_title"
+	FieldPreferredLanguage = "preferred_language"
+)
+
+// SyncProfile copies the profile and photo c can see into the account of
+// userID and records when that happened.
+func SyncProfile(ctx context.Context, db *sql.DB, c *Client, userID int) error {
+	me, err := c.Me(ctx)
+	if err != nil {
+		return err
+	}
+	photo, err := c.MyPhoto(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var overrides string
+	err = tx.QueryRow("SELECT profile_overrides FROM users WHERE id = ? FOR UPDATE", userID).Scan(&overrides)
+	if err != nil {
+		return err
+	}
+	overridden := make(map[string]bool)
+	for _, f := range strings.Split(overrides, ",") {
+		overridden[f] = true
+	}
+
+	sets := []string{"graph_synced_at = ?", "graph_sync_attempted_at = ?", "graph_sync_error = NULL"}
+	now := time.Now()
+	args := []any{now, now}
+	for _, f := range []struct {
+		column string
+		value  string
+	}{
+		{FieldDisplayName, me.DisplayName},
+		{FieldJobTitle, me.JobTitle},
+		{FieldPreferredLanguage, me.PreferredLanguage},
+	} {
+		if !overridden[f.column] {
+			sets = append(sets, f.column+" = ?")
+			args = append(args, nullIfEmpty(f.value))
+		}
+	}
+
+	if !overridden[FieldAvatar] {
+		avatarURL, err := saveAvatar(tx, userID, photo)
+		if err != nil {
+			return err
+		}
+		sets = append(sets, "avatar_url = ?")
+		args = append(args, avatarURL)
+	}
+
+	args = append(args, userID)
+	if _, err := tx.Exec("UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// saveAvatar stores photo as the avatar of userID and returns its URL, or
+// removes the avatar if photo is nil. The URL changes with the photo so
+// browsers do not keep showing an old one.
+func saveAvatar(tx *sql.Tx, userID int, photo *Photo) (*string, error) {
+	if photo == nil {
+		_, err := tx.Exec("DELETE FROM user_avatars WHERE user_id = ?", userID)
+		return nil, err
+	}
+
+	sum := sha256.Sum256(photo.Data)
+	hash := hex.EncodeToString(sum[:])
+	_, err := tx.Exec(`
+        INSERT INTO user_avatars (user_id, content_type, data, sha256, updated_at)
+        VALUES (?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE content_type = VALUES(content_type), data = VALUES(data),
+            sha256 = VALUES(sha256), updated_at = VALUES(updated_at)
+    `, userID, photo.ContentType, photo.Data, hash, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("/api/users/%d/avatar?v=%s", userID, hash[:12])
+	return &url, nil
+}
+
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// Syncer periodically syncs every user with a stored Microsoft token whose
+// last sync attempt is older than Interval.
+type Syncer struct {
+	Service  *Service
+	Interval time.Duration
+}
+
+const (
+	syncCheckInterval = 10 * time.Minute
+	syncBatchSize     = 50
+	syncUserTimeout   = 30 * time.Second
+)
+
+// Run syncs due users until ctx is cancelled.
+func (s *Syncer) Run(ctx context.Context) {
+	ticker := time.NewTicker(syncCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.syncDue(ctx); err != nil {
+			log.Printf("Graph profile sync failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Syncer) syncDue(ctx context.Context) error {
+	rows, err := s.Service.DB.QueryContext(ctx, `
+        SELECT DISTINCT u.id
+        FROM users u
+        JOIN user_identities i ON i.user_id = u.id AND i.provider = 'microsoft'
+        JOIN oauth_tokens t ON t.identity_id = i.id
+        WHERE u.graph_sync_attempted_at IS NULL OR u.graph_sync_attempted_at < ?
+        ORDER BY u.id
+        LIMIT ?
+    `, time.Now().Add(-s.Interval), syncBatchSize)
+	if err != nil {
+		return err
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		if err := s.syncUser(ctx, userID); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Graph profile sync for user %d failed: %v", userID, err)
+			_, err := s.Service.DB.Exec(
+				"UPDATE users SET graph_sync_attempted_at = ?, graph_sync_error = ? WHERE id = ?",
+				time.Now(), storage.Truncate(err.Error(), 255), userID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Syncer) syncUser(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, syncUserTimeout)
+	defer cancel()
+
+	c, err := s.Service.ClientForUser(ctx, userID)
+	if err != nil {
+		if errors.Is(err, ErrNotLinked) {
+			return errors.New("no Microsoft token stored")
+		}
+		return err
+	}
+	return SyncProfile(ctx, s.Service.DB, c, userID)
+}
@@ -0,0 +1,180 @@
+package graph
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var jpeg = []byte{0xff, 0xd8, 0xff, 0xe0, 'J', 'F', 'I', 'F'}
+
+// fakeGraph serves /me and /me/photo/$value. photo is called for the photo
+// request so each test decides how it answers.
+func fakeGraph(t *testing.T, photo http.HandlerFunc) *Client {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1.0/me", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"g-1","displayName":"Ada Lovelace","mail":"ada@example.com",` +
+			`"userPrincipalName":"ada@example.com","jobTitle":"Analyst","preferredLanguage":"en-GB"}`))
+	})
+	mux.HandleFunc("/v1.0/me/photo/$value", photo)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return &Client{HTTP: srv.Client(), BaseURL: srv.URL + "/v1.0"}
+}
+
+func servePhoto(contentType string, data []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(data)
+	}
+}
+
+func newMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, mock
+}
+
+func expectOverrides(mock sqlmock.Sqlmock, userID int, overrides string) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT profile_overrides FROM users WHERE id = ? FOR UPDATE")).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"profile_overrides"}).AddRow(overrides))
+}
+
+func TestSyncProfileCopiesFields(t *testing.T) {
+	db, mock := newMock(t)
+	c := fakeGraph(t, servePhoto("image/jpeg", jpeg))
+
+	expectOverrides(mock, 7, "")
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_avatars")).
+		WithArgs(7, "image/jpeg", jpeg, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(
+		"UPDATE users SET graph_synced_at = ?, graph_sync_attempted_at = ?, graph_sync_error = NULL, "+
+			"display_name = ?, job_title = ?, preferred_language = ?, avatar_url = ? WHERE id = ?",
+	)).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "Ada Lovelace", "Analyst", "en-GB", avatarURLArg{}, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := SyncProfile(context.Background(), db, c, 7); err != nil {
+		t.Fatalf("SyncProfile: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncProfileKeepsOverrides(t *testing.T) {
+	db, mock := newMock(t)
+	c := fakeGraph(t, servePhoto("image/png", []byte("\x89PNG")))
+
+	// Neither the display name nor the avatar may be touched
+	expectOverrides(mock, 7, "display_name,avatar")
+	mock.ExpectExec(regexp.QuoteMeta(
+		"UPDATE users SET graph_synced_at = ?, graph_sync_attempted_at = ?, graph_sync_error = NULL, "+
+			"job_title = ?, preferred_language = ? WHERE id = ?",
+	)).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "Analyst", "en-GB", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := SyncProfile(context.Background(), db, c, 7); err != nil {
+		t.Fatalf("SyncProfile: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncProfileRemovesAvatarWithoutPhoto(t *testing.T) {
+	db, mock := newMock(t)
+	c := fakeGraph(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":{"code":"ImageNotFound"}}`, http.StatusNotFound)
+	})
+
+	expectOverrides(mock, 7, "")
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM user_avatars WHERE user_id = ?")).
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("avatar_url = ? WHERE id = ?")).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "Ada Lovelace", "Analyst", "en-GB", nil, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := SyncProfile(context.Background(), db, c, 7); err != nil {
+		t.Fatalf("SyncProfile: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncProfileRejectsBadPhotos(t *testing.T) {
+	tests := []struct {
+		name  string
+		photo http.HandlerFunc
+	}{
+		{"oversize", servePhoto("image/jpeg", bytes.Repeat([]byte{0xff}, MaxPhotoSize+1))},
+		{"svg", servePhoto("image/svg+xml", []byte(`<svg onload="alert(1)"/>`))},
+		{"not an image", servePhoto("text/html", []byte("<script>alert(1)</script>"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMock(t)
+			c := fakeGraph(t, tt.photo)
+
+			// Nothing is written when the photo is refused
+			err := SyncProfile(context.Background(), db, c, 7)
+			if err == nil || !strings.Contains(err.Error(), "photo") {
+				t.Fatalf("SyncProfile error = %v, want a photo error", err)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestAllowedPhotoType(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"image/jpeg":               true,
+		"image/png":                true,
+		"image/gif":                true,
+		"image/webp":               true,
+		"IMAGE/JPEG; charset=x":    true,
+		"image/svg+xml":            false,
+		"image/svg+xml; charset=x": false,
+		"text/html":                false,
+		"":                         false,
+	} {
+		if got := AllowedPhotoType(contentType); got != want {
+			t.Errorf("AllowedPhotoType(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+// avatarURLArg matches the versioned avatar URL saveAvatar stores.
+type avatarURLArg struct{}
+
+var avatarURLPattern = regexp.MustCompile(`^/api/users/7/avatar\?v=[0-9a-f]{12}$`)
+
+func (avatarURLArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	return ok && avatarURLPattern.MatchString(s)
+}
@@ -0,0 +1,177 @@
+// Package jwtauth issues and verifies the ES256 access tokens used by
+// clients that cannot keep a cookie session.
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// Keyset holds the signing keys. The first key signs new tokens, the rest
+// are only published so tokens signed before a rotation stay valid until
+// they expire.
+type Keyset struct {
+	signer jose.Signer
+	keys   map[string]*ecdsa.PublicKey
+	jwks   jose.JSONWebKeySet
+}
+
+// NewKeyset builds a keyset from P-256 keys, current key first.
+func NewKeyset(keys []*ecdsa.PrivateKey) (*Keyset, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("jwtauth: no signing keys")
+	}
+
+	ks := &Keyset{keys: make(map[string]*ecdsa.PublicKey)}
+	for i, key := range keys {
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("jwtauth: signing keys must use P-256")
+		}
+		jwk := jose.JSONWebKey{Key: &key.PublicKey, Algorithm: string(jose.ES256), Use: "sig"}
+		thumb, err := jwk.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumb)
+		if _, dup := ks.keys[jwk.KeyID]; dup {
+			return nil, errors.New("jwtauth: duplicate signing key")
+		}
+		ks.keys[jwk.KeyID] = &key.PublicKey
+		ks.jwks.Keys = append(ks.jwks.Keys, jwk)
+
+		if i == 0 {
+			signer, err := jose.NewSigner(
+				jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: key, KeyID: jwk.KeyID}},
+				(&jose.SignerOptions{}).WithType("at+jwt"),
+			)
+			if err != nil {
+				return nil, err
+			}
+			ks.signer = signer
+		}
+	}
+	return ks, nil
+}
+
+// JWKS returns the public keys for publishing.
+func (ks *Keyset) JWKS() jose.JSONWebKeySet {
+	return ks.jwks
+}
+
+// GenerateKey returns a new P-256 key.
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// LoadKeyFile reads a P-256 private key in SEC 1 or PKCS #8 PEM form.
+func LoadKeyFile(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jwtauth: %s is not PEM encoded", path)
+	}
+
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ec, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("jwtauth: %s is not an EC key", path)
+		}
+		return ec, nil
+	}
+	return nil, fmt.Errorf("jwtauth: unsupported PEM block %q in %s", block.Type, path)
+}
+
+// Claims are the claims of an access token. SessionID names the refresh
+// token family the token was issued from.
+type Claims struct {
+	jwt.Claims
+	SessionID string `json:"sid"`
+}
+
+// UserID returns the user the token was issued to.
+func (c *Claims) UserID() (int, error) {
+	return strconv.Atoi(c.Subject)
+}
+
+// Issuer signs and checks access tokens.
+type Issuer struct {
+	Keys     *Keyset
+	Issuer   string
+	Audience string
+	TTL      time.Duration
+}
+
+// Issue returns a signed access token for userID and when it expires.
+func (i *Issuer) Issue(userID int, sessionID, tokenID string) (string, time.Time, error) {
+	now := time.Now()
+	expiry := now.Add(i.TTL)
+	claims := Claims{
+		Claims: jwt.Claims{
+			Issuer:    i.Issuer,
+			Subject:   strconv.Itoa(userID),
+			Audience:  jwt.Audience{i.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(expiry),
+			ID:        tokenID,
+		},
+		SessionID: sessionID,
+	}
+	raw, err := jwt.Signed(i.Keys.signer).Claims(claims).Serialize()
+	return raw, expiry, err
+}
+
+// Verify checks the signature, issuer, audience and lifetime of raw.
+func (i *Issuer) Verify(raw string) (*Claims, error) {
+	tok, err := jwt.ParseSigned(raw, []jose.SignatureAlgorithm{jose.ES256})
+	if err != nil {
+		return nil, err
+	}
+	if len(tok.Headers) != 1 {
+		return nil, errors.New("jwtauth: expected a single signature")
+	}
+	key, ok := i.Keys.keys[tok.Headers[0].KeyID]
+	if !ok {
+		return nil, errors.New("jwtauth: unknown key id")
+	}
+
+	var claims Claims
+	if err := tok.Claims(key, &claims); err != nil {
+		return nil, err
+	}
+	err = claims.Claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:      i.Issuer,
+		AnyAudience: jwt.Audience{i.Audience},
+		Time:        time.Now(),
+	}, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if claims.SessionID == "" {
+		return nil, errors.New("jwtauth: token has no session")
+	}
+	return &claims, nil
+}
@@ -0,0 +1,49 @@
+package mailer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File writes every message into a maildir under Dir so it can be opened
+// with a regular mail client or inspected by hand.
+type File struct {
+	Dir  string
+	From string
+}
+
+func NewFile(dir, from string) (*File, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return &File{Dir: dir, From: from}, nil
+}
+
+func (m *File) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if msg.From == "" {
+		msg.From = m.From
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d.%s.go-rest-api", time.Now().UnixNano(), hex.EncodeToString(b))
+
+	// Maildir delivery: write to tmp, then move into new once complete
+	tmpPath := filepath.Join(m.Dir, "tmp", name)
+	if err := os.WriteFile(tmpPath, msg.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(m.Dir, "new", name))
+}
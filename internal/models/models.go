@@ -5,9 +5,23 @@ import (
 )
 
 type User struct {
-	ID        int       `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
+	ID            int    `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	AvatarURL     string `json:"avatar_url,omitempty"`
+	DisplayName   string `json:"display_name,omitempty"`
+	JobTitle      string `json:"job_title,omitempty"`
+	// PreferredLanguage is a BCP 47 tag such as en-US
+	PreferredLanguage string `json:"preferred_language,omitempty"`
+	// ProfileOverrides lists the fields the user set themselves, the
+	// Microsoft profile sync leaves them alone
+	ProfileOverrides []string   `json:"profile_overrides"`
+	ProfileSyncedAt  *time.Time `json:"profile_synced_at,omitempty"`
+	// Role is the primary role, Roles also includes roles granted through
+	// tenant groups
+	Role      string    `json:"role"`
+	Roles     []string  `json:"roles"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
@@ -19,10 +33,96 @@ type Post struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Likes     int       `json:"likes"`
+	LikedByMe bool      `json:"liked_by_me"`
 }
 
 type Like struct {
 	UserID    int       `json:"user_id"`
+	Username  string    `json:"username,omitempty"`
 	PostID    int       `json:"post_id"`
 	CreatedAt time.Time `json:"created_at"`
 }
+
+type Session struct {
+	ID         string    `json:"id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Browser    string    `json:"browser"`
+	OS         string    `json:"os"`
+	Device     string    `json:"device"`
+	Current    bool      `json:"current"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type Passkey struct {
+	ID           int        `json:"id"`
+	Name         string     `json:"name"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+	CloneWarning bool       `json:"clone_warning"`
+}
+
+type Identity struct {
+	ID          int        `json:"id"`
+	Provider    string     `json:"provider"`
+	Email       string     `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+type AccessToken struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// Prefix is the start of the token, enough to recognise it
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Expired    bool       `json:"expired"`
+}
+
+type Role struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Builtin     bool     `json:"builtin"`
+	Permissions []string `json:"permissions"`
+}
+
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type ImpersonationEvent struct {
+	ID               int64     `json:"id"`
+	ImpersonationID  *int64    `json:"impersonation_id,omitempty"`
+	Event            string    `json:"event"`
+	AdminID          int       `json:"admin_id"`
+	UserID           int       `json:"user_id"`
+	Reason           string    `json:"reason,omitempty"`
+	AllowDestructive bool      `json:"allow_destructive"`
+	IP               string    `json:"ip"`
+	UserAgent        string    `json:"user_agent"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+type OAuthClient struct {
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// OAuthGrant is an app a user allowed to act on their behalf
+type OAuthGrant struct {
+	ClientID   string     `json:"client_id"`
+	ClientName string     `json:"client_name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
@@ -0,0 +1,194 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// MicrosoftClaims are the ID token claims we rely on from the Microsoft
+// identity platform.
+type MicrosoftClaims struct {
+	Issuer            string `json:"iss"`
+	TenantID          string `json:"tid"`
+	ObjectID          string `json:"oid"`
+	Email             string `json:"email"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	// Groups holds group object IDs when the app registration emits them
+	Groups []string `json:"groups"`
+	// ClaimNames lists claims left out of the token, "groups" is in here
+	// when the user is in too many groups to fit
+	ClaimNames map[string]string `json:"_claim_names"`
+	// EmailDomainOwnerVerified is the xms_edov optional claim, true when the
+	// tenant has verified the domain of Email
+	EmailDomainOwnerVerified bool `json:"xms_edov"`
+}
+
+// VerifiedEmail returns the email claim if Microsoft vouches for it, or "".
+// Personal accounts sign in with a confirmed address. Work and school
+// accounts can put any address in email, it only counts with xms_edov.
+func (c *MicrosoftClaims) VerifiedEmail() string {
+	if strings.EqualFold(c.TenantID, ConsumerTenantID) || c.EmailDomainOwnerVerified {
+		return c.Email
+	}
+	return ""
+}
+
+// GroupsOverage reports whether the groups claim was left out because the
+// user is in too many groups.
+func (c *MicrosoftClaims) GroupsOverage() bool {
+	_, ok := c.ClaimNames["groups"]
+	return ok
+}
+
+// ConsumerTenantID is the tenant personal Microsoft accounts belong to.
+const ConsumerTenantID = "9188040d-6c67-4c5b-b112-36a304b66dad"
+
+// MicrosoftPolicy restricts which Microsoft accounts may sign in and maps
+// their tenant groups to app roles. Empty lists allow everything.
+type MicrosoftPolicy struct {
+	// AllowedTenants are tenant IDs, compared case-insensitively
+	AllowedTenants []string
+	// AllowedDomains are user principal name domains, subdomains are not
+	// included
+	AllowedDomains []string
+	// AllowPersonalAccounts lets accounts from ConsumerTenantID in
+	AllowPersonalAccounts bool
+	// GroupRoles maps group object IDs to app role names
+	GroupRoles map[string]string
+}
+
+// Allows reports whether an account in tenantID with the given user
+// principal name may sign in. All restrictions that are set must match.
+//
+// Domains are checked against the UPN rather than mail: a tenant can put any
+// address in mail, but only UPNs in domains it has verified. Personal
+// accounts have no such check, so they never match a domain.
+func (p MicrosoftPolicy) Allows(tenantID, upn string) bool {
+	personal := strings.EqualFold(tenantID, ConsumerTenantID)
+	if personal && !p.AllowPersonalAccounts {
+		return false
+	}
+	if len(p.AllowedTenants) > 0 && !containsFold(p.AllowedTenants, tenantID) {
+		return false
+	}
+	if len(p.AllowedDomains) > 0 {
+		at := strings.LastIndex(upn, "@")
+		if personal || at < 0 || !containsFold(p.AllowedDomains, upn[at+1:]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Roles returns the app roles granted by groups, without duplicates.
+func (p MicrosoftPolicy) Roles(groups []string) []string {
+	seen := make(map[string]bool)
+	roles := make([]string, 0)
+	for _, g := range groups {
+		role, ok := p.GroupRoles[strings.ToLower(g)]
+		if ok && !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// MicrosoftVerifier checks ID tokens issued by login.microsoftonline.com.
+// The multi-tenant endpoints (common, organizations) advertise an issuer of
+// the form https://login.microsoftonline.com/{tenantid}/v2.0, so the usual
+// issuer check is replaced by one that fills in the token's own tid.
+type MicrosoftVerifier struct {
+	verifier       *oidc.IDTokenVerifier
+	issuerTemplate string
+	client         *http.Client
+}
+
+// NewMicrosoftVerifier loads the discovery document for an authority such
+// as https://login.microsoftonline.com/consumers/v2.0 and verifies tokens
+// for clientID against its JWKS.
+func NewMicrosoftVerifier(ctx context.Context, client *http.Client, authority, clientID string) (*MicrosoftVerifier, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		strings.TrimSuffix(authority, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %s", resp.Status)
+	}
+
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing issuer or jwks_uri")
+	}
+
+	keyCtx := oidc.ClientContext(context.Background(), client)
+	keySet := oidc.NewRemoteKeySet(keyCtx, discovery.JWKSURI)
+
+	return &MicrosoftVerifier{
+		verifier: oidc.NewVerifier(discovery.Issuer, keySet, &oidc.Config{
+			ClientID:        clientID,
+			SkipIssuerCheck: true,
+		}),
+		issuerTemplate: discovery.Issuer,
+		client:         client,
+	}, nil
+}
+
+// Verify checks the signature, audience, expiry, nonce and issuer of an ID
+// token and returns its claims.
+func (v *MicrosoftVerifier) Verify(ctx context.Context, rawIDToken, nonce string) (*MicrosoftClaims, error) {
+	idToken, err := v.verifier.Verify(oidc.ClientContext(ctx, v.client), rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != nonce {
+		return nil, ErrNonceMismatch
+	}
+
+	var claims MicrosoftClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	if claims.TenantID == "" || claims.ObjectID == "" {
+		return nil, errors.New("oauth: id_token is missing tid or oid")
+	}
+
+	expectedIssuer := strings.ReplaceAll(v.issuerTemplate, "{tenantid}", claims.TenantID)
+	if claims.Issuer != expectedIssuer {
+		return nil, fmt.Errorf("oauth: id_token issued by %q, expected %q", claims.Issuer, expectedIssuer)
+	}
+
+	return &claims, nil
+}
@@ -0,0 +1,150 @@
+package oauth
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMicrosoftPolicyAllows(t *testing.T) {
+	const workTenant = "72f988bf-86f1-41af-91ab-2d7cd011db47"
+
+	tests := []struct {
+		name   string
+		policy MicrosoftPolicy
+		tenant string
+		upn    string
+		want   bool
+	}{
+		{"no restrictions", MicrosoftPolicy{}, workTenant, "ada@contoso.com", true},
+		{"personal refused by default", MicrosoftPolicy{}, ConsumerTenantID, "ada@outlook.com", false},
+		{"personal allowed", MicrosoftPolicy{AllowPersonalAccounts: true}, ConsumerTenantID, "ada@outlook.com", true},
+		{"tenant listed", MicrosoftPolicy{AllowedTenants: []string{workTenant}}, workTenant, "ada@contoso.com", true},
+		{"tenant not listed", MicrosoftPolicy{AllowedTenants: []string{workTenant}}, "other", "ada@contoso.com", false},
+		{"domain listed", MicrosoftPolicy{AllowedDomains: []string{"contoso.com"}}, workTenant, "Ada@Contoso.com", true},
+		{"domain not listed", MicrosoftPolicy{AllowedDomains: []string{"contoso.com"}}, workTenant, "ada@fabrikam.com", false},
+		{"subdomain not included", MicrosoftPolicy{AllowedDomains: []string{"contoso.com"}}, workTenant, "ada@eu.contoso.com", false},
+		{"personal UPN never matches a domain",
+			MicrosoftPolicy{AllowedDomains: []string{"contoso.com"}, AllowPersonalAccounts: true},
+			ConsumerTenantID, "ada@contoso.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Allows(tt.tenant, tt.upn); got != tt.want {
+				t.Errorf("Allows(%q, %q) = %v, want %v", tt.tenant, tt.upn, got, tt.want)
+			}
+		})
+	}
+}
+
+const (
+	testTenant = "72f988bf-86f1-41af-91ab-2d7cd011db47"
+	testOID    = "00000000-0000-0000-66f3-3332eca7ea81"
+	testNonce  = "nonce-1"
+)
+
+func microsoftIssuer(tenant string) string {
+	return "https://login.microsoftonline.com/" + tenant + "/v2.0"
+}
+
+func newMicrosoftVerifier(t *testing.T, idp *mockIdP) *MicrosoftVerifier {
+	t.Helper()
+	v, err := NewMicrosoftVerifier(context.Background(), idp.Client(), idp.URL+"/common/v2.0", testClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// microsoftToken signs an ID token for testTenant. claims are added on top,
+// a nil value leaves the claim out.
+func microsoftToken(idp *mockIdP, nonce string, claims map[string]interface{}) string {
+	idp.idIssuer = microsoftIssuer(testTenant)
+	idp.idClaims = map[string]interface{}{
+		"tid":                testTenant,
+		"oid":                testOID,
+		"email":              "ada@contoso.com",
+		"preferred_username": "ada@contoso.com",
+		"groups":             []string{"g-1"},
+		"xms_edov":           true,
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(idp.idClaims, k)
+		} else {
+			idp.idClaims[k] = v
+		}
+	}
+	return idp.signIDToken(nonce)
+}
+
+func TestMicrosoftVerify(t *testing.T) {
+	idp := newMockIdP(t)
+	v := newMicrosoftVerifier(t, idp)
+
+	claims, err := v.Verify(context.Background(), microsoftToken(idp, testNonce, nil), testNonce)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if claims.TenantID != testTenant || claims.ObjectID != testOID || claims.VerifiedEmail() != "ada@contoso.com" ||
+		len(claims.Groups) != 1 || claims.Issuer != microsoftIssuer(testTenant) {
+		t.Errorf("claims = %+v", claims)
+	}
+}
+
+func TestMicrosoftVerifyRefusals(t *testing.T) {
+	otherTenant := "00000000-0000-0000-0000-000000000001"
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		nonce  string
+		claims map[string]interface{}
+		want   string
+	}{
+		{"issuer of another tenant", testNonce,
+			map[string]interface{}{"iss": microsoftIssuer(otherTenant)}, "issued by"},
+		{"tid of another tenant", testNonce,
+			map[string]interface{}{"tid": otherTenant}, "issued by"},
+		{"issuer not filled in", testNonce,
+			map[string]interface{}{"iss": microsoftIssuer("{tenantid}")}, "issued by"},
+		{"wrong nonce", "other", nil, ErrNonceMismatch.Error()},
+		{"missing nonce", "", nil, ErrNonceMismatch.Error()},
+		{"missing oid", testNonce, map[string]interface{}{"oid": nil}, "missing tid or oid"},
+		{"missing tid", testNonce, map[string]interface{}{"tid": nil}, "missing tid or oid"},
+		{"expired", testNonce,
+			map[string]interface{}{"iat": past.Add(-time.Hour).Unix(), "exp": past.Unix()}, "expired"},
+		{"other audience", testNonce, map[string]interface{}{"aud": "someone-else"}, "audience"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newMockIdP(t)
+			v := newMicrosoftVerifier(t, idp)
+
+			claims, err := v.Verify(context.Background(), microsoftToken(idp, tt.nonce, tt.claims), testNonce)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Verify = %+v, %v, want an error containing %q", claims, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMicrosoftVerifiedEmail(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims MicrosoftClaims
+		want   string
+	}{
+		{"personal account", MicrosoftClaims{TenantID: ConsumerTenantID, Email: "ada@outlook.com"}, "ada@outlook.com"},
+		{"work account with xms_edov", MicrosoftClaims{TenantID: testTenant, Email: "ada@contoso.com", EmailDomainOwnerVerified: true}, "ada@contoso.com"},
+		{"work account without xms_edov", MicrosoftClaims{TenantID: testTenant, Email: "ada@contoso.com"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.claims.VerifiedEmail(); got != tt.want {
+				t.Errorf("VerifiedEmail() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
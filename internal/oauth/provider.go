@@ -0,0 +1,203 @@
+// Package oauth holds the external login providers users can sign in with.
+// Providers are either OpenID Connect issuers, whose endpoints and signing
+// keys are found through discovery, or plain OAuth2 providers that expose a
+// user info API, like GitHub.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var ErrNonceMismatch = errors.New("oauth: id_token nonce does not match")
+
+// ClaimMapping names the claims a provider puts each profile field in.
+type ClaimMapping struct {
+	Subject       string `json:"subject"`
+	Email         string `json:"email"`
+	EmailVerified string `json:"email_verified"`
+	Username      string `json:"username"`
+	Avatar        string `json:"avatar"`
+}
+
+// Profile is what we learn about a user from a provider.
+type Profile struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Username      string
+	AvatarURL     string
+	// Claims holds every claim the provider returned
+	Claims map[string]interface{}
+}
+
+type Provider struct {
+	Name        string
+	DisplayName string
+	OAuth2      *oauth2.Config
+	// Verifier checks ID tokens, nil for providers without OpenID Connect
+	Verifier *oidc.IDTokenVerifier
+	// UserInfoURL is queried with the access token for extra claims
+	UserInfoURL string
+	Claims      ClaimMapping
+	// HTTPClient is used for every call to the provider, mainly so tests can
+	// point it at a mock identity provider
+	HTTPClient *http.Client
+	// fetchEmail finds the address for providers that leave it out of the
+	// user info response
+	fetchEmail func(ctx context.Context, client *http.Client) (string, bool, error)
+}
+
+func (p *Provider) IsOIDC() bool {
+	return p.Verifier != nil
+}
+
+func (p *Provider) context(ctx context.Context) context.Context {
+	if p.HTTPClient == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, p.HTTPClient)
+}
+
+// AuthCodeURL returns the URL to send the user to. nonce is ignored for
+// providers without OpenID Connect.
+func (p *Provider) AuthCodeURL(state, nonce, verifier string) string {
+	opts := []oauth2.AuthCodeOption{oauth2.S256ChallengeOption(verifier)}
+	if p.IsOIDC() {
+		opts = append(opts, oidc.Nonce(nonce))
+	}
+	return p.OAuth2.AuthCodeURL(state, opts...)
+}
+
+// Exchange redeems code and returns the token and the user's profile. For
+// OpenID Connect providers the ID token signature, issuer, audience, expiry
+// and nonce are all checked before any claim is trusted.
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string) (*oauth2.Token, *Profile, error) {
+	ctx = p.context(ctx)
+
+	token, err := p.OAuth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, nil, fmt.Errorf("exchanging code: %w", err)
+	}
+
+	claims := make(map[string]interface{})
+
+	if p.IsOIDC() {
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			return nil, nil, errors.New("oauth: token response has no id_token")
+		}
+		idToken, err := p.Verifier.Verify(ctx, rawIDToken)
+		if err != nil {
+			return nil, nil, fmt.Errorf("verifying id_token: %w", err)
+		}
+		if idToken.Nonce != nonce {
+			return nil, nil, ErrNonceMismatch
+		}
+		if err := idToken.Claims(&claims); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	client := p.OAuth2.Client(ctx, token)
+
+	if p.UserInfoURL != "" {
+		info, err := getJSON(client, p.UserInfoURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fetching user info: %w", err)
+		}
+		for k, v := range info {
+			// ID token claims are signed, user info only fills the gaps
+			if _, ok := claims[k]; !ok || !p.IsOIDC() {
+				claims[k] = v
+			}
+		}
+	}
+
+	profile := p.mapClaims(claims)
+
+	if p.fetchEmail != nil && (profile.Email == "" || !profile.EmailVerified) {
+		profile.Email, profile.EmailVerified, err = p.fetchEmail(ctx, client)
+		if err != nil {
+			return nil, nil, fmt.Errorf("fetching email: %w", err)
+		}
+	}
+
+	if profile.Subject == "" {
+		return nil, nil, errors.New("oauth: provider returned no subject")
+	}
+	return token, profile, nil
+}
+
+func (p *Provider) mapClaims(claims map[string]interface{}) *Profile {
+	profile := &Profile{
+		Provider:  p.Name,
+		Subject:   stringClaim(claims, p.Claims.Subject),
+		Email:     stringClaim(claims, p.Claims.Email),
+		Username:  stringClaim(claims, p.Claims.Username),
+		AvatarURL: stringClaim(claims, p.Claims.Avatar),
+		Claims:    claims,
+	}
+
+	switch v := claims[p.Claims.EmailVerified].(type) {
+	case bool:
+		profile.EmailVerified = v
+	case string:
+		profile.EmailVerified, _ = strconv.ParseBool(v)
+	}
+	return profile
+}
+
+// stringClaim returns a claim as a string. Numeric IDs, as GitHub uses,
+// are formatted without a decimal point.
+func stringClaim(claims map[string]interface{}, name string) string {
+	if name == "" {
+		return ""
+	}
+	switch v := claims[name].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+func getJSON(client *http.Client, url string) (map[string]interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	var v map[string]interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
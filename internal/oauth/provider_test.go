@@ -0,0 +1,430 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const (
+	testClientID    = "client-123"
+	testRedirectURL = "https://app.example.com/auth/test/callback"
+	testCode        = "code-abc"
+)
+
+// mockIdP is an identity provider that serves discovery, JWKS, a token
+// endpoint that enforces PKCE, user info and GitHub's emails API.
+type mockIdP struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	challenge string
+	nonce     string
+
+	// idIssuer and idAudience override what the ID token claims, to test
+	// that mismatches are refused
+	idIssuer   string
+	idAudience string
+	// idClaims are added to the ID token, userInfo is served as is
+	idClaims map[string]interface{}
+	userInfo map[string]interface{}
+	emails   []map[string]interface{}
+	// withIDToken controls whether the token response has an id_token
+	withIDToken bool
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIdP{t: t, key: key, withIDToken: true}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	// Served under another path, the document names an issuer that is not
+	// the URL it was fetched from
+	mux.HandleFunc("/other/.well-known/openid-configuration", m.discovery)
+	// Like a Microsoft multi-tenant authority, the issuer has a placeholder
+	// for the token's tenant
+	mux.HandleFunc("/common/v2.0/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":   microsoftIssuer("{tenantid}"),
+			"jwks_uri": m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not used", http.StatusNotFound)
+	})
+	mux.HandleFunc("/token", m.token)
+	mux.HandleFunc("/userinfo", m.serveJSON(func() interface{} { return m.userInfo }))
+	mux.HandleFunc("/userinfo/emails", m.serveJSON(func() interface{} { return m.emails }))
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize stands in for the user's browser visiting authURL: the IdP
+// remembers the PKCE challenge and nonce it was sent.
+func (m *mockIdP) authorize(authURL string) {
+	m.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		m.t.Fatalf("auth URL has no S256 code challenge: %s", authURL)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.challenge = q.Get("code_challenge")
+	m.nonce = q.Get("nonce")
+}
+
+func (m *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                m.URL,
+		"authorization_endpoint":                m.URL + "/authorize",
+		"token_endpoint":                        m.URL + "/token",
+		"userinfo_endpoint":                     m.URL + "/userinfo",
+		"jwks_uri":                              m.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (m *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &m.key.PublicKey,
+		KeyID:     "k1",
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}})
+}
+
+func (m *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mu.Lock()
+	challenge, nonce := m.challenge, m.nonce
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if r.PostForm.Get("code") != testCode ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	resp := map[string]interface{}{
+		"access_token": "access-xyz",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	}
+	if m.withIDToken {
+		resp["id_token"] = m.signIDToken(nonce)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (m *mockIdP) signIDToken(nonce string) string {
+	claims := map[string]interface{}{
+		"iss":   m.URL,
+		"aud":   testClientID,
+		"sub":   "user-1",
+		"nonce": nonce,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+	}
+	if m.idIssuer != "" {
+		claims["iss"] = m.idIssuer
+	}
+	if m.idAudience != "" {
+		claims["aud"] = m.idAudience
+	}
+	for k, v := range m.idClaims {
+		claims[k] = v
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: m.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "k1"),
+	)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	payload, _ := json.Marshal(claims)
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	raw, err := jws.CompactSerialize()
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return raw
+}
+
+func (m *mockIdP) serveJSON(v func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-xyz" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v())
+	}
+}
+
+func (m *mockIdP) provider(t *testing.T, cfg ProviderConfig) *Provider {
+	t.Helper()
+	cfg.Name = "test"
+	cfg.ClientID = testClientID
+	cfg.ClientSecret = "secret"
+	cfg.RedirectURL = testRedirectURL
+	p, err := New(context.Background(), cfg, m.Client())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return p
+}
+
+// goodVerifier is the PKCE verifier login starts the flow with.
+const goodVerifier = "verifier-0123456789-0123456789-0123456789"
+
+// login runs the flow the way the login and callback handlers do: the auth
+// URL is built with nonce and goodVerifier, the code is then exchanged with
+// exchangeNonce and verifier.
+func login(p *Provider, idp *mockIdP, nonce, exchangeNonce, verifier string) (*Profile, error) {
+	idp.authorize(p.AuthCodeURL("state-1", nonce, goodVerifier))
+	_, profile, err := p.Exchange(context.Background(), testCode, exchangeNonce, verifier)
+	return profile, err
+}
+
+func TestDiscovery(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider(t, ProviderConfig{Type: "oidc", Issuer: idp.URL})
+
+	if !p.IsOIDC() {
+		t.Fatal("discovered provider is not OpenID Connect")
+	}
+	if p.OAuth2.Endpoint.AuthURL != idp.URL+"/authorize" || p.OAuth2.Endpoint.TokenURL != idp.URL+"/token" {
+		t.Errorf("endpoints = %+v, want the discovered ones", p.OAuth2.Endpoint)
+	}
+	if p.UserInfoURL != idp.URL+"/userinfo" {
+		t.Errorf("UserInfoURL = %q", p.UserInfoURL)
+	}
+	if p.DisplayName != "test" {
+		t.Errorf("DisplayName = %q, want the provider name", p.DisplayName)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+	_, err := New(context.Background(), ProviderConfig{
+		Name:        "test",
+		Type:        "oidc",
+		Issuer:      idp.URL + "/other",
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+	}, idp.Client())
+	if err == nil || !strings.Contains(err.Error(), "did not match the issuer") {
+		t.Fatalf("New error = %v, want an issuer mismatch", err)
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.idClaims = map[string]interface{}{
+		"email":              "ada@example.com",
+		"email_verified":     true,
+		"preferred_username": "ada",
+	}
+	// User info only fills gaps, it cannot override signed claims
+	idp.userInfo = map[string]interface{}{
+		"sub":     "someone-else",
+		"email":   "mallory@example.com",
+		"picture": "https://idp.example.com/ada.png",
+	}
+	p := idp.provider(t, ProviderConfig{Type: "oidc", Issuer: idp.URL})
+
+	profile, err := login(p, idp, "nonce-1", "nonce-1", goodVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	want := Profile{
+		Provider:      "test",
+		Subject:       "user-1",
+		Email:         "ada@example.com",
+		EmailVerified: true,
+		Username:      "ada",
+		AvatarURL:     "https://idp.example.com/ada.png",
+	}
+	got := *profile
+	got.Claims = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("profile = %+v, want %+v", got, want)
+	}
+}
+
+func TestGoogleExchange(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.idClaims = map[string]interface{}{
+		"email":          "ada@gmail.com",
+		"email_verified": "true",
+		"name":           "Ada Lovelace",
+		"picture":        "https://lh3.example.com/ada",
+	}
+	idp.userInfo = map[string]interface{}{}
+	// The preset points at accounts.google.com, the issuer override keeps
+	// its claim mapping but talks to the mock
+	p := idp.provider(t, ProviderConfig{Type: "google", Issuer: idp.URL})
+	if p.DisplayName != "Google" {
+		t.Errorf("DisplayName = %q, want Google", p.DisplayName)
+	}
+
+	profile, err := login(p, idp, "nonce-1", "nonce-1", goodVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if profile.Subject != "user-1" || profile.Email != "ada@gmail.com" || !profile.EmailVerified ||
+		profile.Username != "Ada Lovelace" || profile.AvatarURL != "https://lh3.example.com/ada" {
+		t.Errorf("profile = %+v", *profile)
+	}
+}
+
+func TestGitHubExchange(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.withIDToken = false
+	idp.userInfo = map[string]interface{}{
+		"id":         float64(583231),
+		"login":      "octocat",
+		"email":      nil,
+		"avatar_url": "https://avatars.example.com/u/583231",
+	}
+	idp.emails = []map[string]interface{}{
+		{"email": "old@example.com", "primary": false, "verified": true},
+		{"email": "octocat@example.com", "primary": true, "verified": true},
+	}
+	p := idp.provider(t, ProviderConfig{
+		Type:        "github",
+		AuthURL:     idp.URL + "/authorize",
+		TokenURL:    idp.URL + "/token",
+		UserInfoURL: idp.URL + "/userinfo",
+	})
+	if p.IsOIDC() {
+		t.Fatal("GitHub provider should not be OpenID Connect")
+	}
+
+	profile, err := login(p, idp, "", "", goodVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if profile.Subject != "583231" || profile.Username != "octocat" ||
+		profile.Email != "octocat@example.com" || !profile.EmailVerified {
+		t.Errorf("profile = %+v", *profile)
+	}
+}
+
+func TestExchangeRefusals(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(idp *mockIdP)
+		nonce    string
+		verifier string
+		check    func(err error) bool
+	}{
+		{
+			name:     "wrong PKCE verifier",
+			nonce:    "nonce-1",
+			verifier: "not-the-verifier-0123456789-0123456789",
+			check:    func(err error) bool { return strings.Contains(err.Error(), "exchanging code") },
+		},
+		{
+			name:     "nonce mismatch",
+			nonce:    "nonce-2",
+			verifier: goodVerifier,
+			check:    func(err error) bool { return errors.Is(err, ErrNonceMismatch) },
+		},
+		{
+			name:     "issuer mismatch",
+			setup:    func(idp *mockIdP) { idp.idIssuer = "https://evil.example.com" },
+			nonce:    "nonce-1",
+			verifier: goodVerifier,
+			check:    func(err error) bool { return strings.Contains(err.Error(), "verifying id_token") },
+		},
+		{
+			name:     "audience mismatch",
+			setup:    func(idp *mockIdP) { idp.idAudience = "another-client" },
+			nonce:    "nonce-1",
+			verifier: goodVerifier,
+			check:    func(err error) bool { return strings.Contains(err.Error(), "verifying id_token") },
+		},
+		{
+			name:     "missing id_token",
+			setup:    func(idp *mockIdP) { idp.withIDToken = false },
+			nonce:    "nonce-1",
+			verifier: goodVerifier,
+			check:    func(err error) bool { return strings.Contains(err.Error(), "no id_token") },
+		},
+	}
+
+	for _, preset := range []string{"oidc", "google"} {
+		for _, tt := range tests {
+			t.Run(preset+"/"+tt.name, func(t *testing.T) {
+				idp := newMockIdP(t)
+				idp.userInfo = map[string]interface{}{}
+				if tt.setup != nil {
+					tt.setup(idp)
+				}
+				p := idp.provider(t, ProviderConfig{Type: preset, Issuer: idp.URL})
+
+				profile, err := login(p, idp, "nonce-1", tt.nonce, tt.verifier)
+				if err == nil {
+					t.Fatalf("Exchange succeeded with profile %+v", *profile)
+				}
+				if !tt.check(err) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestGitHubWrongVerifier(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.withIDToken = false
+	p := idp.provider(t, ProviderConfig{
+		Type:        "github",
+		AuthURL:     idp.URL + "/authorize",
+		TokenURL:    idp.URL + "/token",
+		UserInfoURL: idp.URL + "/userinfo",
+	})
+
+	if _, err := login(p, idp, "", "", "not-the-verifier-0123456789-0123456789"); err == nil {
+		t.Fatal("Exchange succeeded with the wrong PKCE verifier")
+	}
+}
@@ -0,0 +1,219 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// ProviderConfig describes a provider in the providers file or environment.
+// Type is "google", "github" or "oidc"; presets fill in everything but the
+// client credentials, and any field that is set overrides the preset.
+type ProviderConfig struct {
+	Name         string       `json:"name"`
+	Type         string       `json:"type"`
+	DisplayName  string       `json:"display_name"`
+	ClientID     string       `json:"client_id"`
+	ClientSecret string       `json:"client_secret"`
+	RedirectURL  string       `json:"redirect_url"`
+	Issuer       string       `json:"issuer"`
+	Scopes       []string     `json:"scopes"`
+	AuthURL      string       `json:"auth_url"`
+	TokenURL     string       `json:"token_url"`
+	UserInfoURL  string       `json:"user_info_url"`
+	Claims       ClaimMapping `json:"claims"`
+}
+
+var oidcClaims = ClaimMapping{
+	Subject:       "sub",
+	Email:         "email",
+	EmailVerified: "email_verified",
+	Username:      "preferred_username",
+	Avatar:        "picture",
+}
+
+func applyPreset(cfg *ProviderConfig) error {
+	var preset ProviderConfig
+
+	switch cfg.Type {
+	case "google":
+		preset = ProviderConfig{
+			DisplayName: "Google",
+			Issuer:      "https://accounts.google.com",
+			Scopes:      []string{oidc.ScopeOpenID, "email", "profile"},
+			Claims: ClaimMapping{
+				Subject:       "sub",
+				Email:         "email",
+				EmailVerified: "email_verified",
+				Username:      "name",
+				Avatar:        "picture",
+			},
+		}
+	case "github":
+		preset = ProviderConfig{
+			DisplayName: "GitHub",
+			AuthURL:     "https://github.com/login/oauth/authorize",
+			TokenURL:    "https://github.com/login/oauth/access_token",
+			UserInfoURL: "https://api.github.com/user",
+			Scopes:      []string{"read:user", "user:email"},
+			Claims: ClaimMapping{
+				Subject:  "id",
+				Email:    "email",
+				Username: "login",
+				Avatar:   "avatar_url",
+			},
+		}
+	case "oidc":
+		preset = ProviderConfig{
+			DisplayName: cfg.Name,
+			Scopes:      []string{oidc.ScopeOpenID, "email", "profile"},
+			Claims:      oidcClaims,
+		}
+	default:
+		return fmt.Errorf("provider %q has unknown type %q", cfg.Name, cfg.Type)
+	}
+
+	setDefault(&cfg.DisplayName, preset.DisplayName)
+	setDefault(&cfg.Issuer, preset.Issuer)
+	setDefault(&cfg.AuthURL, preset.AuthURL)
+	setDefault(&cfg.TokenURL, preset.TokenURL)
+	setDefault(&cfg.UserInfoURL, preset.UserInfoURL)
+	setDefault(&cfg.Claims.Subject, preset.Claims.Subject)
+	setDefault(&cfg.Claims.Email, preset.Claims.Email)
+	setDefault(&cfg.Claims.EmailVerified, preset.Claims.EmailVerified)
+	setDefault(&cfg.Claims.Username, preset.Claims.Username)
+	setDefault(&cfg.Claims.Avatar, preset.Claims.Avatar)
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = preset.Scopes
+	}
+	return nil
+}
+
+func setDefault(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// New builds a provider from its config. OpenID Connect providers are
+// discovered from their issuer, so this makes network calls.
+func New(ctx context.Context, cfg ProviderConfig, client *http.Client) (*Provider, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("provider name is required")
+	}
+	if err := applyPreset(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, fmt.Errorf("provider %q needs client_id and redirect_url", cfg.Name)
+	}
+
+	p := &Provider{
+		Name:        cfg.Name,
+		DisplayName: cfg.DisplayName,
+		UserInfoURL: cfg.UserInfoURL,
+		Claims:      cfg.Claims,
+		HTTPClient:  client,
+		OAuth2: &oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Scopes:       cfg.Scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  cfg.AuthURL,
+				TokenURL: cfg.TokenURL,
+			},
+		},
+	}
+
+	if cfg.Issuer != "" {
+		discovered, err := oidc.NewProvider(p.context(ctx), cfg.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("discovering %s: %w", cfg.Issuer, err)
+		}
+		endpoint := discovered.Endpoint()
+		setDefault(&p.OAuth2.Endpoint.AuthURL, endpoint.AuthURL)
+		setDefault(&p.OAuth2.Endpoint.TokenURL, endpoint.TokenURL)
+		setDefault(&p.UserInfoURL, discovered.UserInfoEndpoint())
+		p.Verifier = discovered.VerifierContext(p.context(context.Background()), &oidc.Config{ClientID: cfg.ClientID})
+	}
+
+	if p.OAuth2.Endpoint.AuthURL == "" || p.OAuth2.Endpoint.TokenURL == "" {
+		return nil, fmt.Errorf("provider %q needs an issuer or auth_url and token_url", cfg.Name)
+	}
+
+	if cfg.Type == "github" {
+		p.fetchEmail = githubEmail(p.UserInfoURL + "/emails")
+	}
+
+	return p, nil
+}
+
+// githubEmail returns the primary address from the GitHub emails API, since
+// /user only has the address the user chose to make public.
+func githubEmail(url string) func(ctx context.Context, client *http.Client) (string, bool, error) {
+	return func(ctx context.Context, client *http.Client) (string, bool, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return "", false, err
+		}
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", false, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", false, fmt.Errorf("%s returned %s", url, resp.Status)
+		}
+
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&emails); err != nil {
+			return "", false, err
+		}
+		for _, e := range emails {
+			if e.Primary {
+				return e.Email, e.Verified, nil
+			}
+		}
+		return "", false, nil
+	}
+}
+
+type Registry struct {
+	providers map[string]*Provider
+}
+
+func NewRegistry() *Registry {
+	return &Registry{providers: make(map[string]*Provider)}
+}
+
+func (r *Registry) Register(p *Provider) {
+	r.providers[p.Name] = p
+}
+
+func (r *Registry) Get(name string) (*Provider, bool) {
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+// Names returns the registered provider names in alphabetical order.
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Keyring holds numbered AES-256-GCM keys. New data is always encrypted with
+// the current key, older keys are kept around to decrypt data that has not
+// been re-encrypted yet.
+type Keyring struct {
+	current int
+	aeads   map[int]cipher.AEAD
+}
+
+// ParseKeyring reads a list of "id:base64key" pairs separated by commas. The
+// first key is the current one, e.g. "2:bmV3...,1:b2xk...".
+func ParseKeyring(spec string) (*Keyring, error) {
+	k := &Keyring{aeads: make(map[int]cipher.AEAD)}
+
+	for i, part := range strings.Split(spec, ",") {
+		idStr, encoded, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("keyring: entry %d is not id:key", i+1)
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("keyring: invalid key id %q", idStr)
+		}
+		if _, dup := k.aeads[id]; dup {
+			return nil, fmt.Errorf("keyring: duplicate key id %d", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("keyring: key %d must be 32 base64 encoded bytes", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			k.current = id
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// Current returns the ID of the key new data is encrypted with.
+func (k *Keyring) Current() int {
+	return k.current
+}
+
+// Has reports whether key keyID is in the keyring.
+func (k *Keyring) Has(keyID int) bool {
+	_, ok := k.aeads[keyID]
+	return ok
+}
+
+// Encrypt seals plaintext with the current key. aad binds the ciphertext to
+// where it is stored so it cannot be moved to another row.
+func (k *Keyring) Encrypt(plaintext, aad []byte) (int, []byte, error) {
+	aead := k.aeads[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return 0, nil, err
+	}
+	return k.current, aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// Decrypt opens data that was encrypted with key keyID.
+func (k *Keyring) Decrypt(keyID int, data, aad []byte) ([]byte, error) {
+	aead, ok := k.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("keyring: unknown key id %d", keyID)
+	}
+	nonceSize := aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("keyring: ciphertext too short")
+	}
+	return aead.Open(nil, data[:nonceSize], data[nonceSize:], aad)
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// keySpec returns an id:base64key entry with a random key.
+func keySpec(id int) string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return fmt.Sprintf("%d:%s", id, base64.StdEncoding.EncodeToString(key))
+}
+
+func parseKeyring(t *testing.T, specs ...string) *Keyring {
+	t.Helper()
+	k, err := ParseKeyring(strings.Join(specs, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// newTestKeyring returns a keyring with a random key for each ID, the
+// first one current.
+func newTestKeyring(t *testing.T, ids ...int) *Keyring {
+	t.Helper()
+	specs := make([]string, len(ids))
+	for i, id := range ids {
+		specs[i] = keySpec(id)
+	}
+	return parseKeyring(t, specs...)
+}
+
+func newMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, mock
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	k := newTestKeyring(t, 3, 1)
+	if k.Current() != 3 || !k.Has(1) || k.Has(2) {
+		t.Fatalf("keyring current %d", k.Current())
+	}
+
+	keyID, data, err := k.Encrypt([]byte("secret"), []byte("aad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != 3 || strings.Contains(string(data), "secret") {
+		t.Fatalf("Encrypt = %d, %q", keyID, data)
+	}
+	plaintext, err := k.Decrypt(keyID, data, []byte("aad"))
+	if err != nil || string(plaintext) != "secret" {
+		t.Errorf("Decrypt = %q, %v", plaintext, err)
+	}
+
+	// A fresh nonce every time
+	_, again, _ := k.Encrypt([]byte("secret"), []byte("aad"))
+	if string(again) == string(data) {
+		t.Error("two encryptions gave the same ciphertext")
+	}
+}
+
+func TestKeyringDecryptsWithOlderKey(t *testing.T) {
+	old := keySpec(1)
+	_, data, err := parseKeyring(t, old).Encrypt([]byte("secret"), []byte("aad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := parseKeyring(t, keySpec(2), old)
+	plaintext, err := rotated.Decrypt(1, data, []byte("aad"))
+	if err != nil || string(plaintext) != "secret" {
+		t.Errorf("Decrypt with key 1 = %q, %v", plaintext, err)
+	}
+	if _, err := rotated.Decrypt(2, data, []byte("aad")); err == nil {
+		t.Error("decrypted with the wrong key")
+	}
+}
+
+func TestKeyringDecryptRefusals(t *testing.T) {
+	k := newTestKeyring(t, 1)
+	_, data, err := k.Encrypt([]byte("secret"), []byte("oauth_tokens:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name  string
+		keyID int
+		data  []byte
+		aad   string
+	}{
+		{"wrong aad", 1, data, "oauth_tokens:2"},
+		{"unknown key", 9, data, "oauth_tokens:1"},
+		{"tampered", 1, tampered, "oauth_tokens:1"},
+		{"too short", 1, data[:4], "oauth_tokens:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if plaintext, err := k.Decrypt(tt.keyID, tt.data, []byte(tt.aad)); err == nil {
+				t.Errorf("Decrypt = %q, want an error", plaintext)
+			}
+		})
+	}
+}
+
+func TestParseKeyringErrors(t *testing.T) {
+	short := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	for _, spec := range []string{
+		"",
+		"nokey",
+		"0:" + strings.SplitN(keySpec(1), ":", 2)[1],
+		"x:" + strings.SplitN(keySpec(1), ":", 2)[1],
+		"1:" + short,
+		"1:not base64!",
+		keySpec(1) + "," + keySpec(1),
+	} {
+		if _, err := ParseKeyring(spec); err == nil {
+			t.Errorf("ParseKeyring(%q) succeeded", spec)
+		}
+	}
+}
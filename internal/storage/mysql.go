@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// MySQL is a fiber.Storage backed by a MySQL table. Keys are stored as their
+// SHA-256 hash and values are encrypted with AES-GCM, so a leaked table can
+// neither be used to hijack sessions nor read their contents.
+type MySQL struct {
+	db         *sql.DB
+	table      string
+	aead       cipher.AEAD
+	gcInterval time.Duration
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+type MySQLConfig struct {
+	// Table the entries are stored in, defaults to "sessions"
+	Table string
+	// EncryptionKey must be 16, 24 or 32 bytes long
+	EncryptionKey []byte
+	// GCInterval is how often expired entries are deleted, defaults to 10 minutes
+	GCInterval time.Duration
+}
+
+func NewMySQL(db *sql.DB, cfg MySQLConfig) (*MySQL, error) {
+	if cfg.Table == "" {
+		cfg.Table = "sessions"
+	}
+	if cfg.GCInterval <= 0 {
+		cfg.GCInterval = 10 * time.Minute
+	}
+
+	block, err := aes.NewCipher(cfg.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MySQL{
+		db:         db,
+		table:      cfg.Table,
+		aead:       aead,
+		gcInterval: cfg.GCInterval,
+		done:       make(chan struct{}),
+	}
+	go s.gc()
+	return s, nil
+}
+
+// HashKey returns the identifier a key is stored under.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *MySQL) Get(key string) ([]byte, error) {
+	if key == "" {
+		return nil, nil
+	}
+	id := HashKey(key)
+
+	var data []byte
+	var expiresAt sql.NullTime
+	err := s.db.QueryRow("SELECT data, expires_at FROM "+s.table+" WHERE id = ?", id).Scan(&data, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if expiresAt.Valid && !expiresAt.Time.After(time.Now()) {
+		return nil, nil
+	}
+
+	// A row that no longer decrypts was written under a rotated key or is
+	// corrupt. Dropping it logs that one user out instead of failing every
+	// request that carries the old cookie.
+	val, err := s.decrypt(id, data)
+	if err != nil {
+		log.Printf("Session storage: discarding undecryptable session: %v", err)
+		if _, err := s.db.Exec("DELETE FROM "+s.table+" WHERE id = ?", id); err != nil {
+			log.Printf("Session storage: failed to delete undecryptable session: %v", err)
+		}
+		return nil, nil
+	}
+	return val, nil
+}
+
+func (s *MySQL) Set(key string, val []byte, exp time.Duration) error {
+	if key == "" || len(val) == 0 {
+		return nil
+	}
+	id := HashKey(key)
+
+	data, err := s.encrypt(id, val)
+	if err != nil {
+		return err
+	}
+
+	var expiresAt sql.NullTime
+	if exp > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(exp), Valid: true}
+	}
+
+	_, err = s.db.Exec(`
+        INSERT INTO `+s.table+` (id, data, expires_at) VALUES (?, ?, ?)
+        ON DUPLICATE KEY UPDATE data = VALUES(data), expires_at = VALUES(expires_at)
+    `, id, data, expiresAt)
+	return err
+}
+
+func (s *MySQL) Delete(key string) error {
+	if key == "" {
+		return nil
+	}
+	_, err := s.db.Exec("DELETE FROM "+s.table+" WHERE id = ?", HashKey(key))
+	return err
+}
+
+func (s *MySQL) Reset() error {
+	_, err := s.db.Exec("DELETE FROM " + s.table)
+	return err
+}
+
+// Close stops the garbage collector. The database connection is shared with
+// the rest of the app and is left open.
+func (s *MySQL) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *MySQL) gc() {
+	ticker := time.NewTicker(s.gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			_, err := s.db.Exec("DELETE FROM "+s.table+" WHERE expires_at IS NOT NULL AND expires_at <= ?", time.Now())
+			if err != nil {
+				log.Printf("Session storage gc error: %v", err)
+			}
+		}
+	}
+}
+
+// encrypt seals val with a random nonce. The row id is used as additional
+// data so a payload cannot be moved to another row.
+func (s *MySQL) encrypt(id string, val []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, val, []byte(id)), nil
+}
+
+func (s *MySQL) decrypt(id string, data []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("storage: ciphertext too short")
+	}
+	return s.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(id))
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SessionIndex keeps track of which sessions belong to which user so they
+// can be listed and revoked individually. Sessions are referenced by the hash
+// of their ID, the raw ID never leaves the session cookie.
+//
+// When the session data itself lives in a MySQL table, removing a session
+// from the index deletes its data too. Otherwise the data is left to expire,
+// it can no longer be used because Touch rejects unindexed sessions.
+type SessionIndex struct {
+	db *sql.DB
+	// dataTable is the MySQL storage table, empty for other backends
+	dataTable string
+}
+
+type IndexedSession struct {
+	ID         string
+	UserID     int
+	IP         string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// touchInterval limits how often last_seen_at is written for a session
+const touchInterval = time.Minute
+
+func NewSessionIndex(db *sql.DB, dataTable string) *SessionIndex {
+	return &SessionIndex{db: db, dataTable: dataTable}
+}
+
+// Add records that sessionID belongs to userID, replacing any previous entry.
+func (i *SessionIndex) Add(sessionID string, userID int, ip, userAgent string, ttl time.Duration) error {
+	now := time.Now()
+	_, err := i.db.Exec(`
+        INSERT INTO user_sessions (id, user_id, ip, user_agent, created_at, last_seen_at, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE user_id = VALUES(user_id), ip = VALUES(ip), user_agent = VALUES(user_agent),
+            created_at = VALUES(created_at), last_seen_at = VALUES(last_seen_at), expires_at = VALUES(expires_at)
+    `, HashKey(sessionID), userID, ip, Truncate(userAgent, 255), now, now, now.Add(ttl))
+	return err
+}
+
+// Touch reports whether sessionID is still indexed for userID and records
+// the activity.
+func (i *SessionIndex) Touch(sessionID string, userID int, ip string) (bool, error) {
+	id := HashKey(sessionID)
+	now := time.Now()
+
+	var lastSeen time.Time
+	err := i.db.QueryRow(
+		"SELECT last_seen_at FROM user_sessions WHERE id = ? AND user_id = ? AND expires_at > ?",
+		id, userID, now,
+	).Scan(&lastSeen)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if now.Sub(lastSeen) >= touchInterval {
+		_, err = i.db.Exec("UPDATE user_sessions SET last_seen_at = ?, ip = ? WHERE id = ?", now, ip, id)
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// List returns the unexpired sessions of userID, most recently used first.
+func (i *SessionIndex) List(userID int) ([]IndexedSession, error) {
+	rows, err := i.db.Query(`
+        SELECT id, user_id, ip, user_agent, created_at, last_seen_at, expires_at
+        FROM user_sessions
+        WHERE user_id = ? AND expires_at > ?
+        ORDER BY last_seen_at DESC
+    `, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]IndexedSession, 0)
+	for rows.Next() {
+		var s IndexedSession
+		err := rows.Scan(&s.ID, &s.UserID, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// Remove drops sessionID from the index.
+func (i *SessionIndex) Remove(sessionID string) error {
+	_, err := i.db.Exec("DELETE FROM user_sessions WHERE id = ?", HashKey(sessionID))
+	return err
+}
+
+// RemoveByHash drops the session with the given hashed ID if it belongs to
+// userID, and reports whether it did.
+func (i *SessionIndex) RemoveByHash(hash string, userID int) (bool, error) {
+	result, err := i.db.Exec("DELETE FROM user_sessions WHERE id = ? AND user_id = ?", hash, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	if i.dataTable != "" {
+		if _, err := i.db.Exec("DELETE FROM "+i.dataTable+" WHERE id = ?", hash); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// RemoveAll drops every session of userID from the index.
+func (i *SessionIndex) RemoveAll(userID int) error {
+	if i.dataTable != "" {
+		_, err := i.db.Exec(
+			"DELETE FROM "+i.dataTable+" WHERE id IN (SELECT id FROM user_sessions WHERE user_id = ?)",
+			userID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := i.db.Exec("DELETE FROM user_sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// Truncate cuts s to at most n characters, the way VARCHAR(n) counts them,
+// without splitting a multi-byte character.
+func Truncate(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// ErrNoToken is returned when an identity has no stored token.
+var ErrNoToken = errors.New("storage: no token stored")
+
+// TokenStore keeps the OAuth tokens of linked identities encrypted in the
+// oauth_tokens table. The token type and expiry are stored in the clear so
+// expired tokens can be found without decrypting them.
+type TokenStore struct {
+	db   *sql.DB
+	keys *Keyring
+}
+
+type storedToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+	TokenType    string    `json:"token_type,omitempty"`
+	Expiry       time.Time `json:"expiry,omitempty"`
+}
+
+func NewTokenStore(db *sql.DB, keys *Keyring) *TokenStore {
+	return &TokenStore{db: db, keys: keys}
+}
+
+func tokenAAD(identityID int) []byte {
+	return []byte("oauth_tokens:" + strconv.Itoa(identityID))
+}
+
+// Save stores tok for identityID, replacing the previous token.
+func (s *TokenStore) Save(identityID int, tok *oauth2.Token) error {
+	plaintext, err := json.Marshal(storedToken{
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		TokenType:    tok.TokenType,
+		Expiry:       tok.Expiry,
+	})
+	if err != nil {
+		return err
+	}
+	keyID, data, err := s.keys.Encrypt(plaintext, tokenAAD(identityID))
+	if err != nil {
+		return err
+	}
+
+	var expiresAt *time.Time
+	if !tok.Expiry.IsZero() {
+		expiresAt = &tok.Expiry
+	}
+	_, err = s.db.Exec(`
+        INSERT INTO oauth_tokens (identity_id, key_id, data, expires_at, updated_at)
+        VALUES (?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE key_id = VALUES(key_id), data = VALUES(data),
+            expires_at = VALUES(expires_at), updated_at = VALUES(updated_at)
+    `, identityID, keyID, data, expiresAt, time.Now())
+	return err
+}
+
+// Load returns the stored token of identityID, or ErrNoToken.
+func (s *TokenStore) Load(identityID int) (*oauth2.Token, error) {
+	var keyID int
+	var data []byte
+	err := s.db.QueryRow("SELECT key_id, data FROM oauth_tokens WHERE identity_id = ?", identityID).Scan(&keyID, &data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := s.keys.Decrypt(keyID, data, tokenAAD(identityID))
+	if err != nil {
+		return nil, err
+	}
+	var st storedToken
+	if err := json.Unmarshal(plaintext, &st); err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{
+		AccessToken:  st.AccessToken,
+		RefreshToken: st.RefreshToken,
+		TokenType:    st.TokenType,
+		Expiry:       st.Expiry,
+	}, nil
+}
+
+// Delete forgets the token of identityID.
+func (s *TokenStore) Delete(identityID int) error {
+	_, err := s.db.Exec("DELETE FROM oauth_tokens WHERE identity_id = ?", identityID)
+	return err
+}
+
+// TokenSource returns a source for the stored token of identityID that
+// refreshes it through cfg when it expires and saves whatever the provider
+// hands back, so a rotated refresh token is not lost.
+func (s *TokenStore) TokenSource(ctx context.Context, cfg *oauth2.Config, identityID int) (oauth2.TokenSource, error) {
+	tok, err := s.Load(identityID)
+	if err != nil {
+		return nil, err
+	}
+	return &persistingTokenSource{
+		store:      s,
+		identityID: identityID,
+		base:       oauth2.ReuseTokenSource(tok, cfg.TokenSource(ctx, tok)),
+		saved:      tok.AccessToken,
+	}, nil
+}
+
+type persistingTokenSource struct {
+	store      *TokenStore
+	identityID int
+	base       oauth2.TokenSource
+
+	mu    sync.Mutex
+	saved string
+}
+
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := p.base.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if tok.AccessToken != p.saved {
+		if err := p.store.Save(p.identityID, tok); err != nil {
+			return nil, err
+		}
+		p.saved = tok.AccessToken
+	}
+	return tok, nil
+}
+
+// Rotate re-encrypts every token that is not under the current key and
+// returns how many were rewritten. Tokens whose key is no longer in the
+// keyring cannot be recovered and are deleted. Tokens that do not decrypt
+// with a key that is still configured are left alone, the key is more
+// likely wrong than the data, and reported in the error once the rest are
+// done.
+func (s *TokenStore) Rotate() (int, error) {
+	current := s.keys.Current()
+	rotated, failed, lastID := 0, 0, 0
+
+	for {
+		rows, err := s.db.Query(`
+            SELECT identity_id, key_id, data FROM oauth_tokens
+            WHERE key_id <> ? AND identity_id > ?
+            ORDER BY identity_id LIMIT 100
+        `, current, lastID)
+		if err != nil {
+			return rotated, err
+		}
+
+		type row struct {
+			identityID, keyID int
+			data              []byte
+		}
+		var batch []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.identityID, &r.keyID, &r.data); err != nil {
+				rows.Close()
+				return rotated, err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return rotated, err
+		}
+		if len(batch) == 0 {
+			if failed > 0 {
+				return rotated, fmt.Errorf("storage: %d provider tokens could not be decrypted, check OAUTH_TOKEN_KEYS", failed)
+			}
+			return rotated, nil
+		}
+
+		for _, r := range batch {
+			lastID = r.identityID
+			aad := tokenAAD(r.identityID)
+
+			if !s.keys.Has(r.keyID) {
+				_, err = s.db.Exec("DELETE FROM oauth_tokens WHERE identity_id = ? AND key_id = ?", r.identityID, r.keyID)
+				if err != nil {
+					return rotated, err
+				}
+				continue
+			}
+			plaintext, err := s.keys.Decrypt(r.keyID, r.data, aad)
+			if err != nil {
+				log.Printf("Provider token of identity %d does not decrypt with key %d: %v", r.identityID, r.keyID, err)
+				failed++
+				continue
+			}
+			keyID, data, err := s.keys.Encrypt(plaintext, aad)
+			if err != nil {
+				return rotated, err
+			}
+
+			// Skip rows that were saved again since they were read
+			result, err := s.db.Exec(
+				"UPDATE oauth_tokens SET key_id = ?, data = ? WHERE identity_id = ? AND key_id = ?",
+				keyID, data, r.identityID, r.keyID,
+			)
+			if err != nil {
+				return rotated, err
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				rotated++
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"golang.org/x/oauth2"
+)
+
+// sealed records the ciphertext a token was saved with.
+type sealed struct {
+	data []byte
+}
+
+func (s *sealed) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	s.data = b
+	return ok
+}
+
+func expectSave(mock sqlmock.Sqlmock, identityID, keyID int, data *sealed) {
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO oauth_tokens")).
+		WithArgs(identityID, keyID, data, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func expectLoad(mock sqlmock.Sqlmock, identityID, keyID int, data []byte) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT key_id, data FROM oauth_tokens WHERE identity_id = ?")).
+		WithArgs(identityID).
+		WillReturnRows(sqlmock.NewRows([]string{"key_id", "data"}).AddRow(keyID, data))
+}
+
+func TestTokenStoreSaveLoad(t *testing.T) {
+	db, mock := newMock(t)
+	s := NewTokenStore(db, newTestKeyring(t, 2, 1))
+	expiry := time.Now().Add(time.Hour).Round(time.Second)
+
+	data := &sealed{}
+	expectSave(mock, 7, 2, data)
+	err := s.Save(7, &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", TokenType: "Bearer", Expiry: expiry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data.data), "refresh") {
+		t.Fatal("token stored in plain text")
+	}
+
+	expectLoad(mock, 7, 2, data.data)
+	tok, err := s.Load(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "access" || tok.RefreshToken != "refresh" || !tok.Expiry.Equal(expiry) {
+		t.Errorf("Load = %+v", tok)
+	}
+
+	// The ciphertext is bound to identity 7
+	expectLoad(mock, 8, 2, data.data)
+	if _, err := s.Load(8); err == nil {
+		t.Error("token of identity 7 loaded for identity 8")
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT key_id, data FROM oauth_tokens")).
+		WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"key_id", "data"}))
+	if _, err := s.Load(9); err != ErrNoToken {
+		t.Errorf("Load without a token = %v, want ErrNoToken", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenStoreRotate(t *testing.T) {
+	old := keySpec(1)
+	oldKeys := parseKeyring(t, old)
+	_, underOld, err := oldKeys.Encrypt([]byte(`{"access_token":"a"}`), tokenAAD(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sealed for another identity, so it does not open as identity 2's
+	_, misplaced, err := oldKeys.Encrypt([]byte(`{"access_token":"b"}`), tokenAAD(99))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock := newMock(t)
+	s := NewTokenStore(db, parseKeyring(t, keySpec(2), old))
+
+	// Identity 1 is under the old key and re-encrypted. Identity 2 does not
+	// decrypt although its key is configured, it is kept and reported.
+	// Identity 3 is under a key that left the ring and is deleted.
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT identity_id, key_id, data FROM oauth_tokens")).
+		WithArgs(2, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"identity_id", "key_id", "data"}).
+			AddRow(1, 1, underOld).
+			AddRow(2, 1, misplaced).
+			AddRow(3, 5, []byte("gone")))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE oauth_tokens SET key_id = ?, data = ? WHERE identity_id = ? AND key_id = ?")).
+		WithArgs(2, sqlmock.AnyArg(), 1, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM oauth_tokens WHERE identity_id = ? AND key_id = ?")).
+		WithArgs(3, 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT identity_id, key_id, data FROM oauth_tokens")).
+		WithArgs(2, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"identity_id", "key_id", "data"}))
+
+	n, err := s.Rotate()
+	if n != 1 || err == nil || !strings.Contains(err.Error(), "1 provider tokens") {
+		t.Errorf("Rotate = %d, %v, want 1 and one failure", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenSourceSavesRefreshedToken(t *testing.T) {
+	refreshes := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh-1" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		refreshes++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"access-2","refresh_token":"refresh-2","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer srv.Close()
+	cfg := &oauth2.Config{ClientID: "id", Endpoint: oauth2.Endpoint{TokenURL: srv.URL}}
+
+	db, mock := newMock(t)
+	s := NewTokenStore(db, newTestKeyring(t, 1))
+	keyID, expired, err := s.keys.Encrypt(
+		[]byte(`{"access_token":"access-1","refresh_token":"refresh-1","expiry":"2020-01-01T00:00:00Z"}`), tokenAAD(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLoad(mock, 7, keyID, expired)
+
+	ts, err := s.TokenSource(context.Background(), cfg, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The refreshed token, with the rotated refresh token, is saved once
+	data := &sealed{}
+	expectSave(mock, 7, 1, data)
+	for i := 0; i < 2; i++ {
+		tok, err := ts.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken != "access-2" {
+			t.Fatalf("Token = %+v", tok)
+		}
+	}
+	if refreshes != 1 {
+		t.Errorf("refreshed %d times, want 1", refreshes)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := s.keys.Decrypt(1, data.data, tokenAAD(7))
+	if err != nil || !strings.Contains(string(plaintext), `"refresh_token":"refresh-2"`) {
+		t.Errorf("saved %s, %v", plaintext, err)
+	}
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+// TOTPSecrets encrypts the users' TOTP secrets for users.totp_secret, with
+// the ID of the key in users.totp_key_id. Secrets stored before they were
+// encrypted have no key ID and are read as they are until Rotate seals them.
+type TOTPSecrets struct {
+	db   *sql.DB
+	keys *Keyring
+}
+
+func NewTOTPSecrets(db *sql.DB, keys *Keyring) *TOTPSecrets {
+	return &TOTPSecrets{db: db, keys: keys}
+}
+
+func totpAAD(userID int) []byte {
+	return []byte("users.totp_secret:" + strconv.Itoa(userID))
+}
+
+// Seal encrypts secret for userID and returns the key ID and data to store.
+func (s *TOTPSecrets) Seal(userID int, secret string) (int, []byte, error) {
+	return s.keys.Encrypt([]byte(secret), totpAAD(userID))
+}
+
+// Open returns the secret stored for userID. Without a key ID data is a
+// secret stored before encryption.
+func (s *TOTPSecrets) Open(userID int, keyID sql.NullInt64, data []byte) (string, error) {
+	if !keyID.Valid {
+		return string(data), nil
+	}
+	plaintext, err := s.keys.Decrypt(int(keyID.Int64), data, totpAAD(userID))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Rotate seals every secret that is in plain text or not under the current
+// key and returns how many were rewritten. Unlike provider tokens a secret
+// that cannot be decrypted is never deleted, that would quietly turn off
+// the user's second factor. Those are reported in the error.
+func (s *TOTPSecrets) Rotate() (int, error) {
+	current := s.keys.Current()
+	rotated, failed, lastID := 0, 0, 0
+
+	for {
+		rows, err := s.db.Query(`
+            SELECT id, totp_key_id, totp_secret FROM users
+            WHERE totp_secret IS NOT NULL AND (totp_key_id IS NULL OR totp_key_id <> ?) AND id > ?
+            ORDER BY id LIMIT 100
+        `, current, lastID)
+		if err != nil {
+			return rotated, err
+		}
+
+		type row struct {
+			userID int
+			keyID  sql.NullInt64
+			data   []byte
+		}
+		var batch []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.userID, &r.keyID, &r.data); err != nil {
+				rows.Close()
+				return rotated, err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return rotated, err
+		}
+		if len(batch) == 0 {
+			if failed > 0 {
+				return rotated, fmt.Errorf("storage: %d TOTP secrets could not be decrypted, check OAUTH_TOKEN_KEYS", failed)
+			}
+			return rotated, nil
+		}
+
+		for _, r := range batch {
+			lastID = r.userID
+
+			secret, err := s.Open(r.userID, r.keyID, r.data)
+			if err != nil {
+				log.Printf("TOTP secret of user %d does not decrypt with key %d: %v", r.userID, r.keyID.Int64, err)
+				failed++
+				continue
+			}
+			keyID, data, err := s.Seal(r.userID, secret)
+			if err != nil {
+				return rotated, err
+			}
+
+			// Skip secrets that changed since they were read
+			result, err := s.db.Exec(
+				"UPDATE users SET totp_key_id = ?, totp_secret = ? WHERE id = ? AND totp_key_id <=> ? AND totp_secret = ?",
+				keyID, data, r.userID, r.keyID, r.data,
+			)
+			if err != nil {
+				return rotated, err
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				rotated++
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPSecretsSealOpen(t *testing.T) {
+	s := NewTOTPSecrets(nil, newTestKeyring(t, 1))
+
+	keyID, data, err := s.Seal(7, testTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != 1 || bytes.Contains(data, []byte(testTOTPSecret)) {
+		t.Fatalf("Seal = %d, %q", keyID, data)
+	}
+
+	got, err := s.Open(7, sql.NullInt64{Int64: 1, Valid: true}, data)
+	if err != nil || got != testTOTPSecret {
+		t.Errorf("Open = %q, %v", got, err)
+	}
+
+	// The secret is bound to its user
+	if _, err := s.Open(8, sql.NullInt64{Int64: 1, Valid: true}, data); err == nil {
+		t.Error("another user's secret opened")
+	}
+}
+
+func TestTOTPSecretsOpenPlainText(t *testing.T) {
+	s := NewTOTPSecrets(nil, newTestKeyring(t, 1))
+	got, err := s.Open(7, sql.NullInt64{}, []byte(testTOTPSecret))
+	if err != nil || got != testTOTPSecret {
+		t.Errorf("Open = %q, %v", got, err)
+	}
+}
+
+func TestTOTPSecretsRotate(t *testing.T) {
+	old := keySpec(1)
+	_, sealedOld, err := NewTOTPSecrets(nil, parseKeyring(t, old)).Seal(2, testTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, mock := newMock(t)
+	s := NewTOTPSecrets(db, parseKeyring(t, keySpec(2), old))
+
+	// A plain text secret, one under the old key and one under a key that
+	// is gone, which is reported and left in place
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, totp_key_id, totp_secret FROM users")).
+		WithArgs(2, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "totp_key_id", "totp_secret"}).
+			AddRow(1, nil, []byte(testTOTPSecret)).
+			AddRow(2, 1, sealedOld).
+			AddRow(3, 9, []byte("lost")))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET totp_key_id = ?, totp_secret = ?")).
+		WithArgs(2, sqlmock.AnyArg(), 1, nil, []byte(testTOTPSecret)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE users SET totp_key_id = ?, totp_secret = ?")).
+		WithArgs(2, sqlmock.AnyArg(), 2, 1, sealedOld).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, totp_key_id, totp_secret FROM users")).
+		WithArgs(2, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "totp_key_id", "totp_secret"}))
+
+	n, err := s.Rotate()
+	if n != 2 || err == nil || !strings.Contains(err.Error(), "1 TOTP secrets") {
+		t.Errorf("Rotate = %d, %v, want 2 and one failure", n, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
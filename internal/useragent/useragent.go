@@ -0,0 +1,74 @@
+package useragent
+
+import "strings"
+
+// Info is a rough description of the client behind a User-Agent header,
+// good enough to let users recognise their own devices.
+type Info struct {
+	Browser string `json:"browser"`
+	OS      string `json:"os"`
+	Device  string `json:"device"`
+}
+
+// Order matters: Edge and Opera also claim to be Chrome, and Chrome claims
+// to be Safari.
+var browsers = []struct {
+	token string
+	name  string
+}{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+}
+
+var systems = []struct {
+	token string
+	name  string
+}{
+	{"Windows", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iPadOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Macintosh", "macOS"},
+	{"Linux", "Linux"},
+}
+
+func Parse(ua string) Info {
+	info := Info{
+		Browser: "Unknown",
+		OS:      "Unknown",
+		Device:  "Desktop",
+	}
+
+	for _, b := range browsers {
+		if strings.Contains(ua, b.token) {
+			info.Browser = b.name
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(ua, s.token) {
+			info.OS = s.name
+			break
+		}
+	}
+
+	switch {
+	case strings.Contains(ua, "iPad") || strings.Contains(ua, "Tablet"):
+		info.Device = "Tablet"
+	case strings.Contains(ua, "Mobile") || strings.Contains(ua, "iPhone"):
+		info.Device = "Mobile"
+	case info.OS == "Unknown" && info.Browser == "Unknown":
+		info.Device = "Unknown"
+	}
+
+	return info
+}
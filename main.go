@@ -26,13 +26,21 @@ func main() {
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://localhost:5173",
-		AllowMethods:     "GET,POST,PUT,DELETE",
-		AllowHeaders:     "Origin,Content-Type,Accept",
+		AllowMethods:     "GET,POST,PUT,PATCH,DELETE",
+		AllowHeaders:     "Origin,Content-Type,Accept,Authorization,X-CSRF-Token",
+		ExposeHeaders:    "X-Impersonating-User,X-Impersonator",
 		AllowCredentials: true,
 	}))
 
 	// Initialize the session store first
 	config.SetupSessionStore()
+	config.SetupMailer()
+	config.SetupWebAuthn()
+	config.SetupMicrosoftOAuth()
+	config.SetupProviders()
+	config.SetupJWT()
+	config.SetupTokenStore()
+	config.SetupGraphSync()
 
 	// Use the global store from config package
 	routes.SetupRoutes(app, controllers.NewAuthController(config.Store))
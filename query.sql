@@ -2,12 +2,89 @@ CREATE DATABASE IF NOT EXISTS soc_app;
 
 USE soc_app;
 
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(50) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    builtin BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+    name VARCHAR(50) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role VARCHAR(50) NOT NULL,
+    permission VARCHAR(50) NOT NULL,
+    PRIMARY KEY (role, permission),
+    FOREIGN KEY (role) REFERENCES roles(name) ON DELETE CASCADE,
+    FOREIGN KEY (permission) REFERENCES permissions(name) ON DELETE CASCADE
+);
+
+INSERT INTO roles (name, description, builtin) VALUES
+    ('user', 'Every account', TRUE),
+    ('moderator', 'Keeps posts in line', TRUE),
+    ('admin', 'Manages users and roles', TRUE);
+
+INSERT INTO permissions (name, description) VALUES
+    ('posts:create', 'Write posts'),
+    ('posts:update:own', 'Edit own posts'),
+    ('posts:delete:own', 'Delete own posts'),
+    ('posts:update:any', 'Edit anyone''s posts'),
+    ('posts:delete:any', 'Delete anyone''s posts'),
+    ('likes:write', 'Like posts'),
+    ('users:read:any', 'See other users'' account details'),
+    ('roles:assign', 'Change the role of a user'),
+    ('roles:manage', 'Create roles and edit their permissions'),
+    ('users:impersonate', 'Use the app as another user');
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('user', 'posts:create'),
+    ('user', 'posts:update:own'),
+    ('user', 'posts:delete:own'),
+    ('user', 'likes:write'),
+    ('moderator', 'posts:create'),
+    ('moderator', 'posts:update:own'),
+    ('moderator', 'posts:delete:own'),
+    ('moderator', 'likes:write'),
+    ('moderator', 'posts:update:any'),
+    ('moderator', 'posts:delete:any'),
+    ('admin', 'posts:create'),
+    ('admin', 'posts:update:own'),
+    ('admin', 'posts:delete:own'),
+    ('admin', 'likes:write'),
+    ('admin', 'posts:update:any'),
+    ('admin', 'posts:delete:any'),
+    ('admin', 'users:read:any'),
+    ('admin', 'roles:assign'),
+    ('admin', 'roles:manage'),
+    ('admin', 'users:impersonate');
+
 CREATE TABLE IF NOT EXISTS users (
     id INT AUTO_INCREMENT PRIMARY KEY,
     username VARCHAR(50) NOT NULL UNIQUE,
     email VARCHAR(100) NOT NULL UNIQUE,
-    password_hash VARCHAR(255) NOT NULL,
-    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+    password_hash VARCHAR(255),
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    session_epoch INT NOT NULL DEFAULT 0,
+    email_verified_at DATETIME,
+    verification_sent_at DATETIME,
+    totp_secret VARBINARY(255),
+    totp_key_id INT,
+    totp_enabled_at DATETIME,
+    totp_last_step BIGINT,
+    webauthn_user_handle VARBINARY(64) UNIQUE,
+    avatar_url VARCHAR(512),
+    display_name VARCHAR(100),
+    job_title VARCHAR(100),
+    preferred_language VARCHAR(20),
+    profile_overrides SET('display_name', 'avatar', 'job_title', 'preferred_language') NOT NULL DEFAULT '',
+    graph_synced_at DATETIME,
+    graph_sync_attempted_at DATETIME,
+    graph_sync_error VARCHAR(255),
+    role VARCHAR(50) NOT NULL DEFAULT 'user',
+    FOREIGN KEY (role) REFERENCES roles(name)
 );
 
 CREATE TABLE IF NOT EXISTS posts (
@@ -27,10 +104,265 @@ CREATE TABLE IF NOT EXISTS likes (
     user_id INT NOT NULL,
     created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
     UNIQUE KEY user_post_like (user_id, post_id),
+    INDEX idx_likes_post_created (post_id, created_at),
     FOREIGN KEY (post_id) REFERENCES posts(id),
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
+CREATE TABLE IF NOT EXISTS login_attempts (
+    scope ENUM('user', 'ip') NOT NULL,
+    identifier VARCHAR(100) NOT NULL,
+    failures INT NOT NULL DEFAULT 0,
+    locked_until DATETIME,
+    last_failure_at DATETIME NOT NULL,
+    PRIMARY KEY (scope, identifier)
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id CHAR(64) PRIMARY KEY,
+    data BLOB NOT NULL,
+    expires_at DATETIME,
+    INDEX idx_sessions_expires_at (expires_at)
+);
+
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id CHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    last_seen_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    INDEX idx_user_sessions_user_id (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS password_resets (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at DATETIME,
+    UNIQUE KEY user_recovery_code (user_id, code_hash),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    credential_id VARBINARY(255) NOT NULL UNIQUE,
+    public_key BLOB NOT NULL,
+    attestation_type VARCHAR(32) NOT NULL,
+    transports VARCHAR(255) NOT NULL DEFAULT '',
+    aaguid VARBINARY(16),
+    sign_count INT UNSIGNED NOT NULL DEFAULT 0,
+    flags TINYINT UNSIGNED NOT NULL DEFAULT 0,
+    clone_warning BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME NOT NULL,
+    last_used_at DATETIME,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255),
+    email VARCHAR(100),
+    created_at DATETIME NOT NULL,
+    last_login_at DATETIME,
+    UNIQUE KEY provider_subject (provider, subject),
+    INDEX idx_user_identities_user_id (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS oauth_tokens (
+    identity_id INT PRIMARY KEY,
+    key_id INT NOT NULL,
+    data BLOB NOT NULL,
+    expires_at DATETIME,
+    updated_at DATETIME NOT NULL,
+    INDEX idx_oauth_tokens_key_id (key_id),
+    FOREIGN KEY (identity_id) REFERENCES user_identities(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS user_avatars (
+    user_id INT PRIMARY KEY,
+    content_type VARCHAR(50) NOT NULL,
+    data MEDIUMBLOB NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    updated_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INT NOT NULL,
+    role VARCHAR(50) NOT NULL,
+    source VARCHAR(20) NOT NULL DEFAULT 'manual',
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, role),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (role) REFERENCES roles(name) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    prefix VARCHAR(12) NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    last_used_at DATETIME,
+    revoked_at DATETIME,
+    INDEX idx_personal_access_tokens_user_id (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS refresh_token_families (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    revoked_at DATETIME,
+    INDEX idx_refresh_token_families_user_id (user_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    family_id VARCHAR(64) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME,
+    FOREIGN KEY (family_id) REFERENCES refresh_token_families(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS login_codes (
+    code_hash CHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL,
+    code_challenge VARCHAR(128) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS mfa_tokens (
+    token_hash CHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS magic_links (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    email VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    binding_hash CHAR(64) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- One row per event. Stop and expire rows point at the start row through
+-- impersonation_id. No foreign keys so the trail outlives deleted users.
+CREATE TABLE IF NOT EXISTS impersonation_audit (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    impersonation_id BIGINT,
+    event ENUM('start', 'stop', 'expire') NOT NULL,
+    admin_id INT NOT NULL,
+    user_id INT NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    allow_destructive BOOLEAN NOT NULL DEFAULT FALSE,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    INDEX idx_impersonation_audit_admin (admin_id, created_at),
+    INDEX idx_impersonation_audit_user (user_id, created_at)
+);
+
+DELIMITER //
+CREATE TRIGGER impersonation_audit_no_update BEFORE UPDATE ON impersonation_audit
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'impersonation_audit is append-only'//
+CREATE TRIGGER impersonation_audit_no_delete BEFORE DELETE ON impersonation_audit
+FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'impersonation_audit is append-only'//
+DELIMITER ;
+
+-- Apps registered by users so they can act on behalf of other users.
+-- Public clients (mobile, single page apps) have no secret and rely on PKCE.
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    client_id VARCHAR(64) NOT NULL UNIQUE,
+    secret_hash CHAR(64),
+    name VARCHAR(100) NOT NULL,
+    redirect_uris JSON NOT NULL,
+    owner_id INT NOT NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- What a user agreed to let a client do
+CREATE TABLE IF NOT EXISTS oauth_grants (
+    user_id INT NOT NULL,
+    client_id INT NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (user_id, client_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (client_id) REFERENCES oauth_clients(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS oauth_codes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    code_hash CHAR(64) NOT NULL UNIQUE,
+    client_id INT NOT NULL,
+    user_id INT NOT NULL,
+    redirect_uri TEXT NOT NULL,
+    redirect_uri_sent BOOLEAN NOT NULL DEFAULT TRUE,
+    scopes VARCHAR(255) NOT NULL,
+    code_challenge VARCHAR(128) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME,
+    FOREIGN KEY (client_id) REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS oauth_access_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    client_id INT NOT NULL,
+    user_id INT NOT NULL,
+    code_id INT,
+    scopes VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    last_used_at DATETIME,
+    revoked_at DATETIME,
+    INDEX idx_oauth_access_tokens_grant (user_id, client_id),
+    FOREIGN KEY (client_id) REFERENCES oauth_clients(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (code_id) REFERENCES oauth_codes(id) ON DELETE SET NULL
+);
+
 -- Add a test user for development
 INSERT INTO users (username, email, password_hash, created_at)
 VALUES ('testuser', 'test@example.com', 'password123', NOW());
\ No newline at end of file
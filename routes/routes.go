@@ -2,31 +2,115 @@ package routes
 
 import (
 	"go-rest-api/controllers"
+	"go-rest-api/internal/api/handlers/posts"
+	"go-rest-api/internal/auth"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
 )
 
 func SetupRoutes(app *fiber.App, authController *controllers.AuthController) {
+	app.Use(authController.CSRFProtect())
+	app.Use(authController.ImpersonationGuard())
+
+	app.Get("/api/csrf", authController.CSRFToken)
+
 	// Auth routes
 	app.Post("/api/register", authController.Register)
 	app.Post("/api/login", authController.Login)
-	app.Get("/api/user", authController.User)
+	app.Post("/api/login/2fa", authController.LoginTwoFactor)
+	app.Post("/api/login/magic", limiter.New(limiter.Config{
+		Max:        5,
+		Expiration: 15 * time.Minute,
+	}), authController.RequestMagicLink)
+	app.Post("/api/login/magic/verify", authController.VerifyMagicLink)
+	app.Get("/api/user", authController.RequireAuth(controllers.ScopeProfileRead), authController.User)
+	app.Patch("/api/user/profile", authController.UpdateProfile)
+	app.Get("/api/users/:id/avatar", authController.GetAvatar)
 	app.Post("/api/logout", authController.Logout)
+	app.Post("/api/password/forgot", limiter.New(limiter.Config{
+		Max:        5,
+		Expiration: 15 * time.Minute,
+	}), authController.ForgotPassword)
+	app.Post("/api/password/reset", authController.ResetPassword)
+	app.Post("/api/email/verify", authController.VerifyEmail)
+	app.Post("/api/email/verify/resend", limiter.New(limiter.Config{
+		Max:        5,
+		Expiration: 15 * time.Minute,
+	}), authController.ResendVerification)
+
+	app.Post("/api/2fa/enroll", authController.EnrollTwoFactor)
+	app.Post("/api/2fa/confirm", authController.ConfirmTwoFactor)
+	app.Post("/api/2fa/disable", authController.DisableTwoFactor)
+
+	app.Post("/api/passkeys/register/begin", authController.BeginPasskeyRegistration)
+	app.Post("/api/passkeys/register/finish", authController.FinishPasskeyRegistration)
+	app.Post("/api/passkeys/login/begin", authController.BeginPasskeyLogin)
+	app.Post("/api/passkeys/login/finish", authController.FinishPasskeyLogin)
+	app.Get("/api/passkeys", authController.ListPasskeys)
+	app.Delete("/api/passkeys/:id", authController.DeletePasskey)
+
+	app.Post("/api/token", authController.Token)
+	app.Post("/api/token/revoke", authController.RevokeToken)
+	app.Get("/.well-known/jwks.json", authController.JWKS)
+
+	app.Post("/api/tokens", authController.CreateAccessToken)
+	app.Get("/api/tokens", authController.ListAccessTokens)
+	app.Delete("/api/tokens/:id", authController.RevokeAccessToken)
+
+	app.Get("/api/sessions", authController.ListSessions)
+	app.Delete("/api/sessions/:id", authController.RevokeSession)
+
+	app.Get("/api/identities", authController.ListIdentities)
+	app.Post("/api/identities/:provider", authController.LinkIdentity)
+	app.Delete("/api/identities/:id", authController.UnlinkIdentity)
+
+	manageRoles := authController.RequirePermission(auth.PermRolesManage)
+	app.Get("/api/admin/permissions", authController.RequireAuth(), manageRoles, authController.ListPermissions)
+	app.Get("/api/admin/roles", authController.RequireAuth(), manageRoles, authController.ListRoles)
+	app.Post("/api/admin/roles", authController.RequireAuth(), manageRoles, authController.CreateRole)
+	app.Put("/api/admin/roles/:name/permissions", authController.RequireAuth(), manageRoles, authController.UpdateRolePermissions)
+	app.Delete("/api/admin/roles/:name", authController.RequireAuth(), manageRoles, authController.DeleteRole)
+	app.Put("/api/admin/users/:id/role", authController.RequireAuth(),
+		authController.RequirePermission(auth.PermRolesAssign), authController.AssignRole)
+
+	impersonate := authController.RequirePermission(auth.PermUsersImpersonate)
+	app.Post("/api/admin/impersonate", authController.RequireAuth(), impersonate, authController.StartImpersonation)
+	app.Post("/api/admin/impersonate/stop", authController.StopImpersonation)
+	app.Get("/api/admin/impersonations", authController.RequireAuth(), impersonate, authController.ListImpersonations)
 
 	app.Get("/auth/microsoft", authController.MicrosoftLogin)
 	app.Get("/auth/microsoft/callback", authController.MicrosoftCallback)
+	app.Get("/auth/:provider", authController.ProviderLogin)
+	app.Get("/auth/:provider/callback", authController.ProviderCallback)
 
 	app.Get("/login", authController.LoginPage)
 
-	// Posts routes - convert your handlers to work with Fiber
-	app.Get("/posts", func(c *fiber.Ctx) error {
+	app.Get("/oauth/authorize", authController.Authorize)
+	app.Post("/oauth/authorize", authController.Consent)
+	app.Post("/oauth/token", authController.OAuthToken)
+	app.Post("/oauth/introspect", authController.Introspect)
+	app.Post("/oauth/revoke", authController.RevokeAppToken)
 
-		return c.SendString("Posts endpoint")
-	})
+	app.Post("/api/oauth/clients", authController.RegisterOAuthClient)
+	app.Get("/api/oauth/clients", authController.ListOAuthClients)
+	app.Delete("/api/oauth/clients/:client_id", authController.DeleteOAuthClient)
+	app.Get("/api/oauth/grants", authController.ListOAuthGrants)
+	app.Delete("/api/oauth/grants/:client_id", authController.RevokeOAuthGrant)
 
-	app.Get("/posts/:id", func(c *fiber.Ctx) error {
-		return c.SendString("Get post endpoint")
-	})
+	// Posts routes
+	writePosts := authController.RequireUser(controllers.ScopePostsWrite)
+	readPosts := authController.OptionalUser(controllers.ScopePostsRead)
+	app.Get("/api/posts", readPosts, posts.GetPostsHandler)
+	app.Get("/api/posts/:id", readPosts, posts.GetPostHandler)
+	app.Get("/api/posts/:id/likes", readPosts, posts.GetPostLikesHandler)
+	app.Put("/api/posts/:id/like", writePosts, posts.LikePostHandler)
+	app.Delete("/api/posts/:id/like", writePosts, posts.UnlikePostHandler)
+	app.Post("/api/posts", writePosts, posts.AddPostHandler)
+	app.Put("/api/posts/:id", writePosts, posts.UpdatePostHandler)
+	app.Patch("/api/posts/:id", writePosts, posts.PatchPostHandler)
+	app.Delete("/api/posts/:id", writePosts, posts.DeletePostHandler)
 
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Welcome to the API")